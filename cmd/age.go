@@ -0,0 +1,119 @@
+/*
+	Copyright © 2022 Funtoo Macaroni OS Linux
+	See AUTHORS and LICENSE for the license details and contributors.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	tablewriter "github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var ageCmd = &cobra.Command{
+	Use:   "age",
+	Short: "Manage the aging of the passwords and of the accounts.",
+}
+
+var ageReportCmd = &cobra.Command{
+	Use:          "report",
+	SilenceUsage: true,
+	Short:        "Report the aging status of the accounts.",
+	Long: `
+Report the aging status of the accounts of the shadow file:
+
+  expired      the account is expired.
+  inactive     the password is expired and the inactivity period is over.
+  change-due   the password must be changed.
+  warning      the password expires in the warning period.
+  ok           none of the above.
+
+The status is computed for today or for the day of the option --date.
+
+To read /etc/shadow requires root permissions.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shadowFile, _ := cmd.Flags().GetString("shadow-file")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		problems, _ := cmd.Flags().GetBool("problems")
+		date, _ := cmd.Flags().GetString("date")
+
+		today := Today()
+		if date != "" {
+			var err error
+			today, err = ParseShadowDate(date)
+			if err != nil {
+				return err
+			}
+		}
+
+		db := NewDatabaseFromPaths(map[string]string{ShadowKind: shadowFile})
+		entries, err := AgingReport(db, today)
+		if err != nil {
+			return err
+		}
+
+		if problems {
+			res := []AgingEntry{}
+			for _, e := range entries {
+				if e.Status != AgingOk {
+					res = append(res, e)
+				}
+			}
+			entries = res
+		}
+
+		if jsonOutput {
+			data, _ := json.Marshal(entries)
+			fmt.Println(string(data))
+			return nil
+		}
+
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetBorders(tablewriter.Border{
+			Left:   true,
+			Top:    true,
+			Right:  true,
+			Bottom: true,
+		})
+		table.SetColWidth(50)
+		table.SetHeader([]string{
+			"Username", "Status", "Last Password Change", "Password Expires",
+			"Inactive From", "Account Expires",
+		})
+		for _, e := range entries {
+			if e.Message != "" {
+				table.Append([]string{e.Username, "invalid", e.Message, "", "", ""})
+				continue
+			}
+			table.Append([]string{
+				e.Username,
+				e.Status,
+				FormatShadowDate(e.Aging.LastChanged),
+				FormatShadowDate(e.Aging.PasswordExpiration()),
+				FormatShadowDate(e.Aging.InactiveFrom()),
+				FormatShadowDate(e.Aging.Expire),
+			})
+		}
+		table.Render()
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(ageCmd)
+	ageCmd.AddCommand(ageReportCmd)
+
+	var flags = ageReportCmd.Flags()
+	flags.String("shadow-file", ShadowDefault(""), "Define custom shadow file.")
+	flags.String("date", "", "Compute the status for the date YYYY-MM-DD instead of today.")
+	flags.Bool("problems", false, "Show only the accounts with a status different from ok.")
+	flags.Bool("json", false, "Show in JSON format.")
+}
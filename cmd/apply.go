@@ -24,7 +24,43 @@ var applyCmd = &cobra.Command{
 			return err
 		}
 
-		return entity.Apply(entityFile, safe)
+		var idLock *IdLock
+		lockFile, _ := cmd.Flags().GetString("lockfile")
+		if lockFile != "" {
+			idLock, err = LoadIdLock(lockFile)
+			if err != nil {
+				return err
+			}
+		}
+
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if dryRun {
+			jsonOutput, _ := cmd.Flags().GetBool("json")
+			return planEntity(entity, planApply, safe, jsonOutput, idLock)
+		}
+
+		if idLock == nil {
+			return entity.Apply(entityFile, safe)
+		}
+
+		tx, err := newEntityTransaction(entity)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		tx.SetIdLock(idLock)
+
+		err = tx.Apply(entity, safe)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+
+		return idLock.Write(lockFile)
 	},
 }
 
@@ -34,4 +70,8 @@ func init() {
 	var flags = applyCmd.Flags()
 	flags.Bool("safe", false,
 		"Avoid to override existing entity if it has difference or if the id is used in a different way.")
+	flags.String("lockfile", "",
+		"Read and store the ids assigned to the dynamic users and groups in the specified file (e.g. "+
+			IdLockDefaultFile+").")
+	addPlanFlags(flags)
 }
@@ -25,24 +25,26 @@ type EntityDifference struct {
 	Missing        bool   `json:"missing" yaml:"missing"`
 }
 
-func getCurrentStatus(store *EntitiesStore, usersFile, groupsFile, shadowFile, gshadowFile string) error {
+func getCurrentStatus(store *EntitiesStore, usersFile, groupsFile, shadowFile, gshadowFile,
+	subuidFile, subgidFile string) error {
 
-	mUsers, err := ParseUser(usersFile)
+	mUsers, err := ParseUser(UserDefault(usersFile))
 	if err != nil {
 		return err
 	}
 
-	mGroups, err := ParseGroup(groupsFile)
+	mGroups, err := ParseGroup(GroupsDefault(groupsFile))
 	if err != nil {
 		return err
 	}
 
-	mShadows, err := ParseShadow(shadowFile)
+	mShadows, err := ParseShadow(ShadowDefault(shadowFile))
 	if err != nil {
 		return err
 	}
 
 	// GShadow file could be not present
+	gshadowFile = GShadowDefault(gshadowFile)
 	_, err = os.Stat(gshadowFile)
 	if err == nil {
 		mGShadows, err := ParseGShadow(gshadowFile)
@@ -54,14 +56,26 @@ func getCurrentStatus(store *EntitiesStore, usersFile, groupsFile, shadowFile, g
 		return err
 	}
 
+	mSubUids, err := ParseSubUid(SubUidDefault(subuidFile))
+	if err != nil {
+		return err
+	}
+
+	mSubGids, err := ParseSubGid(SubGidDefault(subgidFile))
+	if err != nil {
+		return err
+	}
+
 	store.Users = mUsers
 	store.Groups = mGroups
 	store.Shadows = mShadows
+	store.SubUids = mSubUids
+	store.SubGids = mSubGids
 
 	return nil
 }
 
-func compare(currentStore, store *EntitiesStore, jsonOutput bool) error {
+func compare(currentStore, store *EntitiesStore, policy HashPolicy, jsonOutput bool) error {
 
 	differences := []EntityDifference{}
 
@@ -131,6 +145,11 @@ func compare(currentStore, store *EntitiesStore, jsonOutput bool) error {
 			continue
 		}
 
+		// The dates and the durations of the specs are compared as days.
+		if n, err := s.NormalizeAging(); err == nil {
+			s = n
+		}
+
 		if cShadow.MinimumChanged != s.MinimumChanged ||
 			cShadow.MaximumChanged != s.MaximumChanged ||
 			cShadow.Warn != s.Warn ||
@@ -144,6 +163,18 @@ func compare(currentStore, store *EntitiesStore, jsonOutput bool) error {
 				Descr:          fmt.Sprintf("Shadow with user %s has difference.", name),
 			})
 		}
+
+		// The hashes of the locked passwords are ignored.
+		if err := policy.Check(cShadow.Password); errors.Is(err, ErrWeakHash) {
+			differences = append(differences, EntityDifference{
+				OriginalEntity: cShadow,
+				TargetEntity:   s,
+				Missing:        false,
+				Kind:           s.GetKind(),
+				Descr: fmt.Sprintf("Shadow with user %s has a weak password hash: %s.",
+					name, err.Error()),
+			})
+		}
 	}
 
 	// Check gshadow
@@ -172,6 +203,56 @@ func compare(currentStore, store *EntitiesStore, jsonOutput bool) error {
 		}
 	}
 
+	// Check subuid
+	for name, s := range store.SubUids {
+		cSubUid, ok := currentStore.GetSubUid(name)
+		if !ok {
+			differences = append(differences, EntityDifference{
+				TargetEntity: s,
+				Missing:      true,
+				Kind:         s.GetKind(),
+				Descr:        fmt.Sprintf("SubUid of user %s is not present.", name),
+			})
+			continue
+		}
+
+		if (s.Start > 0 && cSubUid.Start != s.Start) ||
+			(s.Count > 0 && cSubUid.Count != s.Count) {
+			differences = append(differences, EntityDifference{
+				OriginalEntity: cSubUid,
+				TargetEntity:   s,
+				Missing:        false,
+				Kind:           s.GetKind(),
+				Descr:          fmt.Sprintf("SubUid of user %s has difference.", name),
+			})
+		}
+	}
+
+	// Check subgid
+	for name, s := range store.SubGids {
+		cSubGid, ok := currentStore.GetSubGid(name)
+		if !ok {
+			differences = append(differences, EntityDifference{
+				TargetEntity: s,
+				Missing:      true,
+				Kind:         s.GetKind(),
+				Descr:        fmt.Sprintf("SubGid of user %s is not present.", name),
+			})
+			continue
+		}
+
+		if (s.Start > 0 && cSubGid.Start != s.Start) ||
+			(s.Count > 0 && cSubGid.Count != s.Count) {
+			differences = append(differences, EntityDifference{
+				OriginalEntity: cSubGid,
+				TargetEntity:   s,
+				Missing:        false,
+				Kind:           s.GetKind(),
+				Descr:          fmt.Sprintf("SubGid of user %s has difference.", name),
+			})
+		}
+	}
+
 	if jsonOutput {
 		data, _ := json.Marshal(differences)
 		fmt.Println(string(data))
@@ -199,6 +280,10 @@ func compare(currentStore, store *EntitiesStore, jsonOutput bool) error {
 				name = (d.TargetEntity.(Group)).Name
 			case GShadowKind:
 				name = (d.TargetEntity.(GShadow)).Name
+			case SubUidKind:
+				name = (d.TargetEntity.(SubUid)).Username
+			case SubGidKind:
+				name = (d.TargetEntity.(SubGid)).Username
 			}
 
 			table.Append([]string{
@@ -223,6 +308,9 @@ var compareCmd = &cobra.Command{
 	Long: `
 Compare entities of the system with the specs available in the specified directory.
 
+The password hashes of the shadow entries of the specs that don't meet the hash
+policy (see the passwd check command) are reported as differences.
+
 To read /etc/shadow and /etc/gshadow requires root permissions.
 `,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -238,6 +326,8 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 		groupsFile, _ := cmd.Flags().GetString("groups-file")
 		shadowFile, _ := cmd.Flags().GetString("shadow-file")
 		gShadowFile, _ := cmd.Flags().GetString("gshadow-file")
+		subuidFile, _ := cmd.Flags().GetString("subuid-file")
+		subgidFile, _ := cmd.Flags().GetString("subgid-file")
 		jsonOutput, _ := cmd.Flags().GetBool("json")
 
 		currentStore := NewEntitiesStore()
@@ -249,6 +339,7 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 		// Retrieve current information
 		err = getCurrentStatus(currentStore,
 			usersFile, groupsFile, shadowFile, gShadowFile,
+			subuidFile, subgidFile,
 		)
 		if err != nil {
 			return errors.New(
@@ -256,7 +347,16 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 			)
 		}
 
-		err = compare(currentStore, store, jsonOutput)
+		l, err := ParseLoginDefs(LoginDefsDefault(""))
+		if err != nil {
+			return err
+		}
+		policy, err := NewHashPolicy(l)
+		if err != nil {
+			return err
+		}
+
+		err = compare(currentStore, store, policy, jsonOutput)
 		if err != nil {
 			return errors.New(
 				"Error on compare entities stores: " + err.Error(),
@@ -277,5 +377,7 @@ func init() {
 	flags.String("groups-file", GroupsDefault(""), "Define custom groups file.")
 	flags.String("shadow-file", ShadowDefault(""), "Define custom shadow file.")
 	flags.String("gshadow-file", GShadowDefault(""), "Define custom gshadow file.")
+	flags.String("subuid-file", SubUidDefault(""), "Define custom subuid file.")
+	flags.String("subgid-file", SubGidDefault(""), "Define custom subgid file.")
 	flags.Bool("json", false, "Show in JSON format.")
 }
@@ -22,10 +22,18 @@ var createCmd = &cobra.Command{
 			return err
 		}
 
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if dryRun {
+			jsonOutput, _ := cmd.Flags().GetBool("json")
+			return planEntity(entity, planCreate, false, jsonOutput, nil)
+		}
+
 		return entity.Create(entityFile)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(createCmd)
+
+	addPlanFlags(createCmd.Flags())
 }
@@ -0,0 +1,74 @@
+/*
+	Copyright © 2022 Funtoo Macaroni OS Linux
+	See AUTHORS and LICENSE for the license details and contributors.
+*/
+
+package cmd
+
+import (
+	. "github.com/geaaru/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func addDatabaseFlags(flags *pflag.FlagSet) {
+	flags.String("users-file", UserDefault(""), "Define custom users file.")
+	flags.String("groups-file", GroupsDefault(""), "Define custom groups file.")
+	flags.String("shadow-file", ShadowDefault(""), "Define custom shadow file.")
+	flags.String("gshadow-file", GShadowDefault(""), "Define custom gshadow file.")
+}
+
+// newCmdDatabase creates the database of the files defined by the
+// flags of the command.
+func newCmdDatabase(cmd *cobra.Command) *Database {
+	usersFile, _ := cmd.Flags().GetString("users-file")
+	groupsFile, _ := cmd.Flags().GetString("groups-file")
+	shadowFile, _ := cmd.Flags().GetString("shadow-file")
+	gShadowFile, _ := cmd.Flags().GetString("gshadow-file")
+
+	return NewDatabase(usersFile, groupsFile, shadowFile, gShadowFile)
+}
+
+// newCmdTransaction creates the transaction of the files defined by
+// the flags of the command.
+func newCmdTransaction(cmd *cobra.Command) (*Transaction, error) {
+	usersFile, _ := cmd.Flags().GetString("users-file")
+	groupsFile, _ := cmd.Flags().GetString("groups-file")
+	shadowFile, _ := cmd.Flags().GetString("shadow-file")
+	gShadowFile, _ := cmd.Flags().GetString("gshadow-file")
+
+	return NewTransaction(usersFile, groupsFile, shadowFile, gShadowFile)
+}
+
+// newEntityTransaction creates the transaction that locks the file of
+// the entity and the default files of the other kinds that the entity
+// could modify (e.g. the group of a user with create_group).
+func newEntityTransaction(entity Entity) (*Transaction, error) {
+	paths := map[string]string{}
+	for _, kind := range EntityKinds(entity) {
+		paths[kind] = ""
+	}
+	paths[entity.GetKind()] = entityFile
+
+	return NewTransactionFromPaths(paths)
+}
+
+// commitCmdTransaction writes the changes of the transaction or shows
+// them with --dry-run.
+func commitCmdTransaction(cmd *cobra.Command, tx *Transaction) error {
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+
+	if dryRun {
+		plans, err := tx.Plan()
+		if err != nil {
+			return err
+		}
+		printPlan(plans, jsonOutput)
+
+		return tx.Validate()
+	}
+
+	return tx.Commit()
+}
@@ -5,6 +5,8 @@
 package cmd
 
 import (
+	"errors"
+
 	. "github.com/geaaru/entities/pkg/entities"
 	"github.com/spf13/cobra"
 )
@@ -22,10 +24,27 @@ var deleteCmd = &cobra.Command{
 			return err
 		}
 
-		return entity.Delete(entityFile)
+		missingOk, _ := cmd.Flags().GetBool("missing-ok")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if dryRun {
+			jsonOutput, _ := cmd.Flags().GetBool("json")
+			err = planEntity(entity, planDelete, false, jsonOutput, nil)
+		} else {
+			err = entity.Delete(entityFile)
+		}
+
+		if err != nil && missingOk && errors.Is(err, ErrNotFound) {
+			return nil
+		}
+
+		return err
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(deleteCmd)
+
+	var flags = deleteCmd.Flags()
+	flags.Bool("missing-ok", false, "Don't return an error if the entity is not present.")
+	addPlanFlags(flags)
 }
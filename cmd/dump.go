@@ -47,7 +47,7 @@ func writeUsers(store *EntitiesStore, targetDir string) error {
 
 			err = ioutil.WriteFile(file, data, 0755)
 			if err != nil {
-				return errors.New(fmt.Sprint(
+				return errors.New(fmt.Sprintf(
 					"Error on write file %s: %s",
 					file, err.Error()))
 			}
@@ -88,7 +88,7 @@ func writeGroups(store *EntitiesStore, targetDir string) error {
 
 			err = ioutil.WriteFile(file, data, 0755)
 			if err != nil {
-				return errors.New(fmt.Sprint(
+				return errors.New(fmt.Sprintf(
 					"Error on write file %s: %s",
 					file, err.Error()))
 			}
@@ -129,7 +129,7 @@ func writeShadows(store *EntitiesStore, targetDir string) error {
 
 			err = ioutil.WriteFile(file, data, 0755)
 			if err != nil {
-				return errors.New(fmt.Sprint(
+				return errors.New(fmt.Sprintf(
 					"Error on write file %s: %s",
 					file, err.Error()))
 			}
@@ -170,7 +170,7 @@ func writeGShadows(store *EntitiesStore, targetDir string) error {
 
 			err = ioutil.WriteFile(file, data, 0755)
 			if err != nil {
-				return errors.New(fmt.Sprint(
+				return errors.New(fmt.Sprintf(
 					"Error on write file %s: %s",
 					file, err.Error()))
 			}
@@ -181,6 +181,61 @@ func writeGShadows(store *EntitiesStore, targetDir string) error {
 	return nil
 }
 
+func writeSubIds(store *EntitiesStore, targetDir string) error {
+	subids := map[string]map[string]Entity{
+		SubUidKind: make(map[string]Entity, 0),
+		SubGidKind: make(map[string]Entity, 0),
+	}
+	for k, e := range store.SubUids {
+		subids[SubUidKind][k] = e
+	}
+	for k, e := range store.SubGids {
+		subids[SubGidKind][k] = e
+	}
+
+	for _, kind := range []string{SubUidKind, SubGidKind} {
+		entities := subids[kind]
+		if len(entities) == 0 {
+			continue
+		}
+
+		dir := filepath.Join(targetDir, kind+"s")
+		fmt.Println(fmt.Sprintf(
+			"Creating %d %ss under the directory %s", len(entities), kind, dir))
+
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return errors.New(fmt.Sprintf(
+				"Error on creating directory %s: %s",
+				dir, err.Error()),
+			)
+		}
+
+		for k, e := range entities {
+
+			file := filepath.Join(dir, fmt.Sprintf(
+				"entity_%s_%s.yaml", kind, k))
+
+			m := e.ToMap()
+			data, err := yaml.Marshal(m)
+			if err != nil {
+				return errors.New(fmt.Sprintf(
+					"Error on marshal %s %s: %s",
+					kind, k, err.Error()))
+			}
+
+			err = ioutil.WriteFile(file, data, 0755)
+			if err != nil {
+				return errors.New(fmt.Sprintf(
+					"Error on write file %s: %s",
+					file, err.Error()))
+			}
+		}
+	}
+
+	return nil
+}
+
 var dumpCmd = &cobra.Command{
 	Use:   "dump",
 	Short: "Dump current system status in entities format",
@@ -202,12 +257,15 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 		groupsFile, _ := cmd.Flags().GetString("groups-file")
 		shadowFile, _ := cmd.Flags().GetString("shadow-file")
 		gShadowFile, _ := cmd.Flags().GetString("gshadow-file")
+		subuidFile, _ := cmd.Flags().GetString("subuid-file")
+		subgidFile, _ := cmd.Flags().GetString("subgid-file")
 
 		store := NewEntitiesStore()
 
 		// Retrieve current information
 		err := getCurrentStatus(store,
 			usersFile, groupsFile, shadowFile, gShadowFile,
+			subuidFile, subgidFile,
 		)
 		if err != nil {
 			return errors.New(
@@ -235,6 +293,11 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 			return err
 		}
 
+		err = writeSubIds(store, targetDir)
+		if err != nil {
+			return err
+		}
+
 		fmt.Println("All done.")
 
 		return nil
@@ -251,4 +314,6 @@ func init() {
 	flags.String("groups-file", GroupsDefault(""), "Define custom groups file.")
 	flags.String("shadow-file", ShadowDefault(""), "Define custom shadow file.")
 	flags.String("gshadow-file", GShadowDefault(""), "Define custom gshadow file.")
+	flags.String("subuid-file", SubUidDefault(""), "Define custom subuid file.")
+	flags.String("subgid-file", SubGidDefault(""), "Define custom subgid file.")
 }
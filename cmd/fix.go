@@ -0,0 +1,116 @@
+/*
+	Copyright © 2022 Funtoo Macaroni OS Linux
+	See AUTHORS and LICENSE for the license details and contributors.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+type fixOutput struct {
+	Fixes   []FixAction `json:"fixes"`
+	Changes []FilePlan  `json:"changes,omitempty"`
+}
+
+func printFixReport(report *FixReport, plans []FilePlan, dryRun, jsonOutput bool) {
+	if jsonOutput {
+		data, _ := json.Marshal(fixOutput{
+			Fixes:   report.Fixes,
+			Changes: plans,
+		})
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(report.Fixes) == 0 {
+		fmt.Println("Nothing to fix.")
+		return
+	}
+
+	for _, f := range report.Fixes {
+		fmt.Println(fmt.Sprintf("[%s] %s: %s", f.Fix, f.File, f.Message))
+	}
+
+	if dryRun {
+		fmt.Println()
+		printPlan(plans, false)
+	} else {
+		fmt.Println(fmt.Sprintf("%d fixes applied.", len(report.Fixes)))
+	}
+}
+
+var fixCmd = &cobra.Command{
+	Use:          "fix",
+	SilenceUsage: true,
+	Short:        "Repair the inconsistencies of the entities files.",
+	Long: `
+Repair the inconsistencies of the passwd, group, shadow and gshadow files
+that could be fixed without loss of information:
+
+  - create the missing shadow and gshadow entries with a locked password
+  - remove empty and duplicated names from the members lists
+  - with --sort, sort the entries by id
+  - with --drop-orphans, drop the shadow and gshadow entries without
+    user or group (their passwords are lost)
+
+The other problems reported by the validate command must be fixed manually.
+
+To read /etc/shadow and /etc/gshadow requires root permissions.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sortEntries, _ := cmd.Flags().GetBool("sort")
+		dropOrphans, _ := cmd.Flags().GetBool("drop-orphans")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		tx, err := newCmdTransaction(cmd)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		report, err := FixDatabase(tx.GetDatabase(), FixOptions{
+			Sort:        sortEntries,
+			DropOrphans: dropOrphans,
+		})
+		if err != nil {
+			return err
+		}
+
+		var plans []FilePlan
+		if dryRun {
+			plans, err = tx.Plan()
+			if err != nil {
+				return err
+			}
+		} else {
+			err = tx.Commit()
+			if err != nil {
+				return err
+			}
+		}
+
+		printFixReport(report, plans, dryRun, jsonOutput)
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fixCmd)
+
+	var flags = fixCmd.Flags()
+	addDatabaseFlags(flags)
+	flags.Bool("sort", false, "Sort the entries by id.")
+	flags.Bool("drop-orphans", false,
+		"Remove the shadow and gshadow entries without user or group.")
+	flags.Bool("dry-run", false, "Show the fixes without write them.")
+	flags.Bool("json", false, "Show the fixes in JSON format.")
+}
@@ -0,0 +1,106 @@
+/*
+	Copyright © 2022 Funtoo Macaroni OS Linux
+	See AUTHORS and LICENSE for the license details and contributors.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+var groupCmd = &cobra.Command{
+	Use:   "group",
+	Short: "Manage the groups.",
+}
+
+// runGroupMembersCmd runs the operation over the members of the group
+// of the first argument with the users of the other arguments.
+func runGroupMembersCmd(cmd *cobra.Command, args []string, msg string,
+	op func(tx *Transaction, group string, users ...string) error) error {
+
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	tx, err := newCmdTransaction(cmd)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = op(tx, args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+
+	err = commitCmdTransaction(cmd, tx)
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		fmt.Println(fmt.Sprintf(msg, args[0]))
+	}
+
+	return nil
+}
+
+var groupAddMemberCmd = &cobra.Command{
+	Use:          "add-member <group> <user> [<user>...]",
+	SilenceUsage: true,
+	Short:        "Add users to the members of a group.",
+	Long: `
+Add the users to the members of the group in the group and gshadow files.
+The users must be present in the passwd file.
+`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runGroupMembersCmd(cmd, args, "Members of the group %s updated.",
+			(*Transaction).AddGroupMembers)
+	},
+}
+
+var groupRemoveMemberCmd = &cobra.Command{
+	Use:          "remove-member <group> <user> [<user>...]",
+	SilenceUsage: true,
+	Short:        "Remove users from the members of a group.",
+	Long: `
+Remove the users from the members of the group in the group and gshadow
+files.
+`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runGroupMembersCmd(cmd, args, "Members of the group %s updated.",
+			(*Transaction).RemoveGroupMembers)
+	},
+}
+
+var groupSetMembersCmd = &cobra.Command{
+	Use:          "set-members <group> [<user>...]",
+	SilenceUsage: true,
+	Short:        "Replace the members of a group.",
+	Long: `
+Replace the members of the group in the group and gshadow files with the
+users defined. Without users all the members are removed.
+`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runGroupMembersCmd(cmd, args, "Members of the group %s updated.",
+			(*Transaction).SetGroupMembers)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(groupCmd)
+
+	for _, c := range []*cobra.Command{
+		groupAddMemberCmd, groupRemoveMemberCmd, groupSetMembersCmd,
+	} {
+		groupCmd.AddCommand(c)
+		addDatabaseFlags(c.Flags())
+		addPlanFlags(c.Flags())
+	}
+}
@@ -11,8 +11,6 @@ import (
 	"os"
 	"regexp"
 	"sort"
-	"strconv"
-	"time"
 
 	. "github.com/geaaru/entities/pkg/entities"
 
@@ -181,6 +179,27 @@ func listGroups(file, order, filter string, jsonOutput, groupHasShadow bool, spe
 	return nil
 }
 
+// humanShadow returns the shadow with the dates in human readable
+// format and the aging status of today.
+func humanShadow(s Shadow) (Shadow, string, error) {
+	a, err := s.Aging()
+	if err != nil {
+		return s, "", err
+	}
+
+	format := func(day int) string {
+		if day == AgingUnset {
+			return ""
+		}
+		return ShadowDate(day).Format("2006-01-02T15:04:05Z")
+	}
+
+	s = s.SetAging(a)
+	s.LastChanged = format(a.LastChanged)
+	s.Expire = format(a.Expire)
+	return s, a.Status(Today()), nil
+}
+
 func listShadows(file, order, filter string, jsonOutput, humanReadable bool, specsdirs []string) error {
 	var err error
 	var mShadows map[string]Shadow
@@ -215,34 +234,14 @@ func listShadows(file, order, filter string, jsonOutput, humanReadable bool, spe
 
 		for _, s := range shadows {
 
-			lastChanged := mShadows[s].LastChanged
+			shadow := mShadows[s]
 			if humanReadable {
-				i, err := strconv.Atoi(lastChanged)
-				if err != nil {
-					return err
-				}
-
-				unixSec := int64(i) * 24 * 60 * 60
-				lctime := time.Unix(unixSec, 0)
-				lastChanged = lctime.Format("2006-01-02T15:04:05Z")
-			}
-
-			expire := mShadows[s].Expire
-			if humanReadable && expire != "" {
-				i, err := strconv.Atoi(expire)
+				shadow, _, err = humanShadow(shadow)
 				if err != nil {
 					return err
 				}
-
-				unixSec := int64(i) * 24 * 60 * 60
-				extime := time.Unix(unixSec, 0)
-				expire = extime.Format("2006-01-02T15:04:05Z")
 			}
 
-			shadow := mShadows[s]
-			shadow.Expire = expire
-			shadow.LastChanged = lastChanged
-
 			res = append(res, shadow)
 		}
 
@@ -258,11 +257,15 @@ func listShadows(file, order, filter string, jsonOutput, humanReadable bool, spe
 			Bottom: true,
 		})
 		table.SetColWidth(50)
-		table.SetHeader([]string{
+		header := []string{
 			"Username", "Encrypted Password", "Last Password Change",
 			"Minimum Changed", "Maximun Changed", "Warning Expiration",
 			"Inactive", "Expire",
-		})
+		}
+		if humanReadable {
+			header = append(header, "Status")
+		}
+		table.SetHeader(header)
 
 		for _, s := range shadows {
 
@@ -271,40 +274,29 @@ func listShadows(file, order, filter string, jsonOutput, humanReadable bool, spe
 				pass = pass[0:60] + "\n" + pass[60:]
 			}
 
-			lastChanged := mShadows[s].LastChanged
+			shadow := mShadows[s]
+			status := ""
 			if humanReadable {
-				i, err := strconv.Atoi(lastChanged)
+				shadow, status, err = humanShadow(shadow)
 				if err != nil {
 					return err
 				}
-
-				unixSec := int64(i) * 24 * 60 * 60
-				lctime := time.Unix(unixSec, 0)
-				lastChanged = lctime.Format("2006-01-02T15:04:05Z")
 			}
 
-			expire := mShadows[s].Expire
-			if humanReadable && expire != "" {
-				i, err := strconv.Atoi(expire)
-				if err != nil {
-					return err
-				}
-
-				unixSec := int64(i) * 24 * 60 * 60
-				extime := time.Unix(unixSec, 0)
-				expire = extime.Format("2006-01-02T15:04:05Z")
-			}
-
-			table.Append([]string{
-				mShadows[s].Username,
+			row := []string{
+				shadow.Username,
 				pass,
-				lastChanged,
-				mShadows[s].MinimumChanged,
-				mShadows[s].MaximumChanged,
-				mShadows[s].Warn,
-				mShadows[s].Inactive,
-				expire,
-			})
+				shadow.LastChanged,
+				shadow.MinimumChanged,
+				shadow.MaximumChanged,
+				shadow.Warn,
+				shadow.Inactive,
+				shadow.Expire,
+			}
+			if humanReadable {
+				row = append(row, status)
+			}
+			table.Append(row)
 
 		}
 
@@ -507,8 +499,88 @@ func listGshadows(file, order, filter string, jsonOutput bool, specsdirs []strin
 	return nil
 }
 
+func listSubIds(kind, file, order, filter string, jsonOutput bool, specsdirs []string) error {
+	mSubIds := make(map[string]SubId, 0)
+
+	if len(specsdirs) > 0 {
+		store, err := createStore(specsdirs)
+		if err != nil {
+			return err
+		}
+		if kind == SubUidKind {
+			for k, e := range store.SubUids {
+				mSubIds[k] = e.SubId
+			}
+		} else {
+			for k, e := range store.SubGids {
+				mSubIds[k] = e.SubId
+			}
+		}
+	} else if kind == SubUidKind {
+		mSubUids, err := ParseSubUid(SubUidDefault(file))
+		if err != nil {
+			return err
+		}
+		for k, e := range mSubUids {
+			mSubIds[k] = e.SubId
+		}
+	} else {
+		mSubGids, err := ParseSubGid(SubGidDefault(file))
+		if err != nil {
+			return err
+		}
+		for k, e := range mSubGids {
+			mSubIds[k] = e.SubId
+		}
+	}
+
+	res := []SubId{}
+	for k, e := range mSubIds {
+		if filterMatch(filter, k) {
+			res = append(res, e)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if order == "id" {
+			return res[i].Start < res[j].Start
+		}
+		return res[i].Username < res[j].Username
+	})
+
+	if jsonOutput {
+		data, _ := json.Marshal(res)
+		fmt.Println(string(data))
+
+	} else {
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetBorders(tablewriter.Border{
+			Left:   true,
+			Top:    true,
+			Right:  true,
+			Bottom: true,
+		})
+		table.SetHeader([]string{
+			"Username", "Start", "Count", "End",
+		})
+
+		for _, s := range res {
+			table.Append([]string{
+				s.Username,
+				fmt.Sprintf("%d", s.Start),
+				fmt.Sprintf("%d", s.Count),
+				fmt.Sprintf("%d", s.End()),
+			})
+		}
+
+		table.Render()
+	}
+
+	return nil
+}
+
 var listCmd = &cobra.Command{
-	Use:   "list <shadow|groups|users|gshadow>",
+	Use:   "list <shadow|groups|users|gshadow|subuid|subgid>",
 	Short: "Show entities availables",
 	Args:  cobra.MinimumNArgs(1),
 	Long:  `Show the list of entities applied on current system.`,
@@ -518,12 +590,12 @@ var listCmd = &cobra.Command{
 		}
 		etype := args[0]
 		switch etype {
-		case "shadow", "groups", "users", "gshadow":
+		case "shadow", "groups", "users", "gshadow", "subuid", "subgid":
 			break
 		default:
 			return errors.New(
 				"Invalid entity type string. " +
-					"First argument must contains one of this values: shadow|groups|users|gshadow.",
+					"First argument must contains one of this values: shadow|groups|users|gshadow|subuid|subgid.",
 			)
 		}
 
@@ -556,6 +628,10 @@ var listCmd = &cobra.Command{
 			ans = listUsers(file, order, filter, jsonOutput, userHasShadow, specsdirs)
 		case "gshadow":
 			ans = listGshadows(file, order, filter, jsonOutput, specsdirs)
+		case "subuid":
+			ans = listSubIds(SubUidKind, file, order, filter, jsonOutput, specsdirs)
+		case "subgid":
+			ans = listSubIds(SubGidKind, file, order, filter, jsonOutput, specsdirs)
 		default:
 			return errors.New("Unexpected entity type " + etype)
 		}
@@ -14,59 +14,64 @@ import (
 )
 
 func mergeEntity(store, currentStore *EntitiesStore,
-	entityName, usersFile, groupsFile, shadowFile, gShadowFile string) error {
+	entityName string, tx *Transaction, quiet bool) error {
 
 	var err error
 	found := false
 
-	// Merge user if present.
-	if u, ok := store.Users[entityName]; ok {
+	// Merge group before the user to permit to
+	// resolve the gid from the group name.
+	if g, ok := store.Groups[entityName]; ok {
 		found = true
+		var newEntity Entity = g
 
-		var newEntity Entity = u
-
-		if cu, ok := currentStore.Users[entityName]; ok {
-			// POST: the entity is already present. I merge it.
-			newEntity, err = cu.Merge(u)
+		if cu, ok := currentStore.Groups[entityName]; ok {
+			// POST: the entity is already present. I merge it
+			newEntity, err = cu.Merge(g)
 			if err != nil {
 				return errors.New(fmt.Sprintf(
-					"Error on merge user %s: %s", cu.Username, err.Error()))
+					"Error on merge group %s: %s", entityName, err.Error()))
 			}
 		}
 
-		err = newEntity.Apply(usersFile, false)
+		err = tx.ApplyMerged(newEntity, g, false)
 		if err != nil {
 			return errors.New(
 				fmt.Sprintf(
-					"Error on apply user %s: %s", entityName, err.Error()))
+					"Error on apply group %s: %s", entityName, err.Error()))
 		}
 
-		fmt.Println(fmt.Sprintf(
-			"Merged users %s.", entityName))
+		if !quiet {
+			fmt.Println(fmt.Sprintf(
+				"Merged group %s.", entityName))
+		}
 	}
 
-	if g, ok := store.Groups[entityName]; ok {
+	if u, ok := store.Users[entityName]; ok {
 		found = true
-		var newEntity Entity = g
 
-		if cu, ok := currentStore.Groups[entityName]; ok {
-			// POST: the entity is already present. I merge it
-			newEntity, err = cu.Merge(g)
+		var newEntity Entity = u
+
+		if cu, ok := currentStore.Users[entityName]; ok {
+			// POST: the entity is already present. I merge it.
+			newEntity, err = cu.Merge(u)
 			if err != nil {
 				return errors.New(fmt.Sprintf(
-					"Error on merge group %s: %s", entityName, err.Error()))
+					"Error on merge user %s: %s", cu.Username, err.Error()))
 			}
 		}
 
-		err = newEntity.Apply(groupsFile, false)
+		err = tx.ApplyMerged(newEntity, u, false)
 		if err != nil {
 			return errors.New(
 				fmt.Sprintf(
-					"Error on apply group %s: %s", entityName, err.Error()))
+					"Error on apply user %s: %s", entityName, err.Error()))
 		}
 
-		fmt.Println(fmt.Sprintf(
-			"Merged group %s.", entityName))
+		if !quiet {
+			fmt.Println(fmt.Sprintf(
+				"Merged users %s.", entityName))
+		}
 	}
 
 	if s, ok := store.Shadows[entityName]; ok {
@@ -83,15 +88,17 @@ func mergeEntity(store, currentStore *EntitiesStore,
 			}
 		}
 
-		err = newEntity.Apply(shadowFile, false)
+		err = tx.Apply(newEntity, false)
 		if err != nil {
 			return errors.New(
 				fmt.Sprintf(
 					"Error on apply shadow %s: %s", entityName, err.Error()))
 		}
 
-		fmt.Println(fmt.Sprintf(
-			"Merged shadow %s.", entityName))
+		if !quiet {
+			fmt.Println(fmt.Sprintf(
+				"Merged shadow %s.", entityName))
+		}
 	}
 
 	if s, ok := store.GShadows[entityName]; ok {
@@ -107,53 +114,91 @@ func mergeEntity(store, currentStore *EntitiesStore,
 			}
 		}
 
-		err = newEntity.Apply(gShadowFile, false)
+		err = tx.Apply(newEntity, false)
 		if err != nil {
 			return errors.New(
 				fmt.Sprintf(
 					"Error on apply gshadow %s: %s", entityName, err.Error()))
 		}
 
-		fmt.Println(fmt.Sprintf(
-			"Merged gshadow %s.", entityName))
+		if !quiet {
+			fmt.Println(fmt.Sprintf(
+				"Merged gshadow %s.", entityName))
+		}
 
 	}
 
-	if !found {
-		return errors.New(
-			fmt.Sprintf("No entities found with name %s.", entityName))
-	}
+	if s, ok := store.SubUids[entityName]; ok {
+		found = true
+		var newEntity Entity = s
 
-	return nil
-}
+		if cs, ok := currentStore.SubUids[entityName]; ok {
+			// POST: the entity is already present. I merge it
+			newEntity, err = cs.Merge(s)
+			if err != nil {
+				return errors.New(fmt.Sprintf(
+					"Error on merge subuid %s: %s", entityName, err.Error()))
+			}
+		}
 
-func mergeAllEntities(store, currentStore *EntitiesStore,
-	usersFile, groupsFile, shadowFile, gShadowFile string) error {
-	entities := make(map[string]bool, 0)
+		err = tx.Apply(newEntity, false)
+		if err != nil {
+			return errors.New(
+				fmt.Sprintf(
+					"Error on apply subuid %s: %s", entityName, err.Error()))
+		}
 
-	for k, _ := range store.Users {
-		entities[k] = true
+		if !quiet {
+			fmt.Println(fmt.Sprintf(
+				"Merged subuid %s.", entityName))
+		}
 	}
 
-	for k, _ := range store.Groups {
-		entities[k] = true
-	}
+	if s, ok := store.SubGids[entityName]; ok {
+		found = true
+		var newEntity Entity = s
+
+		if cs, ok := currentStore.SubGids[entityName]; ok {
+			// POST: the entity is already present. I merge it
+			newEntity, err = cs.Merge(s)
+			if err != nil {
+				return errors.New(fmt.Sprintf(
+					"Error on merge subgid %s: %s", entityName, err.Error()))
+			}
+		}
+
+		err = tx.Apply(newEntity, false)
+		if err != nil {
+			return errors.New(
+				fmt.Sprintf(
+					"Error on apply subgid %s: %s", entityName, err.Error()))
+		}
 
-	for k, _ := range store.Shadows {
-		entities[k] = true
+		if !quiet {
+			fmt.Println(fmt.Sprintf(
+				"Merged subgid %s.", entityName))
+		}
 	}
 
-	for k, _ := range store.GShadows {
-		entities[k] = true
+	if !found {
+		return errors.New(
+			fmt.Sprintf("No entities found with name %s.", entityName))
 	}
 
+	return nil
+}
+
+func mergeAllEntities(store, currentStore *EntitiesStore, tx *Transaction, quiet bool) error {
+	// The entities are merged sorted by priority and name to
+	// assign always the same dynamic ids.
+	entities := store.Names()
+
 	if len(entities) == 0 {
 		return errors.New("No entities to merge")
 	}
 
-	for k, _ := range entities {
-		err := mergeEntity(store, currentStore, k,
-			usersFile, groupsFile, shadowFile, gShadowFile)
+	for _, k := range entities {
+		err := mergeEntity(store, currentStore, k, tx, quiet)
 		if err != nil {
 			return err
 		}
@@ -194,8 +239,15 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 		groupsFile, _ := cmd.Flags().GetString("groups-file")
 		shadowFile, _ := cmd.Flags().GetString("shadow-file")
 		gShadowFile, _ := cmd.Flags().GetString("gshadow-file")
+		subuidFile, _ := cmd.Flags().GetString("subuid-file")
+		subgidFile, _ := cmd.Flags().GetString("subgid-file")
 		entity, _ := cmd.Flags().GetString("entity")
 		all, _ := cmd.Flags().GetBool("all")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		lockFile, _ := cmd.Flags().GetString("lockfile")
+		mergeStrategy, _ := cmd.Flags().GetString("merge-strategy")
+		quiet := dryRun && jsonOutput
 
 		store := NewEntitiesStore()
 		currentStore := NewEntitiesStore()
@@ -209,9 +261,47 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 			}
 		}
 
+		// The strategy of the specs has priority over the option.
+		err := store.SetMergeStrategy(mergeStrategy)
+		if err != nil {
+			return err
+		}
+
+		// The transaction locks all files to avoid changes by other
+		// tools between the read of the current status and the merge.
+		paths := map[string]string{
+			UserKind:    usersFile,
+			GroupKind:   groupsFile,
+			ShadowKind:  shadowFile,
+			GShadowKind: gShadowFile,
+		}
+		// The subordinate ids files are locked only if needed.
+		if len(store.SubUids) > 0 {
+			paths[SubUidKind] = subuidFile
+		}
+		if len(store.SubGids) > 0 {
+			paths[SubGidKind] = subgidFile
+		}
+		tx, err := NewTransactionFromPaths(paths)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		tx.SetDryRun(dryRun)
+
+		var idLock *IdLock
+		if lockFile != "" {
+			idLock, err = LoadIdLock(lockFile)
+			if err != nil {
+				return err
+			}
+			tx.SetIdLock(idLock)
+		}
+
 		// Retrieve current information
-		err := getCurrentStatus(currentStore,
+		err = getCurrentStatus(currentStore,
 			usersFile, groupsFile, shadowFile, gShadowFile,
+			subuidFile, subgidFile,
 		)
 		if err != nil {
 			return errors.New(
@@ -220,19 +310,39 @@ To read /etc/shadow and /etc/gshadow requires root permissions.
 		}
 
 		if entity != "" {
-			err = mergeEntity(store, currentStore, entity,
-				usersFile, groupsFile, shadowFile, gShadowFile,
-			)
+			err = mergeEntity(store, currentStore, entity, tx, quiet)
 		} else if all {
-			err = mergeAllEntities(store, currentStore, usersFile,
-				groupsFile, shadowFile, gShadowFile,
-			)
+			err = mergeAllEntities(store, currentStore, tx, quiet)
 		}
 
 		if err != nil {
 			return err
 		}
 
+		if dryRun {
+			plans, err := tx.Plan()
+			if err != nil {
+				return err
+			}
+			printPlan(plans, jsonOutput)
+
+			// Report the errors that the commit will return.
+			return tx.Validate()
+		}
+
+		// Write all files or none.
+		err = tx.Commit()
+		if err != nil {
+			return errors.New("Error on commit changes: " + err.Error())
+		}
+
+		if idLock != nil {
+			err = idLock.Write(lockFile)
+			if err != nil {
+				return errors.New("Error on write lock file: " + err.Error())
+			}
+		}
+
 		fmt.Println("All done.")
 
 		return nil
@@ -249,9 +359,17 @@ func init() {
 		"Merge all entities available on the specified directories.",
 	)
 	flags.StringP("entity", "e", "",
-		"Entity name to merge as groups,user,shadow and gshadow.")
+		"Entity name to merge as groups,user,shadow,gshadow,subuid and subgid.")
 	flags.String("users-file", UserDefault(""), "Define custom users file.")
 	flags.String("groups-file", GroupsDefault(""), "Define custom groups file.")
 	flags.String("shadow-file", ShadowDefault(""), "Define custom shadow file.")
 	flags.String("gshadow-file", GShadowDefault(""), "Define custom gshadow file.")
+	flags.String("subuid-file", SubUidDefault(""), "Define custom subuid file.")
+	flags.String("subgid-file", SubGidDefault(""), "Define custom subgid file.")
+	flags.String("lockfile", "",
+		"Read and store the ids assigned to the dynamic users and groups in the specified file (e.g. "+
+			IdLockDefaultFile+").")
+	flags.String("merge-strategy", "",
+		"Strategy used to merge the members and the uid, gid and password of the specs without merge_strategy: union, replace or remove.")
+	addPlanFlags(flags)
 }
@@ -0,0 +1,82 @@
+/*
+	Copyright © 2022 Funtoo Macaroni OS Linux
+	See AUTHORS and LICENSE for the license details and contributors.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+var passwdCmd = &cobra.Command{
+	Use:   "passwd",
+	Short: "Manage the passwords of the users.",
+}
+
+var passwdCheckCmd = &cobra.Command{
+	Use:           "check",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "Check the password hashes of the shadow file.",
+	Long: `
+Check the password hashes of the shadow file with the hash policy: the
+method and the minimum rounds of the option --hash and --hash-rounds or
+of the ENCRYPT_METHOD and the rounds of login.defs.
+
+The empty passwords and the MD5 and DES hashes are always reported.
+The hashes of the locked passwords are reported as warnings. The
+hashes are never printed.
+
+The command exits with a non-zero status if errors are found.
+
+To read /etc/shadow requires root permissions.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shadowFile, _ := cmd.Flags().GetString("shadow-file")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		l, err := ParseLoginDefs(LoginDefsDefault(""))
+		if err != nil {
+			return err
+		}
+		policy, err := NewHashPolicy(l)
+		if err != nil {
+			return err
+		}
+
+		db := NewDatabaseFromPaths(map[string]string{ShadowKind: shadowFile})
+		report, err := CheckPasswordHashes(db, policy)
+		if err != nil {
+			return err
+		}
+
+		printValidationReport(report, jsonOutput)
+
+		if !report.Valid() {
+			// Avoid to print the error on JSON output.
+			if jsonOutput {
+				os.Exit(1)
+			}
+			return errors.New(fmt.Sprintf(
+				"Check failed with %d errors.", report.Errors))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(passwdCmd)
+	passwdCmd.AddCommand(passwdCheckCmd)
+
+	var flags = passwdCheckCmd.Flags()
+	flags.String("shadow-file", ShadowDefault(""), "Define custom shadow file.")
+	flags.Bool("json", false, "Show in JSON format.")
+}
@@ -0,0 +1,83 @@
+/*
+	Copyright © 2022 Funtoo Macaroni OS Linux
+	See AUTHORS and LICENSE for the license details and contributors.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	planApply  = "apply"
+	planCreate = "create"
+	planDelete = "delete"
+)
+
+func addPlanFlags(flags *pflag.FlagSet) {
+	flags.Bool("dry-run", false,
+		"Show the changes without write them.")
+	flags.Bool("json", false,
+		"Show the changes of the dry-run in JSON format instead of unified diff.")
+}
+
+// planEntity shows the changes of the operation on the entity
+// without write them.
+func planEntity(entity Entity, op string, safe, jsonOutput bool, idLock *IdLock) error {
+	tx, err := newEntityTransaction(entity)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	tx.SetDryRun(true)
+
+	if idLock != nil {
+		tx.SetIdLock(idLock)
+	}
+
+	switch op {
+	case planApply:
+		err = tx.Apply(entity, safe)
+	case planCreate:
+		err = tx.Create(entity)
+	case planDelete:
+		err = tx.Delete(entity)
+	default:
+		err = errors.New("Unsupported operation " + op)
+	}
+	if err != nil {
+		return err
+	}
+
+	plans, err := tx.Plan()
+	if err != nil {
+		return err
+	}
+
+	printPlan(plans, jsonOutput)
+
+	return nil
+}
+
+func printPlan(plans []FilePlan, jsonOutput bool) {
+	if jsonOutput {
+		data, _ := json.Marshal(plans)
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(plans) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+
+	for _, p := range plans {
+		fmt.Print(p.Diff)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"os"
 
+	. "github.com/geaaru/entities/pkg/entities"
+
 	"github.com/spf13/cobra"
 )
 
@@ -36,6 +38,52 @@ var rootCmd = &cobra.Command{
 	Use:     "entities",
 	Version: version(),
 	Short:   "Modern go identity manager for UNIX systems",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		backup, _ := cmd.Flags().GetBool("backup")
+		if backup {
+			os.Setenv(ENTITY_ENV_BACKUP, "1")
+		}
+		strict, _ := cmd.Flags().GetBool("strict")
+		if strict {
+			os.Setenv(ENTITY_ENV_STRICT, "1")
+		}
+		if cmd.Flags().Changed("login-defs") {
+			loginDefs, _ := cmd.Flags().GetString("login-defs")
+			os.Setenv(ENTITY_ENV_DEF_LOGIN_DEFS, loginDefs)
+		}
+		if cmd.Flags().Changed("root") {
+			root, _ := cmd.Flags().GetString("root")
+			st, err := os.Stat(root)
+			if err != nil {
+				return err
+			}
+			if !st.IsDir() {
+				return fmt.Errorf("The root %s is not a directory", root)
+			}
+			os.Setenv(ENTITY_ENV_ROOT, root)
+		}
+		if cmd.Flags().Changed("home-prefix") {
+			prefix, _ := cmd.Flags().GetString("home-prefix")
+			os.Setenv(ENTITY_ENV_HOME_PREFIX, prefix)
+		}
+		if cmd.Flags().Changed("hash") {
+			method, _ := cmd.Flags().GetString("hash")
+			method, err := ParseHashMethod(method)
+			if err != nil {
+				return err
+			}
+			os.Setenv(ENTITY_ENV_HASH, method)
+		}
+		if cmd.Flags().Changed("hash-rounds") {
+			rounds, _ := cmd.Flags().GetInt("hash-rounds")
+			os.Setenv(ENTITY_ENV_HASH_ROUNDS, fmt.Sprintf("%d", rounds))
+		}
+		if cmd.Flags().Changed("lock-timeout") {
+			timeout, _ := cmd.Flags().GetDuration("lock-timeout")
+			os.Setenv(ENTITY_ENV_LOCK_TIMEOUT, timeout.String())
+		}
+		return nil
+	},
 	Long: `Entities is a modern groups and user manager for Unix system. It allows to create/delete user and groups 
 in a system given policies following the entities yaml format.
 
@@ -63,4 +111,20 @@ func Execute() {
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&entityFile, "file", "f", "", "File to manipulate ( e.g. /etc/passwd ) ")
+	rootCmd.PersistentFlags().Bool("backup", BackupEnabled(),
+		"Save the previous content of every modified file with the suffix '-' (e.g. /etc/passwd-).")
+	rootCmd.PersistentFlags().Duration("lock-timeout", LockTimeout(),
+		"Maximum time to wait for the lock of the files (e.g. /etc/passwd.lock).")
+	rootCmd.PersistentFlags().String("login-defs", LoginDefsDefault(""),
+		"Define custom login.defs file used for the ids allocation.")
+	rootCmd.PersistentFlags().String("root", RootDir(),
+		"Directory of the system tree to manage (e.g. a chroot or an image). All files and home directories are resolved inside it.")
+	rootCmd.PersistentFlags().String("home-prefix", os.Getenv(ENTITY_ENV_HOME_PREFIX),
+		"Directory where the home and skeleton directories are resolved (default the root directory).")
+	rootCmd.PersistentFlags().String("hash", os.Getenv(ENTITY_ENV_HASH),
+		"Method used to hash the clear passwords: yescrypt, bcrypt, sha512 or sha256 (default the ENCRYPT_METHOD of login.defs).")
+	rootCmd.PersistentFlags().Int("hash-rounds", 0,
+		"Rounds of sha512 and sha256, cost of bcrypt or cost factor of yescrypt used to hash the clear passwords.")
+	rootCmd.PersistentFlags().Bool("strict", StrictMode(),
+		"Fail on malformed lines of the files instead of skipping them with a warning.")
 }
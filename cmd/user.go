@@ -0,0 +1,202 @@
+/*
+	Copyright © 2022 Funtoo Macaroni OS Linux
+	See AUTHORS and LICENSE for the license details and contributors.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	"github.com/spf13/cobra"
+)
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users.",
+}
+
+var userDeleteCmd = &cobra.Command{
+	Use:          "delete <username>",
+	SilenceUsage: true,
+	Short:        "Delete a user from all the files.",
+	Args:         cobra.ExactArgs(1),
+	Long: `
+Delete the user from the passwd and shadow files and from the members
+and administrators lists of the group and gshadow files.
+
+With --remove-group the group with the same name of the user is removed
+too if it's the primary group of the user and it isn't used by other
+users, like userdel does.
+
+To read /etc/shadow and /etc/gshadow requires root permissions.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		removeGroup, _ := cmd.Flags().GetBool("remove-group")
+		removeHome, _ := cmd.Flags().GetBool("remove-home")
+		archiveHome, _ := cmd.Flags().GetString("archive-home")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		tx, err := newCmdTransaction(cmd)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = tx.DeleteUser(args[0], DeleteUserOptions{
+			RemoveGroup: removeGroup,
+			RemoveHome:  removeHome,
+			ArchiveHome: archiveHome,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = commitCmdTransaction(cmd, tx)
+		if err != nil {
+			return err
+		}
+
+		if !dryRun {
+			fmt.Println(fmt.Sprintf("User %s deleted.", args[0]))
+		}
+
+		return nil
+	},
+}
+
+// runUserShadowCmd runs the operation over the shadow entry of the
+// user of the first argument.
+func runUserShadowCmd(cmd *cobra.Command, args []string, msg string,
+	op func(tx *Transaction, name string) error) error {
+
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	tx, err := newCmdTransaction(cmd)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = op(tx, args[0])
+	if err != nil {
+		return err
+	}
+
+	err = commitCmdTransaction(cmd, tx)
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		fmt.Println(fmt.Sprintf(msg, args[0]))
+	}
+
+	return nil
+}
+
+var userLockCmd = &cobra.Command{
+	Use:          "lock <username>",
+	SilenceUsage: true,
+	Short:        "Lock the password of a user.",
+	Args:         cobra.ExactArgs(1),
+	Long: `
+Lock the password of the user prefixing the hash of the shadow file
+with !, like passwd -l. The hash is maintained and the password could be
+unlocked with the unlock command.
+
+To read /etc/shadow requires root permissions.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runUserShadowCmd(cmd, args, "User %s locked.", (*Transaction).LockUser)
+	},
+}
+
+var userUnlockCmd = &cobra.Command{
+	Use:          "unlock <username>",
+	SilenceUsage: true,
+	Short:        "Unlock the password of a user.",
+	Args:         cobra.ExactArgs(1),
+	Long: `
+Unlock the password of the user removing the ! prefix of the hash of the
+shadow file, like passwd -u. The unlock fails if the user would have an
+empty password.
+
+To read /etc/shadow requires root permissions.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runUserShadowCmd(cmd, args, "User %s unlocked.", (*Transaction).UnlockUser)
+	},
+}
+
+var userExpireCmd = &cobra.Command{
+	Use:          "expire <username> <date|now|never>",
+	SilenceUsage: true,
+	Short:        "Set the account expiration of a user.",
+	Args:         cobra.ExactArgs(2),
+	Long: `
+Set the account expiration of the user, like chage -E. The date could be
+defined as YYYY-MM-DD, as days from 1970 or as now. With never the
+expiration is removed.
+
+To read /etc/shadow requires root permissions.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		day := AgingUnset
+		if args[1] != "never" {
+			var err error
+			day, err = ParseShadowDate(args[1])
+			if err != nil {
+				return err
+			}
+		}
+
+		return runUserShadowCmd(cmd, args, "Expiration of the user %s updated.",
+			func(tx *Transaction, name string) error {
+				return tx.ExpireUser(name, day)
+			})
+	},
+}
+
+var userForceChangeCmd = &cobra.Command{
+	Use:          "force-change <username>",
+	SilenceUsage: true,
+	Short:        "Force a user to change the password on the next login.",
+	Args:         cobra.ExactArgs(1),
+	Long: `
+Force the user to change the password on the next login setting the
+last password change of the shadow file to 0, like chage -d 0.
+
+To read /etc/shadow requires root permissions.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runUserShadowCmd(cmd, args, "User %s must change the password on the next login.",
+			(*Transaction).ForcePasswordChange)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userDeleteCmd)
+
+	var flags = userDeleteCmd.Flags()
+	addDatabaseFlags(flags)
+	flags.Bool("remove-group", false,
+		"Remove the primary group with the same name of the user if not used by other users.")
+	flags.Bool("remove-home", false,
+		"Remove the home directory of the user. The system directories and the shared homes are refused.")
+	flags.String("archive-home", "",
+		"Directory where to archive the home directory of the user before the remove.")
+	addPlanFlags(flags)
+
+	for _, c := range []*cobra.Command{
+		userLockCmd, userUnlockCmd, userExpireCmd, userForceChangeCmd,
+	} {
+		userCmd.AddCommand(c)
+		flags = c.Flags()
+		addDatabaseFlags(flags)
+		addPlanFlags(flags)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+	Copyright © 2022 Funtoo Macaroni OS Linux
+	See AUTHORS and LICENSE for the license details and contributors.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	tablewriter "github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+func printValidationReport(report *ValidationReport, jsonOutput bool) {
+	if jsonOutput {
+		data, _ := json.Marshal(report)
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(report.Problems) == 0 {
+		fmt.Println("No problems found.")
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorders(tablewriter.Border{
+		Left:   true,
+		Top:    true,
+		Right:  true,
+		Bottom: true,
+	})
+	table.SetColWidth(50)
+	table.SetHeader([]string{
+		"Severity", "Check", "File", "Name", "Problem",
+	})
+	for _, p := range report.Problems {
+		file := p.File
+		if p.Line > 0 {
+			file = fmt.Sprintf("%s:%d", p.File, p.Line)
+		}
+		table.Append([]string{
+			p.Severity,
+			p.Check,
+			file,
+			p.Name,
+			p.Message,
+		})
+	}
+	table.Render()
+
+	fmt.Println(fmt.Sprintf("%d errors, %d warnings.",
+		report.Errors, report.Warnings))
+}
+
+var validateCmd = &cobra.Command{
+	Use:           "validate",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	Short:         "Check the consistency of the entities files.",
+	Long: `
+Check the passwd, group, shadow and gshadow files like pwck and grpck:
+malformed lines, duplicate names or ids, users without shadow entry,
+groups without gshadow entry (and vice versa), missing home directories,
+not executable shells and members not present.
+
+The command exits with a non-zero status if errors are found. The
+missing home directories, shells and groups are reported as warnings.
+
+To read /etc/shadow and /etc/gshadow requires root permissions.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		report, err := ValidateDatabase(newCmdDatabase(cmd))
+		if err != nil {
+			return err
+		}
+
+		printValidationReport(report, jsonOutput)
+
+		if !report.Valid() {
+			// Avoid to print the error on JSON output.
+			if jsonOutput {
+				os.Exit(1)
+			}
+			return errors.New(fmt.Sprintf(
+				"Validation failed with %d errors.", report.Errors))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+
+	var flags = validateCmd.Flags()
+	addDatabaseFlags(flags)
+	flags.Bool("json", false, "Show in JSON format.")
+}
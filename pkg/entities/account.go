@@ -0,0 +1,93 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// editShadow applies the edit to the shadow entry of the user. The
+// other fields of the entry are maintained.
+func editShadow(db *Database, name string, edit func(s Shadow) (Shadow, error)) error {
+	f, err := db.GetFile(ShadowKind)
+	if err != nil {
+		return err
+	}
+	line, ok := f.Get(name)
+	if !ok {
+		return &NotFoundError{Kind: ShadowKind, Name: name, File: f.GetPath()}
+	}
+	_, s, err := parseLine(line)
+	if err != nil {
+		return toParseError(f.GetPath(), f.index[name]+1, redactLine(line), err)
+	}
+
+	s, err = edit(s)
+	if err != nil {
+		return err
+	}
+	if s.String() != line {
+		f.Set(name, s.String())
+	}
+
+	return nil
+}
+
+// LockUser locks the password of the user with the ! prefix, like
+// passwd -l. The hash is maintained to permit the unlock. A locked
+// password is not changed.
+func LockUser(db *Database, name string) error {
+	return editShadow(db, name, func(s Shadow) (Shadow, error) {
+		if !strings.HasPrefix(s.Password, "!") {
+			s.Password = "!" + s.Password
+		}
+		return s, nil
+	})
+}
+
+// UnlockUser removes the ! prefix of the password of the user, like
+// passwd -u. It returns an error if the user would have an empty
+// password.
+func UnlockUser(db *Database, name string) error {
+	return editShadow(db, name, func(s Shadow) (Shadow, error) {
+		if !strings.HasPrefix(s.Password, "!") {
+			return s, nil
+		}
+		pwd := s.Password[1:]
+		if pwd == "" {
+			return s, errors.New("The unlock of the user " + name +
+				" would result in an empty password")
+		}
+		s.Password = pwd
+		return s, nil
+	})
+}
+
+// ExpireUser sets the day of the account expiration of the user, like
+// chage -E. With AgingUnset the expiration is removed.
+func ExpireUser(db *Database, name string, day int) error {
+	if day < AgingUnset {
+		return errors.New("Invalid expire day " + strconv.Itoa(day))
+	}
+	return editShadow(db, name, func(s Shadow) (Shadow, error) {
+		s.Expire = ""
+		if day != AgingUnset {
+			s.Expire = strconv.Itoa(day)
+		}
+		return s, nil
+	})
+}
+
+// ForcePasswordChange forces the user to change the password on the
+// next login setting the last change to 0, like chage -d 0.
+func ForcePasswordChange(db *Database, name string) error {
+	return editShadow(db, name, func(s Shadow) (Shadow, error) {
+		s.LastChanged = "0"
+		return s, nil
+	})
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Account state", func() {
+	var tmpdir, shadow string
+	var db *Database
+
+	BeforeEach(func() {
+		var err error
+		tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+		Expect(err).Should(BeNil())
+		shadow = filepath.Join(tmpdir, "shadow")
+		Expect(ioutil.WriteFile(shadow, []byte(
+			"foo:$6$salt$hash:19000:0:90:7:::\nbar::19000::::::\n"), 0640)).Should(BeNil())
+		db = NewDatabaseFromPaths(map[string]string{ShadowKind: shadow})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpdir)
+	})
+
+	line := func(name string) string {
+		f, err := db.GetFile(ShadowKind)
+		Expect(err).Should(BeNil())
+		l, ok := f.Get(name)
+		Expect(ok).Should(BeTrue())
+		return l
+	}
+
+	It("Locks and unlocks the password maintaining the hash", func() {
+		Expect(LockUser(db, "foo")).Should(BeNil())
+		Expect(line("foo")).Should(Equal("foo:!$6$salt$hash:19000:0:90:7:::"))
+
+		// The locked passwords are not changed.
+		Expect(LockUser(db, "foo")).Should(BeNil())
+		Expect(line("foo")).Should(Equal("foo:!$6$salt$hash:19000:0:90:7:::"))
+
+		Expect(UnlockUser(db, "foo")).Should(BeNil())
+		Expect(line("foo")).Should(Equal("foo:$6$salt$hash:19000:0:90:7:::"))
+		Expect(UnlockUser(db, "foo")).Should(BeNil())
+		Expect(line("foo")).Should(Equal("foo:$6$salt$hash:19000:0:90:7:::"))
+	})
+
+	It("Refuses to unlock an empty password", func() {
+		Expect(LockUser(db, "bar")).Should(BeNil())
+		Expect(line("bar")).Should(Equal("bar:!:19000::::::"))
+		Expect(UnlockUser(db, "bar")).ShouldNot(BeNil())
+		Expect(line("bar")).Should(Equal("bar:!:19000::::::"))
+	})
+
+	It("Sets and removes the account expiration", func() {
+		Expect(ExpireUser(db, "foo", 20849)).Should(BeNil())
+		Expect(line("foo")).Should(Equal("foo:$6$salt$hash:19000:0:90:7::20849:"))
+
+		Expect(ExpireUser(db, "foo", AgingUnset)).Should(BeNil())
+		Expect(line("foo")).Should(Equal("foo:$6$salt$hash:19000:0:90:7:::"))
+
+		Expect(ExpireUser(db, "foo", -2)).ShouldNot(BeNil())
+	})
+
+	It("Forces the password change", func() {
+		Expect(ForcePasswordChange(db, "foo")).Should(BeNil())
+		Expect(line("foo")).Should(Equal("foo:$6$salt$hash:0:0:90:7:::"))
+	})
+
+	It("Reports the line of the malformed entries", func() {
+		Expect(ioutil.WriteFile(shadow, []byte(
+			"foo:$6$salt$hash:19000:0:90:7:::\nbad:!:19000\n"), 0640)).Should(BeNil())
+		db = NewDatabaseFromPaths(map[string]string{ShadowKind: shadow})
+
+		err := LockUser(db, "bad")
+		Expect(err).ShouldNot(BeNil())
+		Expect(err.Error()).Should(HavePrefix(shadow + ":2: "))
+	})
+
+	It("Reports the missing users", func() {
+		err := LockUser(db, "baz")
+		Expect(errors.Is(err, ErrNotFound)).Should(BeTrue())
+	})
+
+	It("Writes only the shadow file with the transaction", func() {
+		tx, err := NewTransactionFromPaths(map[string]string{ShadowKind: shadow})
+		Expect(err).Should(BeNil())
+		defer tx.Rollback()
+
+		Expect(tx.LockUser("foo")).Should(BeNil())
+		Expect(tx.ForcePasswordChange("foo")).Should(BeNil())
+		Expect(tx.Commit()).Should(BeNil())
+
+		data, err := ioutil.ReadFile(shadow)
+		Expect(err).Should(BeNil())
+		Expect(string(data)).Should(Equal(
+			"foo:!$6$salt$hash:0:0:90:7:::\nbar::19000::::::\n"))
+	})
+})
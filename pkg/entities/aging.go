@@ -0,0 +1,282 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AgingUnset is the value of the empty aging fields of the shadow file.
+const AgingUnset = -1
+
+// Status of the aging of an account, from the worst to the best.
+const (
+	AgingExpired   = "expired"
+	AgingInactive  = "inactive"
+	AgingChangeDue = "change-due"
+	AgingWarning   = "warning"
+	AgingOk        = "ok"
+)
+
+const shadowDateLayout = "2006-01-02"
+
+// ShadowAging contains the aging fields of a shadow entry. The dates are
+// days since Jan 1, 1970 and the periods are days. The empty fields are
+// AgingUnset.
+type ShadowAging struct {
+	LastChanged    int `json:"last_changed" yaml:"last_changed"`
+	MinimumChanged int `json:"minimum_changed" yaml:"minimum_changed"`
+	MaximumChanged int `json:"maximum_changed" yaml:"maximum_changed"`
+	Warn           int `json:"warn" yaml:"warn"`
+	Inactive       int `json:"inactive" yaml:"inactive"`
+	Expire         int `json:"expire" yaml:"expire"`
+}
+
+// ShadowDay returns the days since Jan 1, 1970 of the time.
+func ShadowDay(t time.Time) int {
+	return int(t.Unix() / 24 / 60 / 60)
+}
+
+// ShadowDate returns the UTC time of the days since Jan 1, 1970.
+func ShadowDate(day int) time.Time {
+	return time.Unix(int64(day)*24*60*60, 0).UTC()
+}
+
+// FormatShadowDate returns the day as YYYY-MM-DD or an empty string
+// if it's not set.
+func FormatShadowDate(day int) string {
+	if day == AgingUnset {
+		return ""
+	}
+	return ShadowDate(day).Format(shadowDateLayout)
+}
+
+// Today returns the current days since Jan 1, 1970.
+func Today() int {
+	return ShadowDay(time.Now())
+}
+
+// ParseShadowDate parses a date of the shadow file or of the specs: the
+// days since Jan 1, 1970, a date as YYYY-MM-DD or now.
+func ParseShadowDate(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "", "-1":
+		return AgingUnset, nil
+	case "now":
+		return Today(), nil
+	}
+
+	if strings.Contains(s, "-") {
+		t, err := time.Parse(shadowDateLayout, s)
+		if err != nil {
+			return 0, errors.New("Invalid date " + s + ": expected YYYY-MM-DD")
+		}
+		return ShadowDay(t), nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.New("Invalid date " + s)
+	}
+	return n, nil
+}
+
+// ParseShadowDays parses a period of the shadow file or of the specs:
+// the days or a duration with the d (days) or w (weeks) suffix.
+func ParseShadowDays(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "-1" {
+		return AgingUnset, nil
+	}
+
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "d"):
+		s = s[:len(s)-1]
+	case strings.HasSuffix(s, "w"):
+		s = s[:len(s)-1]
+		mult = 7
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.New("Invalid duration " + s + ": expected days, Nd or Nw")
+	}
+	return n * mult, nil
+}
+
+// Aging returns the typed aging fields of the entity.
+func (u Shadow) Aging() (ShadowAging, error) {
+	var err error
+	ans := ShadowAging{}
+
+	for _, f := range []struct {
+		name  string
+		value string
+		field *int
+		parse func(string) (int, error)
+	}{
+		{"last_changed", u.LastChanged, &ans.LastChanged, ParseShadowDate},
+		{"minimum_changed", u.MinimumChanged, &ans.MinimumChanged, ParseShadowDays},
+		{"maximum_changed", u.MaximumChanged, &ans.MaximumChanged, ParseShadowDays},
+		{"warn", u.Warn, &ans.Warn, ParseShadowDays},
+		{"inactive", u.Inactive, &ans.Inactive, ParseShadowDays},
+		{"expire", u.Expire, &ans.Expire, ParseShadowDate},
+	} {
+		*f.field, err = f.parse(f.value)
+		if err != nil {
+			return ans, errors.Wrapf(err, "Invalid %s of user %s", f.name, u.Username)
+		}
+	}
+
+	return ans, nil
+}
+
+// SetAging sets the aging fields of the entity with the values of the
+// shadow file.
+func (u Shadow) SetAging(a ShadowAging) Shadow {
+	format := func(n int) string {
+		if n == AgingUnset {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+
+	u.LastChanged = format(a.LastChanged)
+	u.MinimumChanged = format(a.MinimumChanged)
+	u.MaximumChanged = format(a.MaximumChanged)
+	u.Warn = format(a.Warn)
+	u.Inactive = format(a.Inactive)
+	u.Expire = format(a.Expire)
+	return u
+}
+
+// NormalizeAging converts the dates and the durations of the specs
+// to the days of the shadow file.
+func (u Shadow) NormalizeAging() (Shadow, error) {
+	a, err := u.Aging()
+	if err != nil {
+		return u, err
+	}
+	return u.SetAging(a), nil
+}
+
+// PasswordExpiration returns the day when the password must be changed
+// or AgingUnset if the password never expires. A last change equal to 0
+// forces the change on the next login.
+func (a ShadowAging) PasswordExpiration() int {
+	if a.LastChanged == 0 {
+		return 0
+	}
+	if a.LastChanged == AgingUnset || a.MaximumChanged == AgingUnset {
+		return AgingUnset
+	}
+	return a.LastChanged + a.MaximumChanged
+}
+
+// InactiveFrom returns the day when the account is locked because the
+// expired password is not changed or AgingUnset.
+func (a ShadowAging) InactiveFrom() int {
+	exp := a.PasswordExpiration()
+	if exp <= 0 || a.Inactive == AgingUnset {
+		return AgingUnset
+	}
+	return exp + a.Inactive
+}
+
+// AccountExpired returns true if the account is expired on the day.
+// Like shadow-utils the expire 0 is ignored.
+func (a ShadowAging) AccountExpired(today int) bool {
+	return a.Expire > 0 && today >= a.Expire
+}
+
+// AccountInactive returns true if the inactivity period of the expired
+// password is over on the day.
+func (a ShadowAging) AccountInactive(today int) bool {
+	in := a.InactiveFrom()
+	return in != AgingUnset && today >= in
+}
+
+// PasswordChangeDue returns true if the password must be changed on
+// the day.
+func (a ShadowAging) PasswordChangeDue(today int) bool {
+	exp := a.PasswordExpiration()
+	return exp != AgingUnset && today >= exp
+}
+
+// PasswordWarning returns true if the day is in the warning period
+// before the password expiration.
+func (a ShadowAging) PasswordWarning(today int) bool {
+	exp := a.PasswordExpiration()
+	return exp != AgingUnset && a.Warn > 0 && today < exp && today >= exp-a.Warn
+}
+
+// Status returns the worst aging status of the account on the day.
+func (a ShadowAging) Status(today int) string {
+	switch {
+	case a.AccountExpired(today):
+		return AgingExpired
+	case a.AccountInactive(today):
+		return AgingInactive
+	case a.PasswordChangeDue(today):
+		return AgingChangeDue
+	case a.PasswordWarning(today):
+		return AgingWarning
+	}
+	return AgingOk
+}
+
+// AgingEntry is the aging status of an account.
+type AgingEntry struct {
+	Username string      `json:"username" yaml:"username"`
+	Status   string      `json:"status" yaml:"status"`
+	Aging    ShadowAging `json:"aging" yaml:"aging"`
+	Message  string      `json:"message,omitempty" yaml:"message,omitempty"`
+}
+
+// AgingReport returns the aging status on the day of the accounts of
+// the shadow file, sorted as the file. The malformed lines and the
+// entries with invalid aging fields have an empty status and the
+// error in the message.
+func AgingReport(db *Database, today int) ([]AgingEntry, error) {
+	ans := []AgingEntry{}
+
+	f, err := db.GetFile(ShadowKind)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, line := range f.Lines() {
+		if lineKey(line) == "" {
+			continue
+		}
+		name, s, err := parseLine(line)
+		if err != nil {
+			ans = append(ans, AgingEntry{
+				Username: lineKey(line),
+				Message:  toParseError(f.GetPath(), i+1, redactLine(line), err).Error(),
+			})
+			continue
+		}
+
+		a, err := s.Aging()
+		if err != nil {
+			ans = append(ans, AgingEntry{Username: name, Message: err.Error()})
+			continue
+		}
+		ans = append(ans, AgingEntry{
+			Username: name,
+			Status:   a.Status(today),
+			Aging:    a,
+		})
+	}
+
+	return ans, nil
+}
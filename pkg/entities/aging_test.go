@@ -0,0 +1,195 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shadow aging", func() {
+	Context("Parsing the fields", func() {
+		It("Parses the dates", func() {
+			day, err := ParseShadowDate("2027-01-31")
+			Expect(err).Should(BeNil())
+			Expect(day).Should(Equal(20849))
+			Expect(FormatShadowDate(day)).Should(Equal("2027-01-31"))
+
+			day, err = ParseShadowDate("19000")
+			Expect(err).Should(BeNil())
+			Expect(day).Should(Equal(19000))
+
+			day, err = ParseShadowDate("now")
+			Expect(err).Should(BeNil())
+			Expect(day).Should(Equal(Today()))
+
+			day, err = ParseShadowDate("")
+			Expect(err).Should(BeNil())
+			Expect(day).Should(Equal(AgingUnset))
+
+			_, err = ParseShadowDate("2027-31-01")
+			Expect(err).ShouldNot(BeNil())
+			_, err = ParseShadowDate("90d")
+			Expect(err).ShouldNot(BeNil())
+		})
+
+		It("Parses the durations", func() {
+			for s, days := range map[string]int{
+				"90": 90, "90d": 90, "2w": 14, "": AgingUnset, "-1": AgingUnset,
+			} {
+				n, err := ParseShadowDays(s)
+				Expect(err).Should(BeNil())
+				Expect(n).Should(Equal(days))
+			}
+
+			_, err := ParseShadowDays("3m")
+			Expect(err).ShouldNot(BeNil())
+			_, err = ParseShadowDays("-5")
+			Expect(err).ShouldNot(BeNil())
+		})
+
+		It("Normalizes the spec fields", func() {
+			s, err := Shadow{
+				Username:       "foo",
+				LastChanged:    "2026-10-01",
+				MaximumChanged: "90d",
+				Warn:           "1w",
+				Expire:         "2027-01-31",
+			}.NormalizeAging()
+			Expect(err).Should(BeNil())
+			Expect(s.String()).Should(Equal("foo::20727::90:7::20849:"))
+
+			_, err = Shadow{Username: "foo", Inactive: "soon"}.NormalizeAging()
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("Computing the status", func() {
+		aging := func(s Shadow) ShadowAging {
+			a, err := s.Aging()
+			Expect(err).Should(BeNil())
+			return a
+		}
+
+		It("Reports the expired accounts", func() {
+			a := aging(Shadow{LastChanged: "100", Expire: "200"})
+			Expect(a.AccountExpired(199)).Should(BeFalse())
+			Expect(a.AccountExpired(200)).Should(BeTrue())
+			Expect(a.Status(200)).Should(Equal(AgingExpired))
+
+			a = aging(Shadow{LastChanged: "100", Expire: "0"})
+			Expect(a.AccountExpired(200)).Should(BeFalse())
+		})
+
+		It("Reports the passwords to change and the inactive accounts", func() {
+			a := aging(Shadow{LastChanged: "100", MaximumChanged: "30", Warn: "7", Inactive: "5"})
+			Expect(a.PasswordExpiration()).Should(Equal(130))
+			Expect(a.InactiveFrom()).Should(Equal(135))
+
+			Expect(a.Status(122)).Should(Equal(AgingOk))
+			Expect(a.Status(123)).Should(Equal(AgingWarning))
+			Expect(a.Status(130)).Should(Equal(AgingChangeDue))
+			Expect(a.Status(135)).Should(Equal(AgingInactive))
+		})
+
+		It("Forces the change with a last change equal to 0", func() {
+			a := aging(Shadow{LastChanged: "0"})
+			Expect(a.PasswordChangeDue(1)).Should(BeTrue())
+			Expect(a.InactiveFrom()).Should(Equal(AgingUnset))
+
+			a = aging(Shadow{LastChanged: "100"})
+			Expect(a.PasswordExpiration()).Should(Equal(AgingUnset))
+			Expect(a.Status(100000)).Should(Equal(AgingOk))
+		})
+	})
+
+	Context("Applying the specs", func() {
+		var tmpdir, shadow string
+
+		BeforeEach(func() {
+			var err error
+			tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			shadow = filepath.Join(tmpdir, "shadow")
+			Expect(ioutil.WriteFile(shadow, []byte(
+				"foo:!:20000:0:90:7:::\nbar:!:0::::::\n"), 0640)).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpdir)
+		})
+
+		It("Writes the days of the dates and the durations", func() {
+			Expect(Shadow{Username: "baz", Password: "!", LastChanged: "2026-10-01",
+				MaximumChanged: "12w", Expire: "2027-01-31"}.Apply(shadow, false)).Should(BeNil())
+
+			data, err := ioutil.ReadFile(shadow)
+			Expect(err).Should(BeNil())
+			Expect(string(data)).Should(ContainSubstring("baz:!:20727::84:::20849:"))
+
+			err = Shadow{Username: "bad", Password: "!", Expire: "tomorrow"}.Apply(shadow, false)
+			Expect(err).ShouldNot(BeNil())
+		})
+
+		It("Reports the status of the accounts", func() {
+			db := NewDatabaseFromPaths(map[string]string{ShadowKind: shadow})
+			entries, err := AgingReport(db, 20100)
+			Expect(err).Should(BeNil())
+			Expect(entries).Should(HaveLen(2))
+			Expect(entries[0].Username).Should(Equal("foo"))
+			Expect(entries[0].Status).Should(Equal(AgingChangeDue))
+			Expect(entries[1].Status).Should(Equal(AgingChangeDue))
+		})
+
+		It("Merges the aging fields of the spec", func() {
+			cur := Shadow{Username: "foo", Password: "!", LastChanged: "20000",
+				MaximumChanged: "90"}
+
+			s, err := cur.Merge(Shadow{Username: "foo", Expire: "2027-01-31",
+				LastChanged: "2026-10-01"})
+			Expect(err).Should(BeNil())
+			Expect(s.(Shadow).Expire).Should(Equal("2027-01-31"))
+			Expect(s.(Shadow).LastChanged).Should(Equal("2026-10-01"))
+			Expect(s.(Shadow).MaximumChanged).Should(Equal("90"))
+
+			// The last change is not reset on every merge.
+			s, err = cur.Merge(Shadow{Username: "foo", LastChanged: "now"})
+			Expect(err).Should(BeNil())
+			Expect(s.(Shadow).LastChanged).Should(Equal("20000"))
+			Expect(s.(Shadow).Expire).Should(Equal(""))
+
+			shadows, err := ParseShadow(shadow)
+			Expect(err).Should(BeNil())
+			s, err = shadows["foo"].Merge(Shadow{Username: "foo", Expire: "2027-01-31"})
+			Expect(err).Should(BeNil())
+			Expect(s.(Shadow).Apply(shadow, false)).Should(BeNil())
+
+			data, err := ioutil.ReadFile(shadow)
+			Expect(err).Should(BeNil())
+			Expect(string(data)).Should(ContainSubstring("foo:!:20000:0:90:7::20849:"))
+		})
+
+		It("Reports the malformed lines without stopping", func() {
+			Expect(ioutil.WriteFile(shadow, []byte(
+				"foo:!:20000:0:90:7:::\nbad:!:20000\nbar:!:0::::::\n"), 0640)).Should(BeNil())
+
+			db := NewDatabaseFromPaths(map[string]string{ShadowKind: shadow})
+			entries, err := AgingReport(db, 20100)
+			Expect(err).Should(BeNil())
+			Expect(entries).Should(HaveLen(3))
+			Expect(entries[1].Username).Should(Equal("bad"))
+			Expect(entries[1].Status).Should(Equal(""))
+			Expect(entries[1].Message).Should(HavePrefix(shadow + ":2: "))
+			Expect(entries[2].Username).Should(Equal("bar"))
+			Expect(entries[2].Status).Should(Equal(AgingChangeDue))
+		})
+	})
+})
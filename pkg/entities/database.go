@@ -0,0 +1,453 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Database is the in-memory model of the passwd, group, shadow,
+// gshadow, subuid and subgid files. Every file is loaded only once on the first access,
+// the entities are applied in memory and the modified files are written
+// only on Save.
+type Database struct {
+	paths     map[string]string
+	files     map[string]*DatabaseFile
+	loginDefs *LoginDefs
+	// On dry-run the secrets of the entities are not read.
+	dryRun bool
+	// Operations executed after the write of the files (e.g. the
+	// creation of the home directories).
+	actions []func() error
+}
+
+// DatabaseFile contains the lines of a file in the original order.
+// The lines not related to an entity (comments, empty lines, NIS
+// entries) are maintained as they are.
+type DatabaseFile struct {
+	kind            string
+	path            string
+	lines           []string
+	index           map[string]int
+	original        []byte
+	exists          bool
+	trailingNewline bool
+	modified        bool
+}
+
+// databaseEntity is implemented by the entities that could be
+// applied to the database.
+type databaseEntity interface {
+	dbApply(db *Database, safe bool) error
+	dbCreate(db *Database) error
+	dbDelete(db *Database) error
+}
+
+// NewDatabase creates the database of the files. Empty paths are
+// resolved with the default files.
+func NewDatabase(usersFile, groupsFile, shadowFile, gShadowFile string) *Database {
+	return newDatabase(map[string]string{
+		UserKind:    usersFile,
+		GroupKind:   groupsFile,
+		ShadowKind:  shadowFile,
+		GShadowKind: gShadowFile,
+	})
+}
+
+// NewDatabaseFromPaths creates the database of the files defined
+// for every kind. The missing paths are resolved with the default files.
+func NewDatabaseFromPaths(paths map[string]string) *Database {
+	return newDatabase(paths)
+}
+
+func newDatabase(paths map[string]string) *Database {
+	ans := &Database{
+		paths: map[string]string{
+			UserKind:    UserDefault(paths[UserKind]),
+			GroupKind:   GroupsDefault(paths[GroupKind]),
+			ShadowKind:  ShadowDefault(paths[ShadowKind]),
+			GShadowKind: GShadowDefault(paths[GShadowKind]),
+			SubUidKind:  SubUidDefault(paths[SubUidKind]),
+			SubGidKind:  SubGidDefault(paths[SubGidKind]),
+		},
+		files: make(map[string]*DatabaseFile),
+	}
+	return ans
+}
+
+// updateDatabaseFile runs the operation over the database with the
+// file of the kind and the files of the other kinds locked and saves
+// it. The other files are the default ones, or the siblings of the
+// file if it isn't the default file of the kind.
+func updateDatabaseFile(kind, path string, op func(db *Database) error, others ...string) error {
+	db := newDatabase(siblingPaths(kind, path, others))
+
+	paths := []string{path}
+	for _, k := range others {
+		if k != kind {
+			paths = append(paths, db.GetPath(k))
+		}
+	}
+	lock, err := LockFiles(paths...)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	err = op(db)
+	if err != nil {
+		return err
+	}
+
+	return db.Save()
+}
+
+// siblingPaths returns the paths of the other kinds updated with the
+// file of the kind. The files of a path that isn't the default one
+// are searched in the same directory, otherwise the changes of a
+// custom group file would be mirrored to the system gshadow file.
+func siblingPaths(kind, path string, others []string) map[string]string {
+	ans := map[string]string{kind: path}
+	defaults := newDatabase(nil)
+	if RootPath(path) == defaults.GetPath(kind) {
+		return ans
+	}
+
+	dir := filepath.Dir(path)
+	for _, k := range others {
+		if k != kind {
+			ans[k] = filepath.Join(dir, filepath.Base(defaults.GetPath(k)))
+		}
+	}
+	return ans
+}
+
+// SetDryRun sets the dry-run mode: the changes are only planned and
+// the secrets of the entities (files, env variables, stdin and
+// commands) are not read.
+func (db *Database) SetDryRun(dryRun bool) {
+	db.dryRun = dryRun
+}
+
+// GetPath returns the path of the file of the kind.
+func (db *Database) GetPath(kind string) string {
+	return db.paths[kind]
+}
+
+// GetFile returns the file of the kind. The file is read only on the
+// first call.
+func (db *Database) GetFile(kind string) (*DatabaseFile, error) {
+	if f, ok := db.files[kind]; ok {
+		return f, nil
+	}
+
+	path, ok := db.paths[kind]
+	if !ok {
+		return nil, errors.New("Unsupported entity kind " + kind)
+	}
+
+	f, err := LoadDatabaseFile(kind, path)
+	if err != nil {
+		return nil, err
+	}
+	db.files[kind] = f
+
+	return f, nil
+}
+
+// GetLoginDefs returns the options of the login.defs file. The file
+// is read only on the first call.
+func (db *Database) GetLoginDefs() (*LoginDefs, error) {
+	if db.loginDefs == nil {
+		l, err := ParseLoginDefs(LoginDefsDefault(""))
+		if err != nil {
+			return nil, err
+		}
+		db.loginDefs = l
+	}
+	return db.loginDefs, nil
+}
+
+// Apply applies the entity in memory.
+func (db *Database) Apply(e Entity, safe bool) error {
+	de, ok := e.(databaseEntity)
+	if !ok {
+		return errors.New("Unsupported entity kind " + e.GetKind())
+	}
+	return de.dbApply(db, safe)
+}
+
+// Create adds the entity in memory.
+func (db *Database) Create(e Entity) error {
+	de, ok := e.(databaseEntity)
+	if !ok {
+		return errors.New("Unsupported entity kind " + e.GetKind())
+	}
+	return de.dbCreate(db)
+}
+
+// Delete removes the entity in memory.
+func (db *Database) Delete(e Entity) error {
+	de, ok := e.(databaseEntity)
+	if !ok {
+		return errors.New("Unsupported entity kind " + e.GetKind())
+	}
+	return de.dbDelete(db)
+}
+
+// modifiedKinds returns the kinds of the modified files.
+func (db *Database) modifiedKinds() []string {
+	ans := []string{}
+	for _, kind := range txKinds {
+		if f, ok := db.files[kind]; ok && f.modified {
+			ans = append(ans, kind)
+		}
+	}
+	return ans
+}
+
+// Save writes all the modified files or none. If one of the files
+// can't be replaced the files already replaced are restored.
+func (db *Database) Save() error {
+	return db.save(txKinds)
+}
+
+// save writes the modified files of the kinds or none.
+func (db *Database) save(kinds []string) error {
+	if db.dryRun {
+		return errors.New("The changes of the dry-run can't be written")
+	}
+
+	modified := []*DatabaseFile{}
+	for _, kind := range kinds {
+		if f, ok := db.files[kind]; ok && f.modified {
+			modified = append(modified, f)
+		}
+	}
+	if len(modified) == 0 {
+		return db.runActions()
+	}
+
+	paths := []string{}
+	for _, f := range modified {
+		paths = append(paths, f.path)
+	}
+	lock, err := LockFiles(paths...)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	pending := []*pendingFile{}
+	for _, f := range modified {
+		p, err := stageFile(f.path, f.Bytes(), 0644, BackupEnabled())
+		if err != nil {
+			for _, p := range pending {
+				p.discard()
+			}
+			return errors.Wrap(err, "Error on prepare "+f.path)
+		}
+		pending = append(pending, p)
+	}
+
+	for i, p := range pending {
+		err = p.commit()
+		if err == nil {
+			continue
+		}
+
+		// Restore the files and the backups already replaced.
+		for _, rp := range pending[i+1:] {
+			rp.discard()
+		}
+		if rerr := p.restoreBackup(); rerr != nil {
+			err = errors.Wrap(err, fmt.Sprintf(
+				"rollback of the backup of %s failed (%s)", p.path, rerr.Error()))
+		}
+		for j, f := range modified[:i] {
+			var rerr error
+			if f.exists {
+				rerr = writeFileAtomic(f.path, f.original, 0644, false)
+			} else {
+				rerr = os.Remove(f.path)
+			}
+			if rerr == nil {
+				rerr = pending[j].restoreBackup()
+			}
+			if rerr != nil {
+				err = errors.Wrap(err, fmt.Sprintf(
+					"rollback of %s failed (%s)", f.path, rerr.Error()))
+			}
+		}
+
+		return errors.Wrap(err, "Error on commit "+modified[i].path)
+	}
+
+	for _, f := range modified {
+		f.original = f.Bytes()
+		f.exists = true
+		f.modified = false
+	}
+
+	return db.runActions()
+}
+
+// addAction adds an operation to execute after the write of the files.
+func (db *Database) addAction(f func() error) {
+	db.actions = append(db.actions, f)
+}
+
+func (db *Database) runActions() error {
+	actions := db.actions
+	db.actions = nil
+	for _, f := range actions {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadDatabaseFile reads the file of the kind. A missing file is
+// handled as an empty file.
+func LoadDatabaseFile(kind, path string) (*DatabaseFile, error) {
+	data, err := os.ReadFile(path)
+	exists := true
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "Could not read input file")
+		}
+		exists = false
+		data = []byte{}
+	}
+
+	ans := NewDatabaseFileFromBytes(kind, path, data)
+	ans.exists = exists
+
+	return ans, nil
+}
+
+// NewDatabaseFileFromBytes creates the file model from the content.
+func NewDatabaseFileFromBytes(kind, path string, data []byte) *DatabaseFile {
+	ans := &DatabaseFile{
+		kind:            kind,
+		path:            path,
+		lines:           splitLines(string(data)),
+		original:        data,
+		trailingNewline: len(data) == 0 || bytes.HasSuffix(data, []byte("\n")),
+	}
+	ans.reindex()
+	return ans
+}
+
+// lineKey returns the name of the entity of the line or an empty
+// string for the lines not related to an entity.
+func lineKey(line string) string {
+	if line == "" || strings.HasPrefix(line, "#") ||
+		strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+		return ""
+	}
+	return entityIdentifier(line)
+}
+
+func (f *DatabaseFile) reindex() {
+	f.index = make(map[string]int)
+	for i, line := range f.lines {
+		key := lineKey(line)
+		if key == "" {
+			continue
+		}
+		if _, ok := f.index[key]; !ok {
+			f.index[key] = i
+		}
+	}
+}
+
+func (f *DatabaseFile) GetKind() string  { return f.kind }
+func (f *DatabaseFile) GetPath() string  { return f.path }
+func (f *DatabaseFile) Exists() bool     { return f.exists }
+func (f *DatabaseFile) Modified() bool   { return f.modified }
+func (f *DatabaseFile) Original() []byte { return f.original }
+
+// Lines returns all the lines of the file.
+func (f *DatabaseFile) Lines() []string {
+	return f.lines
+}
+
+// Get returns the line of the entity.
+func (f *DatabaseFile) Get(name string) (string, bool) {
+	if i, ok := f.index[name]; ok {
+		return f.lines[i], true
+	}
+	return "", false
+}
+
+// Has returns true if the file contains the entity.
+func (f *DatabaseFile) Has(name string) bool {
+	_, ok := f.index[name]
+	return ok
+}
+
+// Names returns the names of the entities in the file order.
+func (f *DatabaseFile) Names() []string {
+	ans := []string{}
+	for i, line := range f.lines {
+		key := lineKey(line)
+		if key != "" && f.index[key] == i {
+			ans = append(ans, key)
+		}
+	}
+	return ans
+}
+
+// Set replaces the line of the entity or appends it at the end
+// of the file.
+func (f *DatabaseFile) Set(name, line string) {
+	if i, ok := f.index[name]; ok {
+		if f.lines[i] != line {
+			f.lines[i] = line
+			f.modified = true
+		}
+		return
+	}
+
+	f.lines = append(f.lines, line)
+	f.index[name] = len(f.lines) - 1
+	f.trailingNewline = true
+	f.modified = true
+}
+
+// Remove drops the line of the entity. It returns false if the
+// entity is not present.
+func (f *DatabaseFile) Remove(name string) bool {
+	i, ok := f.index[name]
+	if !ok {
+		return false
+	}
+
+	f.lines = append(f.lines[:i], f.lines[i+1:]...)
+	f.reindex()
+	f.modified = true
+
+	return true
+}
+
+// Bytes returns the content of the file.
+func (f *DatabaseFile) Bytes() []byte {
+	if len(f.lines) == 0 {
+		return []byte{}
+	}
+	ans := strings.Join(f.lines, "\n")
+	if f.trailingNewline {
+		ans += "\n"
+	}
+	return []byte(ans)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Database", func() {
+	Context("Updating a custom file", func() {
+		var tmpdir, system string
+
+		BeforeEach(func() {
+			var err error
+			tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+
+			// The default files must be never touched.
+			system = filepath.Join(tmpdir, "system")
+			Expect(os.Mkdir(system, 0755)).Should(BeNil())
+			for k, env := range map[string]string{
+				"group":   ENTITY_ENV_DEF_GROUPS,
+				"gshadow": ENTITY_ENV_DEF_GSHADOW,
+			} {
+				f := filepath.Join(system, k)
+				Expect(ioutil.WriteFile(f, []byte("wheel:x:10:root,foo\n"), 0644)).Should(BeNil())
+				os.Setenv(env, f)
+			}
+		})
+
+		AfterEach(func() {
+			os.Unsetenv(ENTITY_ENV_DEF_GROUPS)
+			os.Unsetenv(ENTITY_ENV_DEF_GSHADOW)
+			os.RemoveAll(tmpdir)
+		})
+
+		It("Updates the gshadow file of the same directory", func() {
+			group := filepath.Join(tmpdir, "group")
+			gshadow := filepath.Join(tmpdir, "gshadow")
+			Expect(ioutil.WriteFile(group, []byte("wheel:x:10:root,foo\n"), 0644)).Should(BeNil())
+			Expect(ioutil.WriteFile(gshadow, []byte("wheel::root:root,foo\n"), 0644)).Should(BeNil())
+
+			err := Group{Name: "wheel", Users: "bar",
+				MergeStrategy: MergeStrategyReplace}.Apply(group, false)
+			Expect(err).Should(BeNil())
+			Expect(readFile(group)).Should(Equal("wheel:x:10:bar\n"))
+			Expect(readFile(gshadow)).Should(Equal("wheel::root:bar\n"))
+
+			err = Group{Name: "wheel", MembersRemove: "bar"}.Apply(group, false)
+			Expect(err).Should(BeNil())
+			Expect(readFile(gshadow)).Should(Equal("wheel::root:\n"))
+
+			Expect(readFile(filepath.Join(system, "gshadow"))).Should(Equal("wheel:x:10:root,foo\n"))
+		})
+
+		It("Creates the group of the user in the same directory", func() {
+			passwd := filepath.Join(tmpdir, "passwd")
+			Expect(ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/sh\n"), 0644)).Should(BeNil())
+
+			err := UserPasswd{Username: "foo", Password: "x", Uid: 3000,
+				CreateGroup: true, Homedir: "/", Shell: "/bin/sh"}.Create(passwd)
+			Expect(err).Should(BeNil())
+			Expect(readFile(passwd)).Should(ContainSubstring("foo:x:3000:3000:"))
+			Expect(readFile(filepath.Join(tmpdir, "group"))).Should(Equal("foo:x:3000:\n"))
+
+			Expect(readFile(filepath.Join(system, "group"))).Should(Equal("wheel:x:10:root,foo\n"))
+			Expect(readFile(filepath.Join(system, "gshadow"))).Should(Equal("wheel:x:10:root,foo\n"))
+		})
+	})
+
+	Context("In-memory changes", func() {
+
+		It("Maintains the order and the unmanaged lines", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			file := filepath.Join(tmpdir, "group")
+			err = ioutil.WriteFile(file, []byte(`# Local groups
+root:x:0:root
+bin:x:1:root,bin
+
++@nisgroup
+daemon:x:2:root,bin,daemon
+`), 0644)
+			Expect(err).Should(BeNil())
+
+			db := NewDatabase("", file, "", "")
+			gid := 100
+			err = db.Create(Group{Name: "foo", Password: "x", Gid: &gid, Users: "foo"})
+			Expect(err).Should(BeNil())
+			err = db.Apply(Group{Name: "bin", Password: "x", Users: "foo"}, false)
+			Expect(err).Should(BeNil())
+			err = db.Delete(Group{Name: "daemon"})
+			Expect(err).Should(BeNil())
+
+			f, err := db.GetFile(GroupKind)
+			Expect(err).Should(BeNil())
+			Expect(f.Names()).Should(Equal([]string{"root", "bin", "foo"}))
+
+			// Nothing is written before Save
+			dat, err := ioutil.ReadFile(file)
+			Expect(err).Should(BeNil())
+			Expect(dat).Should(Equal(f.Original()))
+
+			err = db.Save()
+			Expect(err).Should(BeNil())
+
+			dat, err = ioutil.ReadFile(file)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(Equal(`# Local groups
+root:x:0:root
+bin:x:1:root,bin,foo
+
++@nisgroup
+foo:x:100:foo
+`))
+		})
+	})
+})
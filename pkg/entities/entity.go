@@ -6,9 +6,12 @@
 package entities
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -16,7 +19,17 @@ const (
 	ENTITY_ENV_DEF_PASSWD        = "ENTITY_DEFAULT_PASSWD"
 	ENTITY_ENV_DEF_SHADOW        = "ENTITY_DEFAULT_SHADOW"
 	ENTITY_ENV_DEF_GSHADOW       = "ENTITY_DEFAULT_GSHADOW"
+	ENTITY_ENV_DEF_SUBUID        = "ENTITY_DEFAULT_SUBUID"
+	ENTITY_ENV_DEF_SUBGID        = "ENTITY_DEFAULT_SUBGID"
 	ENTITY_ENV_DEF_DYNAMIC_RANGE = "ENTITY_DYNAMIC_RANGE"
+	ENTITY_ENV_BACKUP            = "ENTITY_BACKUP"
+	ENTITY_ENV_LOCK_TIMEOUT      = "ENTITY_LOCK_TIMEOUT"
+	ENTITY_ENV_STRICT            = "ENTITY_STRICT"
+	ENTITY_ENV_DEF_LOGIN_DEFS    = "ENTITY_DEFAULT_LOGIN_DEFS"
+	ENTITY_ENV_HOME_PREFIX       = "ENTITY_HOME_PREFIX"
+	ENTITY_ENV_ROOT              = "ENTITY_ROOT"
+	ENTITY_ENV_HASH              = "ENTITY_HASH"
+	ENTITY_ENV_HASH_ROUNDS       = "ENTITY_HASH_ROUNDS"
 )
 
 // Entity represent something that needs to be applied to a file
@@ -31,6 +44,40 @@ type Entity interface {
 	ToMap() map[interface{}]interface{}
 }
 
+// ErrNotFound is the error matched by errors.Is when the entity to
+// delete is not present.
+var ErrNotFound = errors.New("Entity not found")
+
+// NotFoundError is returned when the entity to delete is not present
+// in the file.
+type NotFoundError struct {
+	Kind string
+	Name string
+	File string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("The %s %s is not present in %s", e.Kind, e.Name, e.File)
+}
+
+// Is permits to check the error with errors.Is(err, ErrNotFound).
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// removeEntity drops the line of the entity with the name or returns a
+// NotFoundError.
+func removeEntity(f *DatabaseFile, name string) error {
+	if !f.Remove(name) {
+		return &NotFoundError{
+			Kind: f.GetKind(),
+			Name: name,
+			File: f.GetPath(),
+		}
+	}
+	return nil
+}
+
 func entityIdentifier(s string) string {
 	fs := strings.Split(s, ":")
 	if len(fs) == 0 {
@@ -40,6 +87,16 @@ func entityIdentifier(s string) string {
 	return fs[0]
 }
 
+// StrictMode returns true if the parsers must reject the malformed
+// lines instead of skipping them with a warning.
+func StrictMode() bool {
+	switch strings.ToLower(os.Getenv(ENTITY_ENV_STRICT)) {
+	case "1", "true", "yes", "enable":
+		return true
+	}
+	return false
+}
+
 func DynamicRange() (int, int) {
 	// Follow Gentoo way
 	uid_start := 999
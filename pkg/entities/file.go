@@ -0,0 +1,230 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// BackupEnabled returns true if before every write the previous
+// content of the file must be saved with the suffix '-'
+// (e.g. /etc/passwd-) like shadow-utils does.
+func BackupEnabled() bool {
+	switch strings.ToLower(os.Getenv(ENTITY_ENV_BACKUP)) {
+	case "1", "true", "yes", "enable":
+		return true
+	}
+	return false
+}
+
+// writeFileAtomic replaces the content of the file path without leaving
+// the file truncated if something goes wrong. The data are written
+// in a temporary file of the same directory that is synced and then
+// renamed over the target. Owner, permissions and extended attributes
+// of the existing file are maintained. The perm argument is used
+// only when the file doesn't exist.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, backup bool) error {
+	p, err := stageFile(path, data, perm, backup)
+	if err != nil {
+		return err
+	}
+	return p.commit()
+}
+
+// pendingFile is a temporary file ready to replace the target file.
+type pendingFile struct {
+	path string
+	tmp  string
+	// Save the previous content of the file on commit.
+	backup bool
+	perm   os.FileMode
+	// The replaced backup, restored on rollback.
+	oldBackup []byte
+	backedUp  bool
+}
+
+// stageFile writes the data in a synced temporary file of the same
+// directory of the file path with the owner, permissions and extended
+// attributes of the existing file. The file is replaced only on commit.
+func stageFile(path string, data []byte, perm os.FileMode, backup bool) (*pendingFile, error) {
+	var st os.FileInfo
+
+	// Write the real file when the path is a symlink.
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		path = p
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "Failed check file "+path)
+		}
+		st = nil
+	} else {
+		perm = st.Mode().Perm()
+		if st.Mode()&os.ModeSetuid != 0 {
+			perm |= os.ModeSetuid
+		}
+		if st.Mode()&os.ModeSetgid != 0 {
+			perm |= os.ModeSetgid
+		}
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".entities-")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create temporary file")
+	}
+	ans := &pendingFile{path: path, tmp: f.Name(), backup: backup && st != nil, perm: perm}
+	done := false
+	defer func() {
+		if !done {
+			f.Close()
+			ans.discard()
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return nil, errors.Wrap(err, "Could not write")
+	}
+
+	if st != nil {
+		if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+			if sys.Uid != uint32(os.Getuid()) || sys.Gid != uint32(os.Getgid()) {
+				if err = f.Chown(int(sys.Uid), int(sys.Gid)); err != nil {
+					return nil, errors.Wrap(err, "Could not maintain the owner of "+path)
+				}
+			}
+		}
+		if err = copyXattrs(path, ans.tmp); err != nil {
+			return nil, errors.Wrap(err, "Could not maintain the extended attributes of "+path)
+		}
+	}
+
+	// NOTE: chmod must be done after chown that drops setuid/setgid bits.
+	if err = f.Chmod(perm); err != nil {
+		return nil, errors.Wrap(err, "Could not set permissions")
+	}
+
+	if err = f.Sync(); err != nil {
+		return nil, errors.Wrap(err, "Could not sync "+ans.tmp)
+	}
+	if err = f.Close(); err != nil {
+		return nil, errors.Wrap(err, "Could not close "+ans.tmp)
+	}
+	done = true
+
+	return ans, nil
+}
+
+// commit renames the temporary file over the target file. The backup
+// is written here and not on stage to maintain the previous backup if
+// the changes are not committed.
+func (p *pendingFile) commit() error {
+	if p.backup {
+		old, err := ioutil.ReadFile(p.path)
+		if err != nil {
+			p.discard()
+			return errors.Wrap(err, "Could not read input file")
+		}
+		p.oldBackup, err = ioutil.ReadFile(p.path + "-")
+		if err != nil && !os.IsNotExist(err) {
+			p.discard()
+			return errors.Wrap(err, "Could not read backup file")
+		}
+		err = writeFileAtomic(p.path+"-", old, p.perm, false)
+		if err != nil {
+			p.discard()
+			return errors.Wrap(err, "Could not create backup file")
+		}
+		p.backedUp = true
+	}
+
+	if err := os.Rename(p.tmp, p.path); err != nil {
+		p.discard()
+		return errors.Wrap(err, "Could not rename "+p.tmp+" to "+p.path)
+	}
+	return syncDir(filepath.Dir(p.path))
+}
+
+// restoreBackup restores the backup replaced by the commit.
+func (p *pendingFile) restoreBackup() error {
+	if !p.backedUp {
+		return nil
+	}
+	p.backedUp = false
+	if p.oldBackup == nil {
+		return os.Remove(p.path + "-")
+	}
+	return writeFileAtomic(p.path+"-", p.oldBackup, p.perm, false)
+}
+
+// discard removes the temporary file.
+func (p *pendingFile) discard() {
+	os.Remove(p.tmp)
+}
+
+// syncDir flushes the directory entry to avoid to lose the rename
+// on crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "Could not open directory "+dir)
+	}
+	defer d.Close()
+
+	if err = d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return errors.Wrap(err, "Could not sync directory "+dir)
+	}
+	return nil
+}
+
+func copyXattrs(src, dst string) error {
+	size, err := unix.Listxattr(src, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+			return nil
+		}
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(src, buf)
+	if err != nil {
+		return err
+	}
+
+	for _, attr := range strings.Split(string(buf[:size]), "\x00") {
+		if attr == "" {
+			continue
+		}
+
+		vsize, err := unix.Getxattr(src, attr, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, vsize)
+		vsize, err = unix.Getxattr(src, attr, value)
+		if err != nil {
+			return err
+		}
+
+		err = unix.Setxattr(dst, attr, value[:vsize], 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
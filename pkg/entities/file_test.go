@@ -0,0 +1,135 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("File", func() {
+	Context("Writing files", func() {
+		p := &Parser{}
+
+		It("Maintains permissions and doesn't leave temporary files", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			file := filepath.Join(tmpdir, "passwd")
+			_, err = copy("../../testing/fixtures/simple/passwd", file)
+			Expect(err).Should(BeNil())
+			Expect(os.Chmod(file, 0600)).Should(BeNil())
+
+			entity, err := p.ReadEntity("../../testing/fixtures/simple/user.yaml")
+			Expect(err).Should(BeNil())
+
+			err = entity.Apply(file, false)
+			Expect(err).Should(BeNil())
+
+			st, err := os.Stat(file)
+			Expect(err).Should(BeNil())
+			Expect(st.Mode().Perm()).Should(Equal(os.FileMode(0600)))
+
+			files, err := ioutil.ReadDir(tmpdir)
+			Expect(err).Should(BeNil())
+			for _, f := range files {
+				// The lckpwdf lock file is maintained.
+				Expect(f.Name()).Should(BeElementOf("passwd", ".pwd.lock"))
+			}
+		})
+
+		It("Creates the backup file", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			os.Setenv(ENTITY_ENV_BACKUP, "1")
+			defer os.Unsetenv(ENTITY_ENV_BACKUP)
+
+			file := filepath.Join(tmpdir, "passwd")
+			_, err = copy("../../testing/fixtures/simple/passwd", file)
+			Expect(err).Should(BeNil())
+
+			entity, err := p.ReadEntity("../../testing/fixtures/simple/user.yaml")
+			Expect(err).Should(BeNil())
+
+			err = entity.Apply(file, false)
+			Expect(err).Should(BeNil())
+
+			orig, err := ioutil.ReadFile("../../testing/fixtures/simple/passwd")
+			Expect(err).Should(BeNil())
+			backup, err := ioutil.ReadFile(file + "-")
+			Expect(err).Should(BeNil())
+			Expect(backup).Should(Equal(orig))
+
+			dat, err := ioutil.ReadFile(file)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).To(ContainSubstring("foo:pass:0:0:Foo!:/home/foo:/bin/bash\n"))
+		})
+
+		Context("Maintaining the previous backup when the save fails", func() {
+			var tmpdir, file, group string
+			var db *Database
+
+			BeforeEach(func() {
+				var err error
+				tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+				Expect(err).Should(BeNil())
+				os.Setenv(ENTITY_ENV_BACKUP, "1")
+
+				file = filepath.Join(tmpdir, "passwd")
+				_, err = copy("../../testing/fixtures/simple/passwd", file)
+				Expect(err).Should(BeNil())
+				Expect(ioutil.WriteFile(file+"-", []byte("previous\n"), 0644)).Should(BeNil())
+				group = filepath.Join(tmpdir, "group")
+
+				db = NewDatabaseFromPaths(map[string]string{UserKind: file, GroupKind: group})
+				entity, err := p.ReadEntity("../../testing/fixtures/simple/user.yaml")
+				Expect(err).Should(BeNil())
+				Expect(db.Apply(entity, false)).Should(BeNil())
+				gid := 1500
+				Expect(db.Apply(Group{Name: "foo", Password: "x", Gid: &gid}, false)).Should(BeNil())
+			})
+
+			AfterEach(func() {
+				os.Unsetenv(ENTITY_ENV_BACKUP)
+				os.RemoveAll(tmpdir)
+			})
+
+			check := func() {
+				Expect(db.Save()).ShouldNot(BeNil())
+
+				backup, err := ioutil.ReadFile(file + "-")
+				Expect(err).Should(BeNil())
+				Expect(string(backup)).Should(Equal("previous\n"))
+				orig, err := ioutil.ReadFile("../../testing/fixtures/simple/passwd")
+				Expect(err).Should(BeNil())
+				dat, err := ioutil.ReadFile(file)
+				Expect(err).Should(BeNil())
+				Expect(dat).Should(Equal(orig))
+			}
+
+			It("Fails the prepare of the next file", func() {
+				// The symlink loop can't be written.
+				Expect(os.Symlink(group+"2", group)).Should(BeNil())
+				Expect(os.Symlink(group, group+"2")).Should(BeNil())
+				check()
+			})
+
+			It("Fails the commit of the next file", func() {
+				// A not empty directory can't be replaced.
+				Expect(os.MkdirAll(filepath.Join(group, "dir"), 0755)).Should(BeNil())
+				check()
+			})
+		})
+	})
+})
@@ -0,0 +1,267 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fixes applied by FixDatabase.
+const (
+	FixCreateShadow   = "create-shadow"
+	FixCreateGShadow  = "create-gshadow"
+	FixDropShadow     = "drop-shadow"
+	FixDropGShadow    = "drop-gshadow"
+	FixCleanupMembers = "cleanup-members"
+	FixSort           = "sort"
+)
+
+// FixOptions define the optional fixes.
+type FixOptions struct {
+	// Sort the passwd and group entries by id and the shadow and
+	// gshadow entries with the same order.
+	Sort bool
+	// Remove the shadow and gshadow entries without user or group.
+	// The passwords of the entries are lost.
+	DropOrphans bool
+}
+
+// FixAction describes a fix applied to a file.
+type FixAction struct {
+	Fix     string `json:"fix" yaml:"fix"`
+	Kind    string `json:"kind" yaml:"kind"`
+	Name    string `json:"name,omitempty" yaml:"name,omitempty"`
+	File    string `json:"file" yaml:"file"`
+	Message string `json:"message" yaml:"message"`
+}
+
+// FixReport contains the fixes applied.
+type FixReport struct {
+	Fixes []FixAction `json:"fixes" yaml:"fixes"`
+}
+
+func (r *FixReport) add(fix, kind, name, file, msg string) {
+	r.Fixes = append(r.Fixes, FixAction{
+		Fix:     fix,
+		Kind:    kind,
+		Name:    name,
+		File:    file,
+		Message: msg,
+	})
+}
+
+// setLines replaces the lines of the file.
+func (f *DatabaseFile) setLines(lines []string) {
+	if strings.Join(lines, "\n") == strings.Join(f.lines, "\n") {
+		return
+	}
+	f.lines = lines
+	f.reindex()
+	f.modified = true
+}
+
+// cleanupMembers removes the empty and duplicated names from the
+// fields of the lines with the members lists.
+func cleanupMembers(f *DatabaseFile, fields []int, r *FixReport) {
+	lines := make([]string, len(f.lines))
+	copy(lines, f.lines)
+
+	for i, line := range lines {
+		if lineKey(line) == "" {
+			continue
+		}
+		fs := strings.Split(line, ":")
+		if len(fs) != 4 {
+			continue
+		}
+		for _, field := range fields {
+			members := strings.Join(Unique(strings.Split(fs[field], ",")), ",")
+			if members != fs[field] {
+				r.add(FixCleanupMembers, f.GetKind(), fs[0], f.GetPath(),
+					fmt.Sprintf("members of %s changed from '%s' to '%s'",
+						fs[0], fs[field], members))
+				fs[field] = members
+			}
+		}
+		lines[i] = strings.Join(fs, ":")
+	}
+
+	f.setLines(lines)
+}
+
+// sortLines sorts the entries of the file with the order function.
+// The lines not related to an entity and the malformed lines
+// maintain their position.
+func sortLines(f *DatabaseFile, valid func(line string) bool,
+	less func(a, b string) bool, r *FixReport) {
+
+	pos := []int{}
+	entries := []string{}
+	for i, line := range f.lines {
+		if lineKey(line) != "" && valid(line) {
+			pos = append(pos, i)
+			entries = append(entries, line)
+		}
+	}
+
+	sorted := make([]string, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+	if strings.Join(sorted, "\n") == strings.Join(entries, "\n") {
+		return
+	}
+
+	lines := make([]string, len(f.lines))
+	copy(lines, f.lines)
+	for i, p := range pos {
+		lines[p] = sorted[i]
+	}
+	f.setLines(lines)
+
+	r.add(FixSort, f.GetKind(), "", f.GetPath(), "entries sorted")
+}
+
+// lineId returns the numeric id of the third field of the line.
+func lineId(line string) int {
+	id, _ := strconv.Atoi(strings.Split(line, ":")[2])
+	return id
+}
+
+// orderByFile returns a function that sorts the lines by the
+// position of the entity in the reference file. The entities not
+// present in the reference file are moved at the end.
+func orderByFile(ref *DatabaseFile) func(a, b string) bool {
+	order := make(map[string]int)
+	for i, name := range ref.Names() {
+		order[name] = i
+	}
+	position := func(line string) int {
+		if i, ok := order[lineKey(line)]; ok {
+			return i
+		}
+		return len(order)
+	}
+	return func(a, b string) bool {
+		return position(a) < position(b)
+	}
+}
+
+// FixDatabase repairs in memory the inconsistencies that could be fixed
+// without loss of information: the shadow and gshadow entries missing
+// are created locked and the empty or duplicated names are removed
+// from the members lists. Only with the DropOrphans option the shadow
+// and gshadow entries without user or group are removed.
+func FixDatabase(db *Database, opts FixOptions) (*FixReport, error) {
+	r := &FixReport{Fixes: []FixAction{}}
+
+	users, err := db.GetFile(UserKind)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := db.GetFile(GroupKind)
+	if err != nil {
+		return nil, err
+	}
+	shadows, err := db.GetFile(ShadowKind)
+	if err != nil {
+		return nil, err
+	}
+	gshadows, err := db.GetFile(GShadowKind)
+	if err != nil {
+		return nil, err
+	}
+
+	cleanupMembers(groups, []int{3}, r)
+	if gshadows.Exists() {
+		cleanupMembers(gshadows, []int{2, 3}, r)
+	}
+
+	if shadows.Exists() {
+		// The entries are removed only if the user is not present at
+		// all. A malformed passwd line must be fixed manually.
+		for _, name := range shadows.Names() {
+			if opts.DropOrphans && !users.Has(name) {
+				shadows.Remove(name)
+				r.add(FixDropShadow, ShadowKind, name, shadows.GetPath(),
+					fmt.Sprintf("removed shadow entry of missing user %s", name))
+			}
+		}
+
+		for _, name := range users.Names() {
+			line, _ := users.Get(name)
+			if _, err := parseUserLine(line); err != nil || shadows.Has(name) {
+				continue
+			}
+			s, err := Shadow{
+				Username:    name,
+				Password:    "!",
+				LastChanged: "now",
+			}.prepare(db)
+			if err != nil {
+				return nil, err
+			}
+			shadows.Set(name, s.String())
+			r.add(FixCreateShadow, ShadowKind, name, shadows.GetPath(),
+				fmt.Sprintf("created locked shadow entry for user %s", name))
+		}
+	}
+
+	if gshadows.Exists() {
+		for _, name := range gshadows.Names() {
+			if opts.DropOrphans && !groups.Has(name) {
+				gshadows.Remove(name)
+				r.add(FixDropGShadow, GShadowKind, name, gshadows.GetPath(),
+					fmt.Sprintf("removed gshadow entry of missing group %s", name))
+			}
+		}
+
+		for _, name := range groups.Names() {
+			line, _ := groups.Get(name)
+			_, g, err := parseGroupLine(line)
+			if err != nil || gshadows.Has(name) {
+				continue
+			}
+			gs := GShadow{
+				Name:     name,
+				Password: "!",
+				Members:  g.Users,
+			}
+			gshadows.Set(name, gs.String())
+			r.add(FixCreateGShadow, GShadowKind, name, gshadows.GetPath(),
+				fmt.Sprintf("created locked gshadow entry for group %s", name))
+		}
+	}
+
+	if opts.Sort {
+		validUser := func(line string) bool {
+			_, err := parseUserLine(line)
+			return err == nil
+		}
+		validGroup := func(line string) bool {
+			_, _, err := parseGroupLine(line)
+			return err == nil
+		}
+		byId := func(a, b string) bool {
+			return lineId(a) < lineId(b)
+		}
+		always := func(line string) bool { return true }
+
+		sortLines(users, validUser, byId, r)
+		sortLines(groups, validGroup, byId, r)
+		if shadows.Exists() {
+			sortLines(shadows, always, orderByFile(users), r)
+		}
+		if gshadows.Exists() {
+			sortLines(gshadows, always, orderByFile(groups), r)
+		}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fix", func() {
+	Context("Repair entities files", func() {
+
+		It("Fixes the inconsistencies", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			files := map[string]string{
+				"passwd": `root:x:0:0:root:/:/bin/sh
+# local users
+foo:x:1000:100::/:/bin/sh
+bin:x:1:1::/:/bin/sh
+`,
+				"group": `root:x:0:
+users:x:100:,foo,,foo
+bin:x:1:
+`,
+				"shadow": `root:!:::::::
+zed:!:::::::
+`,
+				"gshadow": `root:!::
+users:!:foo,:foo
+old:!::
+`,
+			}
+			for name, content := range files {
+				err := ioutil.WriteFile(filepath.Join(tmpdir, name), []byte(content), 0644)
+				Expect(err).Should(BeNil())
+			}
+
+			tx, err := NewTransaction(
+				filepath.Join(tmpdir, "passwd"),
+				filepath.Join(tmpdir, "group"),
+				filepath.Join(tmpdir, "shadow"),
+				filepath.Join(tmpdir, "gshadow"),
+			)
+			Expect(err).Should(BeNil())
+			defer tx.Rollback()
+
+			report, err := FixDatabase(tx.GetDatabase(), FixOptions{Sort: true, DropOrphans: true})
+			Expect(err).Should(BeNil())
+
+			fixes := []string{}
+			for _, f := range report.Fixes {
+				fixes = append(fixes, f.Fix+":"+f.Name)
+			}
+			Expect(fixes).Should(Equal([]string{
+				"cleanup-members:users",
+				"cleanup-members:users",
+				"drop-shadow:zed",
+				"create-shadow:foo",
+				"create-shadow:bin",
+				"drop-gshadow:old",
+				"create-gshadow:bin",
+				"sort:",
+				"sort:",
+				"sort:",
+				"sort:",
+			}))
+
+			err = tx.Commit()
+			Expect(err).Should(BeNil())
+
+			read := func(name string) string {
+				dat, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+				Expect(err).Should(BeNil())
+				return string(dat)
+			}
+
+			Expect(read("passwd")).Should(Equal(`root:x:0:0:root:/:/bin/sh
+# local users
+bin:x:1:1::/:/bin/sh
+foo:x:1000:100::/:/bin/sh
+`))
+			Expect(read("group")).Should(Equal(`root:x:0:
+bin:x:1:
+users:x:100:foo
+`))
+			Expect(read("gshadow")).Should(Equal(`root:!::
+bin:!::
+users:!:foo:foo
+`))
+
+			shadows := strings.Split(strings.TrimSpace(read("shadow")), "\n")
+			Expect(len(shadows)).Should(Equal(3))
+			Expect(shadows[0]).Should(Equal("root:!:::::::"))
+			Expect(shadows[1]).Should(HavePrefix("bin:!:"))
+			Expect(shadows[2]).Should(HavePrefix("foo:!:"))
+
+			db := NewDatabase(
+				filepath.Join(tmpdir, "passwd"),
+				filepath.Join(tmpdir, "group"),
+				filepath.Join(tmpdir, "shadow"),
+				filepath.Join(tmpdir, "gshadow"),
+			)
+			vreport, err := ValidateDatabase(db)
+			Expect(err).Should(BeNil())
+			Expect(vreport.Errors).Should(Equal(0))
+		})
+
+		It("Maintains the orphan entries without the option", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			files := map[string]string{
+				"passwd":  "root:x:0:0:root:/:/bin/sh\n",
+				"group":   "root:x:0:\n",
+				"shadow":  "root:!:::::::\nzed:$6$salt$hash:::::::\n",
+				"gshadow": "root:!::\nold:$6$salt$hash::\n",
+			}
+			for name, content := range files {
+				err := ioutil.WriteFile(filepath.Join(tmpdir, name), []byte(content), 0644)
+				Expect(err).Should(BeNil())
+			}
+
+			tx, err := NewTransaction(
+				filepath.Join(tmpdir, "passwd"),
+				filepath.Join(tmpdir, "group"),
+				filepath.Join(tmpdir, "shadow"),
+				filepath.Join(tmpdir, "gshadow"),
+			)
+			Expect(err).Should(BeNil())
+			defer tx.Rollback()
+
+			report, err := FixDatabase(tx.GetDatabase(), FixOptions{})
+			Expect(err).Should(BeNil())
+			Expect(report.Fixes).Should(BeEmpty())
+			Expect(tx.Commit()).Should(BeNil())
+
+			for name, content := range files {
+				dat, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+				Expect(err).Should(BeNil())
+				Expect(string(dat)).Should(Equal(content))
+			}
+		})
+	})
+})
@@ -9,13 +9,11 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 
-	permbits "github.com/phayes/permbits"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
@@ -27,7 +25,7 @@ func GroupsDefault(s string) string {
 			s = "/etc/group"
 		}
 	}
-	return s
+	return RootPath(s)
 }
 
 // ParseGroup opens the file and parses it into a map from usernames to Entries
@@ -48,22 +46,37 @@ func ParseGroup(path string) (map[string]Group, error) {
 
 	defer file.Close()
 
-	return ParseGroupReader(file)
+	return parseGroupReader(path, file)
 }
 
 // ParseGroupReader consumes the contents of r and parses it into a map from
-// usernames to Entries
+// names to Entries. Comments, empty lines and NIS entries are skipped.
+// The malformed lines are reported as warnings and skipped or
+// rejected in strict mode.
 func ParseGroupReader(r io.Reader) (map[string]Group, error) {
+	return parseGroupReader("", r)
+}
+
+func parseGroupReader(file string, r io.Reader) (map[string]Group, error) {
 	lines := bufio.NewReader(r)
 	entries := make(map[string]Group)
+	n := 0
 	for {
 		line, _, err := lines.ReadLine()
 		if err != nil {
 			break
 		}
-		name, entry, err := parseGroupLine(string(copyBytes(line)))
+		n++
+		content := string(copyBytes(line))
+		if lineKey(content) == "" {
+			continue
+		}
+		name, entry, err := parseGroupLine(content)
 		if err != nil {
-			return nil, err
+			if err = parseLineError(file, n, content, err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		entries[name] = entry
 	}
@@ -73,41 +86,45 @@ func ParseGroupReader(r io.Reader) (map[string]Group, error) {
 func parseGroupLine(line string) (string, Group, error) {
 	fs := strings.Split(line, ":")
 	if len(fs) != 4 {
-		return "", Group{}, errors.New(
-			"Unexpected number of fields in /etc/group: found " + strconv.Itoa(len(fs)) +
-				" - " + line)
+		return "", Group{}, newFieldsNumberError(4, len(fs))
+	}
+
+	if fs[0] == "" {
+		return "", Group{}, newParseError(ParseErrorEmptyName, 1, "group_name",
+			"Empty group name")
 	}
 
 	gid, err := strconv.Atoi(fs[2])
-	if err != nil {
-		return "", Group{}, errors.New("Expected int for gid")
+	if err != nil || gid < 0 {
+		return "", Group{}, newParseError(ParseErrorInvalidId, 3, "gid",
+			fmt.Sprintf("Invalid gid '%s' for group %s", fs[2], fs[0]))
 	}
-	return fs[0], Group{fs[0], fs[1], &gid, fs[3]}, nil
+	return fs[0], Group{
+		Name:     fs[0],
+		Password: fs[1],
+		Gid:      &gid,
+		Users:    fs[3],
+	}, nil
 }
 
-func groupGetFreeGid(path string) (int, error) {
-	uidStart, uidEnd := DynamicRange()
-	mGids := make(map[int]*Group)
-	ans := -1
+func groupGetFreeGid(db *Database, r IdRange) (int, error) {
+	mGids := make(map[int]bool)
 
-	current, err := ParseGroup(path)
+	f, err := db.GetFile(GroupKind)
 	if err != nil {
-		return ans, err
-	}
-
-	for _, e := range current {
-		mGids[*e.Gid] = &e
+		return -1, err
 	}
 
-	for i := uidStart; i >= uidEnd; i-- {
-		if _, ok := mGids[i]; !ok {
-			ans = i
-			break
+	for _, name := range f.Names() {
+		line, _ := f.Get(name)
+		if _, e, err := parseGroupLine(line); err == nil {
+			mGids[*e.Gid] = true
 		}
 	}
 
-	if ans < 0 {
-		return ans, errors.New("No free GID found")
+	ans, ok := getFreeId(r, mGids)
+	if !ok {
+		return ans, errors.New("No free GID found in range " + r.String())
 	}
 
 	return ans, nil
@@ -118,6 +135,20 @@ type Group struct {
 	Password string `yaml:"password" json:"password"`
 	Gid      *int   `yaml:"gid" json:"gid"`
 	Users    string `yaml:"users" json:"users"`
+
+	// Options used on dynamic gid allocation
+	System   bool   `yaml:"system,omitempty" json:"system,omitempty"`
+	GidRange string `yaml:"gid_range,omitempty" json:"gid_range,omitempty"`
+
+	// Order of the merge of the entity. Lower values are merged first.
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
+
+	// Users to remove from the members of the group and of the
+	// gshadow entry.
+	MembersRemove string `yaml:"members_remove,omitempty" json:"members_remove,omitempty"`
+
+	// Strategy used to merge the users: union, replace or remove.
+	MergeStrategy string `yaml:"merge_strategy,omitempty" json:"merge_strategy,omitempty"`
 }
 
 func (u Group) GetKind() string { return GroupKind }
@@ -131,10 +162,55 @@ func (u Group) GetUsers() []string {
 	return ans
 }
 
-func (u Group) prepare(s string) (Group, error) {
+// gidRange returns the range of the dynamic gid: the range of the
+// entity or the groups or system groups range of login.defs.
+func (u Group) gidRange(db *Database) (IdRange, error) {
+	if u.GidRange != "" {
+		return ParseIdRange(u.GidRange)
+	}
+	l, err := db.GetLoginDefs()
+	if err != nil {
+		return IdRange{}, err
+	}
+	return l.GidRange(u.System), nil
+}
+
+// dropRemovedMembers removes the users of MembersRemove from the users
+// of the group.
+func (u Group) dropRemovedMembers() Group {
+	if u.MembersRemove != "" {
+		u.Users = strings.Join(removeMembers(splitMembers(u.Users),
+			splitMembers(u.MembersRemove)...), ",")
+	}
+	return u
+}
+
+// normalizeStrategy converts the users of the remove strategy in
+// users to remove.
+func (u Group) normalizeStrategy() (Group, error) {
+	err := CheckMergeStrategy(u.MergeStrategy)
+	if err != nil {
+		return u, err
+	}
+
+	if u.MergeStrategy == MergeStrategyRemove {
+		u.MembersRemove = strings.Join(addMembers(splitMembers(u.MembersRemove),
+			splitMembers(u.Users)...), ",")
+		u.Users = ""
+		u.MergeStrategy = ""
+	}
+
+	return u, nil
+}
+
+func (u Group) prepare(db *Database) (Group, error) {
 	if u.Gid != nil && *u.Gid < 0 {
 		// POST: dynamic group
-		gid, err := groupGetFreeGid(s)
+		r, err := u.gidRange(db)
+		if err != nil {
+			return u, err
+		}
+		gid, err := groupGetFreeGid(db, r)
 		if err != nil {
 			return u, err
 		}
@@ -160,82 +236,47 @@ func (u Group) String() string {
 
 func (u Group) Delete(s string) error {
 	s = GroupsDefault(s)
-	input, err := ioutil.ReadFile(s)
-	if err != nil {
-		return errors.Wrap(err, "Could not read input file")
-	}
-	permissions, err := permbits.Stat(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed getting permissions")
-	}
-
-	// Drop the line which match the identifier. Don't look at the content as in other cases
-	lines := strings.Split(string(input), "\n")
-	var toremove int
-	for i, line := range lines {
-		if entityIdentifier(line) == u.Name {
-			toremove = i
-		}
-	}
-
-	// Remove the element at index i from a.
-	copy(lines[toremove:], lines[toremove+1:]) // Shift a[i+1:] left one index.
-	lines[len(lines)-1] = ""                   // Erase last element (write zero value).
-	lines = lines[:len(lines)-1]               // Truncate slice.
+	return updateDatabaseFile(GroupKind, s, func(db *Database) error {
+		return u.dbDelete(db)
+	})
+}
 
-	output := strings.Join(lines, "\n")
+func (u Group) Create(s string) error {
+	s = GroupsDefault(s)
+	return updateDatabaseFile(GroupKind, s, func(db *Database) error {
+		return u.dbCreate(db)
+	})
+}
 
-	err = ioutil.WriteFile(s, []byte(output), os.FileMode(permissions))
+func (u Group) dbDelete(db *Database) error {
+	f, err := db.GetFile(GroupKind)
 	if err != nil {
-		return errors.Wrap(err, "Could not write")
+		return err
+	}
+	if !f.Exists() {
+		return errors.New("Could not read input file " + f.GetPath())
 	}
 
-	return nil
+	// Drop the line which match the group name.
+	return removeEntity(f, u.Name)
 }
 
-func (u Group) Create(s string) error {
-	var f *os.File
-
-	s = GroupsDefault(s)
-
-	u, err := u.prepare(s)
+func (u Group) dbCreate(db *Database) error {
+	u, err := u.prepare(db)
 	if err != nil {
 		return errors.Wrap(err, "Failed entity preparation")
 	}
 
-	_, err = os.Stat(s)
-	if err == nil {
-		current, err := ParseGroup(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed parsing passwd")
-		}
-		if _, ok := current[u.Name]; ok {
-			return errors.New("Entity already present")
-		}
-		permissions, err := permbits.Stat(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed getting permissions")
-		}
-		// Add it
-		f, err = os.OpenFile(s, os.O_APPEND|os.O_WRONLY, os.FileMode(permissions))
-		if err != nil {
-			return errors.Wrap(err, "Could not read")
-		}
-
-	} else if os.IsNotExist(err) {
-		f, err = os.OpenFile(s, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			return errors.Wrap(err, "Could not create the file")
-		}
-	} else {
-		return errors.Wrap(err, "Error on stat file")
+	f, err := db.GetFile(GroupKind)
+	if err != nil {
+		return err
+	}
+	if f.Has(u.Name) {
+		return errors.New("Entity already present")
 	}
 
-	defer f.Close()
+	f.Set(u.Name, u.String())
 
-	if _, err = f.WriteString(u.String() + "\n"); err != nil {
-		return errors.Wrap(err, "Could not write")
-	}
 	return nil
 }
 
@@ -263,109 +304,108 @@ func (u Group) Apply(s string, safe bool) error {
 	}
 
 	s = GroupsDefault(s)
+	return updateDatabaseFile(GroupKind, s, func(db *Database) error {
+		return u.dbApply(db, safe)
+	}, EntityKinds(u)...)
+}
 
-	u, err := u.prepare(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed entity preparation")
+// updatesGShadow returns true if the apply changes the members of the
+// gshadow entry too.
+func (u Group) updatesGShadow() bool {
+	return u.MembersRemove != "" || u.MergeStrategy == MergeStrategyReplace ||
+		u.MergeStrategy == MergeStrategyRemove
+}
+
+func (u Group) dbApply(db *Database, safe bool) error {
+	if u.Name == "" {
+		return errors.New("Empty group name")
 	}
 
-	_, err = os.Stat(s)
-	if err == nil {
-		current, err := ParseGroup(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed parsing passwd")
-		}
-		permissions, err := permbits.Stat(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed getting permissions")
-		}
+	u, err := u.normalizeStrategy()
+	if err != nil {
+		return err
+	}
 
-		if safe && u.Gid != nil {
-			// Avoid this check if the gid is not
-			// present. For example for the specs where
-			// we add users to a group.
+	u, err = u.prepare(db)
+	if err != nil {
+		return errors.Wrap(err, "Failed entity preparation")
+	}
 
-			mGids := make(map[int]*Group)
-			// Create gids to check gid mismatch
-			// Maybe could be done always.
-			for _, e := range current {
-				mGids[*e.Gid] = &e
-			}
+	f, err := db.GetFile(GroupKind)
+	if err != nil {
+		return err
+	}
 
-			if e, present := mGids[*u.Gid]; present {
-				if e.Name != u.Name {
-					return errors.Wrap(err,
-						fmt.Sprintf("Gid %d is already used on group %s",
-							*u.Gid, u.Name))
-				}
+	if safe && u.Gid != nil {
+		// Avoid this check if the gid is not
+		// present. For example for the specs where
+		// we add users to a group.
+		for _, name := range f.Names() {
+			line, _ := f.Get(name)
+			_, e, err := parseGroupLine(line)
+			if err == nil && *e.Gid == *u.Gid && e.Name != u.Name {
+				return errors.New(
+					fmt.Sprintf("Gid %d is already used on group %s",
+						*u.Gid, e.Name))
 			}
 		}
+	}
 
-		if _, ok := current[u.Name]; ok {
-			// POST: The existing group file contains the
-			// required group
-
-			input, err := ioutil.ReadFile(s)
-			if err != nil {
-				return errors.Wrap(err, "Could not read input file")
-			}
+	line, ok := f.Get(u.Name)
+	if !ok {
+		// POST: The existing groups file doesn't contain
+		//       the group name selected.
+		if u.Gid == nil {
+			return errors.New("Required group " + u.Name + " is not present. I can't retrieve id.")
+		}
+		return u.dropRemovedMembers().dbCreate(db)
+	}
 
-			lines := strings.Split(string(input), "\n")
-
-			for i, line := range lines {
-				if entityIdentifier(line) == u.Name {
-					// Merge the groups, don't override the whole user.
-					_, g, err := parseGroupLine(lines[i])
-					if err != nil {
-						return errors.Wrap(err, "Failed parsing current group")
-					}
-					if len(g.Users) > 0 {
-						currentUsers := strings.Split(g.Users, ",")
-						if u.Users != "" {
-							currentUsers = append(currentUsers, strings.Split(u.Users, ",")...)
-						}
-						u.Users = strings.Join(Unique(currentUsers), ",")
-					}
-
-					if !safe {
-						if len(u.Password) == 0 {
-							u.Password = g.Password
-						}
-						if u.Gid == nil {
-							u.Gid = g.Gid
-						}
-					} else {
-						// Maintain existing group id and password
-						u.Gid = g.Gid
-						u.Password = g.Password
-					}
-
-					lines[i] = u.String()
-				}
-			}
-			output := strings.Join(lines, "\n")
-			err = ioutil.WriteFile(s, []byte(output), os.FileMode(permissions))
-			if err != nil {
-				return errors.Wrap(err, "Could not write")
-			}
+	// POST: The existing group file contains the
+	// required group
 
-		} else {
+	// Merge the groups, don't override the whole user.
+	_, g, err := parseGroupLine(line)
+	if err != nil {
+		return errors.Wrap(err, "Failed parsing current group")
+	}
+	if len(g.Users) > 0 && u.MergeStrategy != MergeStrategyReplace {
+		currentUsers := strings.Split(g.Users, ",")
+		if u.Users != "" {
+			currentUsers = append(currentUsers, strings.Split(u.Users, ",")...)
+		}
+		u.Users = strings.Join(Unique(currentUsers), ",")
+	}
+	u = u.dropRemovedMembers()
+
+	// Maintain the gshadow members in sync.
+	if u.MergeStrategy == MergeStrategyReplace {
+		users := splitMembers(u.Users)
+		err = editGroupMembers(db, u.Name, func(members []string) []string {
+			return Unique(users)
+		})
+	} else if u.MembersRemove != "" {
+		err = RemoveGroupMembers(db, u.Name, splitMembers(u.MembersRemove)...)
+	}
+	if err != nil {
+		return err
+	}
 
-			// POST: The existing groups file doesn't contain
-			//       the group name selected.
-			if u.Gid == nil {
-				// NOTE: Pass err nil to errors.Wrap generate a nil error.
-				//       I use errors.New in this case.
-				return errors.New("Required group " + u.Name + " is not present. I can't retrieve id.")
-			}
-			return u.Create(s)
+	if !safe {
+		if len(u.Password) == 0 {
+			u.Password = g.Password
+		}
+		if u.Gid == nil {
+			u.Gid = g.Gid
 		}
-	} else if os.IsNotExist(err) {
-		return u.Create(s)
 	} else {
-		return errors.Wrap(err, "Could not stat file")
+		// Maintain existing group id and password
+		u.Gid = g.Gid
+		u.Password = g.Password
 	}
 
+	f.Set(u.Name, u.String())
+
 	return nil
 }
 
@@ -375,10 +415,16 @@ func (u Group) Merge(e Entity) (Entity, error) {
 		return u, errors.New("merge possible only for entities of the same kind")
 	}
 
-	toMerge := e.(Group)
+	toMerge, err := e.(Group).normalizeStrategy()
+	if err != nil {
+		return u, err
+	}
 
 	// Maintains existing gid and password.
-	if toMerge.Users != "" {
+	if toMerge.MergeStrategy == MergeStrategyReplace {
+		u.Users = toMerge.Users
+		u.MergeStrategy = MergeStrategyReplace
+	} else if toMerge.Users != "" {
 		if u.Users == "" {
 			u.Users = toMerge.Users
 		} else {
@@ -406,6 +452,12 @@ func (u Group) Merge(e Entity) (Entity, error) {
 		}
 	}
 
+	if toMerge.MembersRemove != "" {
+		u.MembersRemove = strings.Join(addMembers(splitMembers(u.MembersRemove),
+			splitMembers(toMerge.MembersRemove)...), ",")
+		u = u.dropRemovedMembers()
+	}
+
 	return u, nil
 }
 
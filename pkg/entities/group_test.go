@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	. "github.com/geaaru/entities/pkg/entities"
 
@@ -116,6 +117,62 @@ minetest:x:975:
 abrt:x:974:
 geoclue:x:973:
 ntp:x:123:
+`))
+		})
+	})
+
+	Context("Parsing files with unmanaged lines", func() {
+
+		It("Skips comments, NIS entries and malformed lines", func() {
+			warnings := []*ParseError{}
+			SetParseWarningHandler(func(w *ParseError) {
+				warnings = append(warnings, w)
+			})
+			defer SetParseWarningHandler(nil)
+
+			groups, err := ParseGroupReader(strings.NewReader(`# Local groups
+root:x:0:root
+
+bin:x:1
++@nisgroup
+-foo
+daemon:x:2:root,bin,daemon
+`))
+			Expect(err).Should(BeNil())
+			Expect(len(groups)).Should(Equal(2))
+			Expect(groups["daemon"].Users).Should(Equal("root,bin,daemon"))
+			Expect(len(warnings)).Should(Equal(1))
+			Expect(warnings[0].Line).Should(Equal(4))
+			Expect(warnings[0].Content).Should(Equal("bin:x:1"))
+			Expect(warnings[0].Kind).Should(Equal(ParseErrorFieldsNumber))
+		})
+
+		It("Deletes an entry maintaining the other lines", func() {
+			tmpFile, err := ioutil.TempFile(os.TempDir(), "pre-")
+			Expect(err).Should(BeNil())
+			defer os.Remove(tmpFile.Name())
+
+			content := `# Local groups
+root:x:0:root
+
+bin:x:1
++@nisgroup
+daemon:x:2:root,bin,daemon
+`
+			err = ioutil.WriteFile(tmpFile.Name(), []byte(content), 0644)
+			Expect(err).Should(BeNil())
+
+			gid := 0
+			err = Group{Name: "root", Password: "x", Gid: &gid, Users: "root"}.Delete(tmpFile.Name())
+			Expect(err).Should(BeNil())
+
+			dat, err := ioutil.ReadFile(tmpFile.Name())
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).To(Equal(`# Local groups
+
+bin:x:1
++@nisgroup
+daemon:x:2:root,bin,daemon
 `))
 		})
 	})
@@ -6,15 +6,11 @@ package entities
 
 import (
 	"bufio"
-	"bytes"
 	"io"
-	"io/ioutil"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 
-	permbits "github.com/phayes/permbits"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
@@ -26,7 +22,7 @@ func GShadowDefault(s string) string {
 			s = "/etc/gshadow"
 		}
 	}
-	return s
+	return RootPath(s)
 }
 
 // ParseGShadow opens the file and parses it into a map from usernames to Entries
@@ -47,22 +43,37 @@ func ParseGShadow(path string) (map[string]GShadow, error) {
 
 	defer file.Close()
 
-	return ParseGShadowReader(file)
+	return parseGShadowReader(path, file)
 }
 
 // ParseGShadowReader consumes the contents of r and parses it into a map from
-// usernames to Entries
+// names to Entries. Comments, empty lines and NIS entries are skipped.
+// The malformed lines are reported as warnings and skipped or
+// rejected in strict mode.
 func ParseGShadowReader(r io.Reader) (map[string]GShadow, error) {
+	return parseGShadowReader("", r)
+}
+
+func parseGShadowReader(file string, r io.Reader) (map[string]GShadow, error) {
 	lines := bufio.NewReader(r)
 	entries := make(map[string]GShadow)
+	n := 0
 	for {
 		line, _, err := lines.ReadLine()
 		if err != nil {
 			break
 		}
-		name, entry, err := parseGShadowLine(string(copyBytes(line)))
+		n++
+		content := string(copyBytes(line))
+		if lineKey(content) == "" {
+			continue
+		}
+		name, entry, err := parseGShadowLine(content)
 		if err != nil {
-			return nil, err
+			if err = parseLineError(file, n, redactLine(content), err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		entries[name] = entry
 	}
@@ -72,10 +83,15 @@ func ParseGShadowReader(r io.Reader) (map[string]GShadow, error) {
 func parseGShadowLine(line string) (string, GShadow, error) {
 	fs := strings.Split(line, ":")
 	if len(fs) != 4 {
-		return "", GShadow{}, errors.New("Unexpected number of fields in /etc/GShadow: found " + strconv.Itoa(len(fs)))
+		return "", GShadow{}, newFieldsNumberError(4, len(fs))
 	}
 
-	return fs[0], GShadow{fs[0], fs[1], fs[2], fs[3]}, nil
+	if fs[0] == "" {
+		return "", GShadow{}, newParseError(ParseErrorEmptyName, 1, "name",
+			"Empty group name")
+	}
+
+	return fs[0], GShadow{Name: fs[0], Password: fs[1], Administrators: fs[2], Members: fs[3]}, nil
 }
 
 type GShadow struct {
@@ -83,6 +99,10 @@ type GShadow struct {
 	Password       string `yaml:"password" json:"password"`
 	Administrators string `yaml:"administrators" json:"administrators"`
 	Members        string `yaml:"members" json:"members"`
+
+	// Strategy used to merge the administrators and the members:
+	// union, replace or remove.
+	MergeStrategy string `yaml:"merge_strategy,omitempty" json:"merge_strategy,omitempty"`
 }
 
 func (u GShadow) GetKind() string { return GShadowKind }
@@ -98,107 +118,81 @@ func (u GShadow) String() string {
 
 func (u GShadow) Delete(s string) error {
 	s = GShadowDefault(s)
-	input, err := ioutil.ReadFile(s)
-	if err != nil {
-		return errors.Wrap(err, "Could not read input file")
-	}
-	permissions, err := permbits.Stat(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed getting permissions")
-	}
-	lines := bytes.Replace(input, []byte(u.String()+"\n"), []byte(""), 1)
-
-	err = ioutil.WriteFile(s, []byte(lines), os.FileMode(permissions))
-	if err != nil {
-		return errors.Wrap(err, "Could not write")
-	}
-
-	return nil
+	return updateDatabaseFile(GShadowKind, s, func(db *Database) error {
+		return u.dbDelete(db)
+	})
 }
 
 func (u GShadow) Create(s string) error {
-	var f *os.File
+	s = GShadowDefault(s)
+	return updateDatabaseFile(GShadowKind, s, func(db *Database) error {
+		return u.dbCreate(db)
+	})
+}
 
+func (u GShadow) Apply(s string, safe bool) error {
 	s = GShadowDefault(s)
+	return updateDatabaseFile(GShadowKind, s, func(db *Database) error {
+		return u.dbApply(db, safe)
+	})
+}
 
-	_, err := os.Stat(s)
-	if err == nil {
-		current, err := ParseGShadow(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed parsing passwd")
-		}
-		if _, ok := current[u.Name]; ok {
-			return errors.New("Entity already present")
-		}
-		permissions, err := permbits.Stat(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed getting permissions")
-		}
-		f, err = os.OpenFile(s, os.O_APPEND|os.O_WRONLY, os.FileMode(permissions))
-		if err != nil {
-			return errors.Wrap(err, "Could not read")
-		}
-	} else if os.IsNotExist(err) {
-		f, err = os.OpenFile(s, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			return errors.Wrap(err, "Could not create the file")
-		}
-	} else {
-		return errors.Wrap(err, "Error on stat file")
+func (u GShadow) dbDelete(db *Database) error {
+	f, err := db.GetFile(GShadowKind)
+	if err != nil {
+		return err
+	}
+	if !f.Exists() {
+		return errors.New("Could not read input file " + f.GetPath())
 	}
 
-	defer f.Close()
+	// Drop the line which match the group name.
+	return removeEntity(f, u.Name)
+}
 
-	if _, err = f.WriteString(u.String() + "\n"); err != nil {
-		return errors.Wrap(err, "Could not write")
+func (u GShadow) dbCreate(db *Database) error {
+	f, err := db.GetFile(GShadowKind)
+	if err != nil {
+		return err
 	}
+	if f.Has(u.Name) {
+		return errors.New("Entity already present")
+	}
+
+	f.Set(u.Name, u.String())
+
 	return nil
 }
 
-func (u GShadow) Apply(s string, safe bool) error {
-	s = GShadowDefault(s)
+func (u GShadow) dbApply(db *Database, safe bool) error {
+	f, err := db.GetFile(GShadowKind)
+	if err != nil {
+		return err
+	}
 
-	_, err := os.Stat(s)
-	if err == nil {
-		current, err := ParseGShadow(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed parsing passwd")
-		}
-		permissions, err := permbits.Stat(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed getting permissions")
+	if line, ok := f.Get(u.Name); ok {
+		if safe {
+			return nil
 		}
-
-		if _, ok := current[u.Name]; ok {
-			input, err := ioutil.ReadFile(s)
+		if u.MergeStrategy == MergeStrategyRemove {
+			// Remove the administrators and the members of the
+			// current entry.
+			_, cur, err := parseGShadowLine(line)
 			if err != nil {
-				return errors.Wrap(err, "Could not read input file")
+				return errors.Wrap(err, "Failed parsing current gshadow")
 			}
-
-			lines := strings.Split(string(input), "\n")
-
-			for i, line := range lines {
-				if entityIdentifier(line) == u.Name && !safe {
-					lines[i] = u.String()
-				}
-			}
-			output := strings.Join(lines, "\n")
-			err = ioutil.WriteFile(s, []byte(output), os.FileMode(permissions))
+			e, err := cur.Merge(u)
 			if err != nil {
-				return errors.Wrap(err, "Could not write")
+				return err
 			}
-
-		} else {
-			// Add it
-			return u.Create(s)
+			u = e.(GShadow)
 		}
-	} else if os.IsNotExist(err) {
-		return u.Create(s)
-	} else {
-		return errors.Wrap(err, "Could not stat file")
+		f.Set(u.Name, u.String())
+		return nil
 	}
 
-	return nil
+	// Add it
+	return u.dbCreate(db)
 }
 
 func (s GShadow) Merge(e Entity) (Entity, error) {
@@ -208,6 +202,22 @@ func (s GShadow) Merge(e Entity) (Entity, error) {
 
 	toMerge := e.(GShadow)
 
+	switch toMerge.MergeStrategy {
+	case MergeStrategyReplace:
+		s.Administrators = toMerge.Administrators
+		s.Members = toMerge.Members
+		return s, nil
+	case MergeStrategyRemove:
+		s.Administrators = strings.Join(removeMembers(splitMembers(s.Administrators),
+			splitMembers(toMerge.Administrators)...), ",")
+		s.Members = strings.Join(removeMembers(splitMembers(s.Members),
+			splitMembers(toMerge.Members)...), ",")
+		return s, nil
+	case "", MergeStrategyUnion:
+	default:
+		return s, CheckMergeStrategy(toMerge.MergeStrategy)
+	}
+
 	if toMerge.Administrators != "" {
 		if s.Administrators == "" {
 			s.Administrators = toMerge.Administrators
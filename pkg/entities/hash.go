@@ -0,0 +1,222 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tredoe/osutil/user/crypt"
+	"github.com/tredoe/osutil/user/crypt/md5_crypt"
+	"github.com/tredoe/osutil/user/crypt/sha256_crypt"
+	"github.com/tredoe/osutil/user/crypt/sha512_crypt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Methods used to hash the passwords. The names match the values of
+// ENCRYPT_METHOD of login.defs.
+const (
+	HashYescrypt = "yescrypt"
+	HashBcrypt   = "bcrypt"
+	HashSha512   = "sha512"
+	HashSha256   = "sha256"
+
+	// Used when the method is not configured.
+	HashDefault = HashSha512
+)
+
+// Hasher generates the crypt(3) hash of a password with a random salt.
+type Hasher interface {
+	Hash(password string) (string, error)
+}
+
+// ParseHashMethod returns the hash method of the name, case insensitive.
+func ParseHashMethod(s string) (string, error) {
+	switch m := strings.ToLower(s); m {
+	case HashYescrypt, HashBcrypt, HashSha512, HashSha256:
+		return m, nil
+	}
+	return "", errors.New("Invalid hash method " + s + ": expected yescrypt, bcrypt, sha512 or sha256")
+}
+
+// NewHasher returns the hasher of the method. The rounds are the
+// rounds of SHA-crypt, the cost of bcrypt or the cost factor of
+// yescrypt. With 0 rounds the default of the method is used.
+func NewHasher(method string, rounds int) (Hasher, error) {
+	method, err := ParseHashMethod(method)
+	if err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case HashYescrypt:
+		if rounds == 0 {
+			rounds = 5
+		}
+		params, err := yescryptCostParams(rounds)
+		if err != nil {
+			return nil, err
+		}
+		return yescryptHasher{params}, nil
+	case HashBcrypt:
+		if rounds == 0 {
+			rounds = bcrypt.DefaultCost
+		}
+		if rounds < bcrypt.MinCost || rounds > bcrypt.MaxCost {
+			return nil, errors.Errorf("Invalid bcrypt cost %d: expected %d-%d",
+				rounds, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return bcryptHasher{rounds}, nil
+	case HashSha256:
+		return newShaCryptHasher("$5$", rounds, sha256_crypt.RoundsMin,
+			sha256_crypt.RoundsMax, sha256_crypt.New())
+	default:
+		return newShaCryptHasher("$6$", rounds, sha512_crypt.RoundsMin,
+			sha512_crypt.RoundsMax, sha512_crypt.New())
+	}
+}
+
+// cryptSalt returns n random characters of the crypt(3) alphabet.
+func cryptSalt(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "Error on generate salt")
+	}
+	for i := range b {
+		b[i] = cryptItoa64[b[i]&0x3f]
+	}
+	return string(b), nil
+}
+
+type yescryptHasher struct {
+	params yescryptParams
+}
+
+func (h yescryptHasher) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "Error on generate salt")
+	}
+	return yescryptHash(password, h.params.encode()+"$"+yescryptEncode64(salt))
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	// $2a$ and $2b$ differ only for passwords longer than 255 bytes that
+	// bcrypt rejects. $2b$ is the prefix used by libxcrypt.
+	return "$2b$" + strings.TrimPrefix(string(hash), "$2a$"), nil
+}
+
+type shaCryptHasher struct {
+	prefix  string
+	rounds  int
+	crypter crypt.Crypter
+}
+
+func newShaCryptHasher(prefix string, rounds, min, max int, c crypt.Crypter) (Hasher, error) {
+	if rounds != 0 && (rounds < min || rounds > max) {
+		return nil, errors.Errorf("Invalid rounds %d: expected %d-%d", rounds, min, max)
+	}
+	return shaCryptHasher{prefix: prefix, rounds: rounds, crypter: c}, nil
+}
+
+func (h shaCryptHasher) Hash(password string) (string, error) {
+	salt, err := cryptSalt(16)
+	if err != nil {
+		return "", err
+	}
+	setting := h.prefix
+	if h.rounds != 0 {
+		setting += fmt.Sprintf("rounds=%d$", h.rounds)
+	}
+	return h.crypter.Generate([]byte(password), []byte(setting+salt))
+}
+
+// HashMethod returns the hash method: the method of the argument or
+// of the ENTITY_HASH env variable or the ENCRYPT_METHOD of login.defs.
+// The DES and MD5 methods of login.defs are too weak and they are
+// replaced with the default method.
+func HashMethod(method string, l *LoginDefs) (string, error) {
+	if method == "" {
+		method = os.Getenv(ENTITY_ENV_HASH)
+	}
+	if method == "" && l != nil {
+		method, _ = l.Get("ENCRYPT_METHOD")
+		switch strings.ToUpper(method) {
+		case "DES", "MD5":
+			method = ""
+		}
+	}
+	if method == "" {
+		return HashDefault, nil
+	}
+	return ParseHashMethod(method)
+}
+
+// HashRounds returns the rounds of the method: the rounds of the
+// argument or of the ENTITY_HASH_ROUNDS env variable or the rounds
+// of login.defs. It returns 0 for the default of the method.
+func HashRounds(method string, rounds int, l *LoginDefs) (int, error) {
+	if rounds != 0 {
+		return rounds, nil
+	}
+	if env := os.Getenv(ENTITY_ENV_HASH_ROUNDS); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return 0, errors.New("Invalid hash rounds " + env)
+		}
+		return n, nil
+	}
+	if l == nil {
+		return 0, nil
+	}
+
+	// Like shadow-utils without the random choice between the min
+	// and the max values.
+	minMax := func(prefix string) int {
+		return l.GetInt(prefix+"_MIN_ROUNDS", l.GetInt(prefix+"_MAX_ROUNDS", 0))
+	}
+	switch method {
+	case HashYescrypt:
+		return l.GetInt("YESCRYPT_COST_FACTOR", 0), nil
+	case HashBcrypt:
+		return minMax("BCRYPT"), nil
+	default:
+		return minMax("SHA_CRYPT"), nil
+	}
+}
+
+// Crypt returns the hash of the password with the salt and the
+// parameters of the setting, like crypt(3). The setting could be a
+// full hash. It supports the yescrypt ($y$), SHA-256 ($5$), SHA-512
+// ($6$), MD5 ($1$) and DES hashes.
+func Crypt(password, setting string) (string, error) {
+	switch {
+	case strings.HasPrefix(setting, "$y$"):
+		return yescryptHash(password, setting)
+	case strings.HasPrefix(setting, "$5$"):
+		return sha256_crypt.New().Generate([]byte(password), []byte(setting))
+	case strings.HasPrefix(setting, "$6$"):
+		return sha512_crypt.New().Generate([]byte(password), []byte(setting))
+	case strings.HasPrefix(setting, "$1$"):
+		return md5_crypt.New().Generate([]byte(password), []byte(setting))
+	case len(setting) >= 2 && cryptAtoi64(setting[0]) < 64 && cryptAtoi64(setting[1]) < 64:
+		return desCrypt(password, setting), nil
+	}
+	return "", errors.New("Unsupported hash setting")
+}
@@ -0,0 +1,143 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+	"golang.org/x/crypto/bcrypt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Password hash", func() {
+	Context("Hashing the passwords", func() {
+		It("Computes the yescrypt hashes of libxcrypt", func() {
+			for _, v := range [][3]string{
+				{"password", "$y$j9T$abcdefghijklmnop", "$y$j9T$abcdefghijklmnop$7asOTx5b6Exfl3myM6K0pLBn.I2hsEvu7G0F7NMfaO."},
+				{"pw", "$y$j75$x.1", "$y$j75$x.1$Qz2GZwyj1wXvqka5hkebOFJxFwafNW5yuzkyUtvnme8"},
+				{"pw", "$y$jC5..$saltsalt", "$y$jC5..$saltsalt$ffBjwKRuabWd9CPRp.FbS6v3a8NN/F8JXRI7lE.pAs8"},
+				{"pw", "$y$jC5/0$saltsalt", "$y$jC5/0$saltsalt$ysgbIZV4Iz0A/BEjKRE6F4XRHCecVPgXxG9e8MOjU01"},
+			} {
+				h, err := Crypt(v[0], v[1])
+				Expect(err).Should(BeNil())
+				Expect(h).Should(Equal(v[2]))
+			}
+		})
+
+		It("Computes the SHA-crypt hashes with rounds", func() {
+			h, err := Crypt("password", "$6$rounds=5000$saltsalt")
+			Expect(err).Should(BeNil())
+			Expect(h).Should(Equal("$6$rounds=5000$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/"))
+		})
+
+		It("Generates the hashes with random salts", func() {
+			for _, m := range []string{HashYescrypt, HashSha512, HashSha256} {
+				h, err := NewHasher(m, 0)
+				Expect(err).Should(BeNil())
+				h1, err := h.Hash("secret")
+				Expect(err).Should(BeNil())
+				h2, err := h.Hash("secret")
+				Expect(err).Should(BeNil())
+				Expect(h1).ShouldNot(Equal(h2))
+
+				check, err := Crypt("secret", h1)
+				Expect(err).Should(BeNil())
+				Expect(check).Should(Equal(h1))
+			}
+
+			h, err := NewHasher("SHA256", 10000)
+			Expect(err).Should(BeNil())
+			pwd, err := h.Hash("secret")
+			Expect(err).Should(BeNil())
+			Expect(pwd).Should(HavePrefix("$5$rounds=10000$"))
+
+			h, err = NewHasher(HashYescrypt, 3)
+			Expect(err).Should(BeNil())
+			pwd, err = h.Hash("secret")
+			Expect(err).Should(BeNil())
+			Expect(pwd).Should(HavePrefix("$y$j7T$"))
+
+			h, err = NewHasher(HashBcrypt, bcrypt.MinCost)
+			Expect(err).Should(BeNil())
+			pwd, err = h.Hash("secret")
+			Expect(err).Should(BeNil())
+			Expect(pwd).Should(HavePrefix("$2b$04$"))
+			Expect(bcrypt.CompareHashAndPassword([]byte(pwd), []byte("secret"))).Should(BeNil())
+		})
+
+		It("Rejects invalid methods and rounds", func() {
+			_, err := NewHasher("md5", 0)
+			Expect(err).ShouldNot(BeNil())
+			_, err = NewHasher(HashYescrypt, 12)
+			Expect(err).ShouldNot(BeNil())
+			_, err = NewHasher(HashBcrypt, 40)
+			Expect(err).ShouldNot(BeNil())
+			_, err = NewHasher(HashSha512, 10)
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("Selecting the method", func() {
+		var tmpdir, shadow, loginDefs string
+
+		BeforeEach(func() {
+			var err error
+			tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			shadow = filepath.Join(tmpdir, "shadow")
+			loginDefs = filepath.Join(tmpdir, "login.defs")
+			Expect(ioutil.WriteFile(shadow, []byte(""), 0640)).Should(BeNil())
+			Expect(ioutil.WriteFile(loginDefs,
+				[]byte("ENCRYPT_METHOD YESCRYPT\nYESCRYPT_COST_FACTOR 4\n"), 0644)).Should(BeNil())
+			os.Setenv(ENTITY_ENV_DEF_LOGIN_DEFS, loginDefs)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv(ENTITY_ENV_DEF_LOGIN_DEFS)
+			os.Unsetenv(ENTITY_ENV_HASH)
+			os.RemoveAll(tmpdir)
+		})
+
+		password := func(user string) string {
+			entries, err := ParseShadow(shadow)
+			Expect(err).Should(BeNil())
+			return entries[user].Password
+		}
+
+		It("Uses the spec, the env and login.defs", func() {
+			Expect(Shadow{Username: "foo", Password: "secret"}.Apply(shadow, false)).Should(BeNil())
+			Expect(password("foo")).Should(HavePrefix("$y$j8T$"))
+
+			os.Setenv(ENTITY_ENV_HASH, HashSha256)
+			Expect(Shadow{Username: "bar", Password: "secret"}.Apply(shadow, false)).Should(BeNil())
+			Expect(password("bar")).Should(HavePrefix("$5$"))
+
+			Expect(Shadow{Username: "baz", Password: "secret", Hash: HashSha512,
+				HashRounds: 6000}.Apply(shadow, false)).Should(BeNil())
+			Expect(password("baz")).Should(HavePrefix("$6$rounds=6000$"))
+
+			err := Shadow{Username: "bad", Password: "secret", Hash: "des"}.Apply(shadow, false)
+			Expect(err).ShouldNot(BeNil())
+		})
+
+		It("Replaces the weak methods of login.defs", func() {
+			Expect(ioutil.WriteFile(loginDefs, []byte("ENCRYPT_METHOD MD5\n"), 0644)).Should(BeNil())
+			method, err := HashMethod("", nil)
+			Expect(err).Should(BeNil())
+			Expect(method).Should(Equal(HashDefault))
+
+			l, err := ParseLoginDefs(loginDefs)
+			Expect(err).Should(BeNil())
+			method, err = HashMethod("", l)
+			Expect(err).Should(BeNil())
+			Expect(method).Should(Equal(HashSha512))
+		})
+	})
+})
@@ -0,0 +1,416 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultSkel = "/etc/skel"
+
+// HomePrefix returns the directory where the home directories and the
+// skeleton directories are resolved. If not defined it's used the root
+// directory. It's empty for the real system.
+func HomePrefix() string {
+	prefix := os.Getenv(ENTITY_ENV_HOME_PREFIX)
+	if prefix == "" {
+		return RootDir()
+	}
+	return prefix
+}
+
+// homePath returns the path of the directory under the prefix.
+func homePath(dir string) string {
+	return rootJoin(HomePrefix(), dir)
+}
+
+// ParseHomeMode parses the permissions of the home directory in
+// octal format (e.g. 0750).
+func ParseHomeMode(s string) (os.FileMode, error) {
+	var mode uint32
+	_, err := fmt.Sscanf(s, "%o", &mode)
+	if err != nil || mode > 07777 {
+		return 0, errors.New("Invalid home mode " + s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// homeMode returns the permissions of the home directory of the user:
+// the mode of the entity or the HOME_MODE of login.defs or the mode
+// obtained by the UMASK of login.defs.
+func (u UserPasswd) homeMode(db *Database) (os.FileMode, error) {
+	if u.HomeMode != "" {
+		return ParseHomeMode(u.HomeMode)
+	}
+
+	l, err := db.GetLoginDefs()
+	if err != nil {
+		return 0, err
+	}
+
+	umask := l.GetInt("UMASK", 022)
+	mode := l.GetInt("HOME_MODE", 0777&^umask)
+
+	return os.FileMode(mode) & os.ModePerm, nil
+}
+
+// prepareHome adds the creation of the home directory to the actions
+// executed after the write of the files.
+func (u UserPasswd) prepareHome(db *Database) error {
+	if !u.CreateHome {
+		return nil
+	}
+	if u.Homedir == "" {
+		return errors.New("Home directory not defined for user " + u.Username)
+	}
+
+	mode, err := u.homeMode(db)
+	if err != nil {
+		return err
+	}
+
+	skel := u.Skel
+	if skel == "" {
+		skel = defaultSkel
+	}
+
+	home := homePath(u.Homedir)
+	skel = homePath(skel)
+	uid, gid := u.Uid, u.Gid
+
+	db.addAction(func() error {
+		return createHome(home, skel, uid, gid, mode)
+	})
+
+	return nil
+}
+
+// protectedHomes are the system directories that are never archived
+// or removed as home directories.
+var protectedHomes = []string{
+	"/", "/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib32", "/lib64",
+	"/libx32", "/media", "/mnt", "/nonexistent", "/opt", "/proc", "/root", "/run",
+	"/sbin", "/srv", "/sys", "/tmp", "/usr", "/usr/bin", "/usr/lib", "/usr/lib64",
+	"/usr/local", "/usr/sbin", "/usr/share", "/var", "/var/cache", "/var/empty",
+	"/var/lib", "/var/log", "/var/spool", "/var/tmp",
+}
+
+// isSubdir returns true if the path is inside the directory.
+func isSubdir(path, dir string) bool {
+	return dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// checkHomeDir returns an error if the home directory is not a real
+// directory owned by the uid. It returns false if the directory is
+// not present.
+func checkHomeDir(home string, uid int) (bool, error) {
+	st, err := os.Lstat(home)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Error on check home directory "+home)
+	}
+	if st.Mode()&os.ModeSymlink != 0 {
+		return false, errors.New("The home directory " + home + " is a symlink")
+	}
+	if !st.IsDir() {
+		return false, errors.New("The home directory " + home + " is not a directory")
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok && sys.Uid != uint32(uid) {
+		return false, errors.New(fmt.Sprintf(
+			"The home directory %s is owned by the uid %d instead of %d", home, sys.Uid, uid))
+	}
+	return true, nil
+}
+
+// checkHomeRemove returns the path of the home directory to remove
+// and an error if it can't be removed safely, like userdel does: the
+// system directories, the root directory, the directories not owned by
+// the user and the directories that contain the home of other users
+// are refused. The path is empty if the directory is not present.
+func checkHomeRemove(db *Database, name, homedir string, uid int) (string, error) {
+	if !filepath.IsAbs(homedir) {
+		return "", errors.New("The home directory " + homedir + " of user " +
+			name + " is not an absolute path")
+	}
+	homedir = filepath.Clean(homedir)
+	if stringInSlice(homedir, protectedHomes) {
+		return "", errors.New("The home directory " + homedir + " of user " +
+			name + " is a system directory")
+	}
+
+	// The last component is not resolved to refuse the symlinks.
+	home := filepath.Join(homePath(filepath.Dir(homedir)), filepath.Base(homedir))
+
+	// Check the path with the symlinks of the parents resolved.
+	prefix := HomePrefix()
+	if prefix == "" {
+		prefix = "/"
+	}
+	if p, err := filepath.EvalSymlinks(prefix); err == nil {
+		prefix = p
+	}
+	real := home
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(home)); err == nil {
+		real = filepath.Join(dir, filepath.Base(home))
+	}
+	rel, err := filepath.Rel(prefix, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.New("The home directory " + home + " of user " +
+			name + " is outside of " + prefix)
+	}
+	rel = filepath.Join("/", rel)
+	if stringInSlice(rel, protectedHomes) {
+		return "", errors.New("The home directory " + home + " of user " +
+			name + " is a system directory")
+	}
+
+	users, err := db.GetFile(UserKind)
+	if err != nil {
+		return "", err
+	}
+	for _, n := range users.Names() {
+		line, _ := users.Get(n)
+		o, err := parseUserLine(line)
+		if err != nil || o.Username == name || o.Homedir == "" {
+			continue
+		}
+		other := filepath.Clean(o.Homedir)
+		if other == homedir || isSubdir(other, homedir) {
+			return "", errors.New("The home directory " + homedir + " of user " +
+				name + " contains the home directory of user " + o.Username)
+		}
+	}
+
+	exists, err := checkHomeDir(home, uid)
+	if err != nil || !exists {
+		return "", err
+	}
+
+	return home, nil
+}
+
+// prepareHomeRemove adds the archive and the remove of the home
+// directory to the actions executed after the write of the files. It
+// returns an error if the home directory can't be removed safely.
+func (u UserPasswd) prepareHomeRemove(db *Database, homedir string, uid int) error {
+	if (!u.RemoveHome && u.ArchiveHome == "") || homedir == "" {
+		return nil
+	}
+
+	home, err := checkHomeRemove(db, u.Username, homedir, uid)
+	if err != nil || home == "" {
+		return err
+	}
+
+	name := u.Username
+	archive := ""
+	if u.ArchiveHome != "" {
+		archive = homePath(u.ArchiveHome)
+	}
+	remove := u.RemoveHome
+
+	db.addAction(func() error {
+		// The directory could be changed after the checks.
+		exists, err := checkHomeDir(home, uid)
+		if err != nil || !exists {
+			return err
+		}
+		if archive != "" {
+			if err := archiveHome(home, archive, name); err != nil {
+				return err
+			}
+		}
+		if remove {
+			if err := os.RemoveAll(home); err != nil {
+				return errors.Wrap(err, "Error on remove home directory "+home)
+			}
+		}
+		return nil
+	})
+
+	return nil
+}
+
+// createHome creates the home directory with the content of the
+// skeleton directory. An existing directory is not modified.
+func createHome(home, skel string, uid, gid int, mode os.FileMode) error {
+	if _, err := os.Lstat(home); err == nil {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(home), 0755)
+	if err != nil {
+		return errors.Wrap(err, "Error on create parent of home directory "+home)
+	}
+	err = os.Mkdir(home, mode)
+	if err != nil {
+		return errors.Wrap(err, "Error on create home directory "+home)
+	}
+
+	if _, err := os.Stat(skel); err == nil {
+		err = copySkel(skel, home, uid, gid)
+		if err != nil {
+			return errors.Wrap(err, "Error on copy skeleton directory "+skel)
+		}
+	}
+
+	err = os.Chown(home, uid, gid)
+	if err != nil {
+		return errors.Wrap(err, "Error on change owner of home directory "+home)
+	}
+	// The umask is applied on creation.
+	return os.Chmod(home, mode)
+}
+
+// copySkel copies the files of the skeleton directory with the owner
+// of the home directory.
+func copySkel(skel, home string, uid, gid int) error {
+	return filepath.Walk(skel, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(skel, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(home, rel)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(link, target)
+			if err != nil {
+				return err
+			}
+		case info.IsDir():
+			err = os.Mkdir(target, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			err = copyFile(path, target, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+		default:
+			// Ignore devices, sockets and pipes.
+			return nil
+		}
+
+		return os.Lchown(target, uid, gid)
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// archiveHome writes the content of the home directory in the file
+// <dir>/<user>-<timestamp>.tar.gz.
+func archiveHome(home, dir, name string) error {
+	if _, err := os.Stat(home); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "Error on create archive directory "+dir)
+	}
+
+	file := filepath.Join(dir, fmt.Sprintf("%s-%s.tar.gz",
+		name, time.Now().UTC().Format("20060102150405")))
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Error on create archive "+file)
+	}
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+
+	base := filepath.Base(home)
+	err = filepath.Walk(home, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(home, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(base, rel))
+		if info.IsDir() && !strings.HasSuffix(header.Name, "/") {
+			header.Name += "/"
+		}
+
+		err = tw.WriteHeader(header)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "Error on archive home directory "+home)
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
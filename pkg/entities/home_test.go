@@ -0,0 +1,199 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Home directory", func() {
+	Context("Managing the home directory", func() {
+		var tmpdir string
+		var passwd string
+
+		BeforeEach(func() {
+			var err error
+			tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+
+			os.Setenv(ENTITY_ENV_DEF_LOGIN_DEFS, filepath.Join(tmpdir, "login.defs"))
+			os.Setenv(ENTITY_ENV_HOME_PREFIX, tmpdir)
+
+			passwd = filepath.Join(tmpdir, "passwd")
+			err = ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/bash\n"), 0644)
+			Expect(err).Should(BeNil())
+
+			skel := filepath.Join(tmpdir, "etc", "skel")
+			Expect(os.MkdirAll(filepath.Join(skel, ".config"), 0755)).Should(BeNil())
+			err = ioutil.WriteFile(filepath.Join(skel, ".bashrc"), []byte("# bashrc\n"), 0644)
+			Expect(err).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			os.Unsetenv(ENTITY_ENV_DEF_LOGIN_DEFS)
+			os.Unsetenv(ENTITY_ENV_HOME_PREFIX)
+			os.RemoveAll(tmpdir)
+		})
+
+		It("Creates, archives and removes the home", func() {
+			user := UserPasswd{
+				Username:    "foo",
+				Password:    "x",
+				Uid:         os.Getuid(),
+				Gid:         os.Getgid(),
+				Info:        "Foo",
+				Homedir:     "/home/foo",
+				Shell:       "/bin/bash",
+				CreateHome:  true,
+				HomeMode:    "0750",
+				RemoveHome:  true,
+				ArchiveHome: "/var/backups",
+			}
+
+			err := user.Create(passwd)
+			Expect(err).Should(BeNil())
+
+			home := filepath.Join(tmpdir, "home", "foo")
+			info, err := os.Stat(home)
+			Expect(err).Should(BeNil())
+			Expect(info.IsDir()).Should(BeTrue())
+			Expect(info.Mode().Perm()).Should(Equal(os.FileMode(0750)))
+
+			dat, err := ioutil.ReadFile(filepath.Join(home, ".bashrc"))
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(Equal("# bashrc\n"))
+			_, err = os.Stat(filepath.Join(home, ".config"))
+			Expect(err).Should(BeNil())
+
+			err = user.Delete(passwd)
+			Expect(err).Should(BeNil())
+
+			_, err = os.Stat(home)
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+
+			archives, err := filepath.Glob(filepath.Join(tmpdir, "var", "backups", "foo-*.tar.gz"))
+			Expect(err).Should(BeNil())
+			Expect(len(archives)).Should(Equal(1))
+		})
+
+		It("Doesn't create the home on dry-run", func() {
+			db := NewDatabase(passwd, filepath.Join(tmpdir, "group"), "", "")
+			err := db.Create(UserPasswd{
+				Username:   "foo",
+				Password:   "x",
+				Uid:        os.Getuid(),
+				Gid:        os.Getgid(),
+				Homedir:    "/home/foo",
+				CreateHome: true,
+			})
+			Expect(err).Should(BeNil())
+
+			_, err = os.Stat(filepath.Join(tmpdir, "home", "foo"))
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+		})
+
+		Context("Refusing the unsafe removes", func() {
+			remove := func(homedir string) error {
+				err := ioutil.WriteFile(passwd, []byte(fmt.Sprintf(
+					"root:x:0:0:root:/root:/bin/bash\nfoo:x:%d:%d::%s:/bin/bash\n",
+					os.Getuid(), os.Getgid(), homedir)), 0644)
+				Expect(err).Should(BeNil())
+				return UserPasswd{Username: "foo", RemoveHome: true}.Delete(passwd)
+			}
+
+			mkdir := func(dir string) string {
+				path := filepath.Join(tmpdir, dir)
+				Expect(os.MkdirAll(path, 0755)).Should(BeNil())
+				return path
+			}
+
+			It("Refuses the root and the system directories", func() {
+				for _, dir := range []string{"/", "/usr", "/var", "/var/lib", "/home", "relative"} {
+					mkdir(dir)
+					Expect(remove(dir)).ShouldNot(BeNil())
+				}
+				_, err := os.Stat(filepath.Join(tmpdir, "usr"))
+				Expect(err).Should(BeNil())
+				_, err = os.Stat(passwd)
+				Expect(err).Should(BeNil())
+			})
+
+			It("Refuses the symlinks and the files", func() {
+				mkdir("/srv/data")
+				Expect(os.MkdirAll(filepath.Join(tmpdir, "home"), 0755)).Should(BeNil())
+				Expect(os.Symlink("../srv/data",
+					filepath.Join(tmpdir, "home", "link"))).Should(BeNil())
+				Expect(remove("/home/link")).ShouldNot(BeNil())
+
+				err := ioutil.WriteFile(filepath.Join(tmpdir, "home", "file"), []byte(""), 0644)
+				Expect(err).Should(BeNil())
+				Expect(remove("/home/file")).ShouldNot(BeNil())
+
+				// A parent symlink to a system directory.
+				Expect(os.Symlink("../var",
+					filepath.Join(tmpdir, "home", "var"))).Should(BeNil())
+				mkdir("/var/lib")
+				Expect(remove("/home/var/lib")).ShouldNot(BeNil())
+
+				_, err = os.Stat(filepath.Join(tmpdir, "srv", "data"))
+				Expect(err).Should(BeNil())
+				_, err = os.Stat(filepath.Join(tmpdir, "var", "lib"))
+				Expect(err).Should(BeNil())
+			})
+
+			It("Refuses the directories of other owners", func() {
+				if os.Getuid() != 0 {
+					Skip("The change of the owner requires root permissions")
+				}
+				home := mkdir("/home/foo")
+				Expect(os.Chown(home, 12345, 12345)).Should(BeNil())
+				Expect(remove("/home/foo")).ShouldNot(BeNil())
+				_, err := os.Stat(home)
+				Expect(err).Should(BeNil())
+			})
+
+			It("Refuses the homes shared with other users", func() {
+				mkdir("/home/foo/bar")
+				for _, other := range []string{"/home/foo", "/home/foo/bar"} {
+					err := ioutil.WriteFile(passwd, []byte(fmt.Sprintf(
+						"bar:x:1500:1500::%s:/bin/bash\nfoo:x:%d:%d::/home/foo:/bin/bash\n",
+						other, os.Getuid(), os.Getgid())), 0644)
+					Expect(err).Should(BeNil())
+					err = UserPasswd{Username: "foo", RemoveHome: true}.Delete(passwd)
+					Expect(err).ShouldNot(BeNil())
+				}
+				_, err := os.Stat(filepath.Join(tmpdir, "home", "foo", "bar"))
+				Expect(err).Should(BeNil())
+
+				// The parent home of another user is not a problem.
+				mkdir("/srv/app/foo")
+				err = ioutil.WriteFile(passwd, []byte(fmt.Sprintf(
+					"bar:x:1500:1500::/srv/app:/bin/bash\nfoo:x:%d:%d::/srv/app/foo:/bin/bash\n",
+					os.Getuid(), os.Getgid())), 0644)
+				Expect(err).Should(BeNil())
+				Expect(UserPasswd{Username: "foo", RemoveHome: true}.Delete(passwd)).Should(BeNil())
+				_, err = os.Stat(filepath.Join(tmpdir, "srv", "app", "foo"))
+				Expect(os.IsNotExist(err)).Should(BeTrue())
+			})
+		})
+
+		It("Parses the home mode", func() {
+			mode, err := ParseHomeMode("0700")
+			Expect(err).Should(BeNil())
+			Expect(mode).Should(Equal(os.FileMode(0700)))
+
+			_, err = ParseHomeMode("rwx")
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+})
@@ -0,0 +1,256 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// IdLockDefaultFile is the default name of the lock file.
+const IdLockDefaultFile = "entities.lock"
+
+// IdLock contains the ids assigned to the users and groups with a
+// dynamic id. The ids are reused on the next merges to obtain the
+// same files from the same specs. The file is in YAML format or in
+// JSON format if the file has the .json extension.
+type IdLock struct {
+	Users  map[string]int `yaml:"users,omitempty" json:"users,omitempty"`
+	Groups map[string]int `yaml:"groups,omitempty" json:"groups,omitempty"`
+}
+
+func NewIdLock() *IdLock {
+	return &IdLock{
+		Users:  make(map[string]int, 0),
+		Groups: make(map[string]int, 0),
+	}
+}
+
+// LoadIdLock reads the lock file. A missing file is handled as an
+// empty lock.
+func LoadIdLock(path string) (*IdLock, error) {
+	ans := NewIdLock()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ans, nil
+		}
+		return nil, errors.Wrap(err, "Error on read lock file "+path)
+	}
+
+	if isJsonFile(path) {
+		err = json.Unmarshal(data, ans)
+	} else {
+		err = yaml.Unmarshal(data, ans)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error on parse lock file "+path)
+	}
+	if ans.Users == nil {
+		ans.Users = make(map[string]int, 0)
+	}
+	if ans.Groups == nil {
+		ans.Groups = make(map[string]int, 0)
+	}
+
+	return ans, nil
+}
+
+// Write writes the lock file.
+func (l *IdLock) Write(path string) error {
+	var data []byte
+	var err error
+	if isJsonFile(path) {
+		data, err = json.MarshalIndent(l, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(l)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Error on marshal lock file")
+	}
+
+	return writeFileAtomic(path, data, 0644, false)
+}
+
+func isJsonFile(path string) bool {
+	return filepath.Ext(path) == ".json"
+}
+
+// GetUid returns the uid assigned to the user.
+func (l *IdLock) GetUid(name string) (int, bool) {
+	uid, ok := l.Users[name]
+	return uid, ok
+}
+
+// GetGid returns the gid assigned to the group.
+func (l *IdLock) GetGid(name string) (int, bool) {
+	gid, ok := l.Groups[name]
+	return gid, ok
+}
+
+// IdLockConflictError is returned when the id of the lock assigned to
+// an entity is already used by another entity.
+type IdLockConflictError struct {
+	Kind   string
+	Name   string
+	Id     int
+	UsedBy string
+}
+
+func (e *IdLockConflictError) Error() string {
+	return fmt.Sprintf("The %s %d of the lock file for the %s %s is already used by %s",
+		idName(e.Kind), e.Id, e.Kind, e.Name, e.UsedBy)
+}
+
+func idName(kind string) string {
+	if kind == GroupKind {
+		return "gid"
+	}
+	return "uid"
+}
+
+// checkLockedGid returns an IdLockConflictError if the gid is used by
+// a group different from the group of the name.
+func checkLockedGid(db *Database, name string, gid int) error {
+	f, err := db.GetFile(GroupKind)
+	if err != nil {
+		return err
+	}
+	for _, n := range f.Names() {
+		line, _ := f.Get(n)
+		if _, o, err := parseGroupLine(line); err == nil &&
+			*o.Gid == gid && o.Name != name {
+			return &IdLockConflictError{
+				Kind:   GroupKind,
+				Name:   name,
+				Id:     gid,
+				UsedBy: o.Name,
+			}
+		}
+	}
+	return nil
+}
+
+// pin sets the id of a dynamic entity with the id of the lock. If the
+// id is used by another entity it returns an IdLockConflictError. For
+// the users with create_group the gid of the primary group is pinned
+// too.
+func (l *IdLock) pin(db *Database, e Entity) (Entity, error) {
+	switch e.GetKind() {
+	case UserKind:
+		u := e.(UserPasswd)
+		if u.Uid >= 0 {
+			return e, nil
+		}
+
+		if uid, ok := l.Users[u.Username]; ok {
+			f, err := db.GetFile(UserKind)
+			if err != nil {
+				return e, err
+			}
+			for _, name := range f.Names() {
+				line, _ := f.Get(name)
+				if o, err := parseUserLine(line); err == nil &&
+					o.Uid == uid && o.Username != u.Username {
+					return e, &IdLockConflictError{
+						Kind:   UserKind,
+						Name:   u.Username,
+						Id:     uid,
+						UsedBy: o.Username,
+					}
+				}
+			}
+			u.Uid = uid
+		}
+
+		if u.CreateGroup {
+			name := u.primaryGroupName()
+			if gid, ok := l.Groups[name]; ok {
+				err := checkLockedGid(db, name, gid)
+				if err != nil {
+					return e, err
+				}
+				u.primaryGid = &gid
+			}
+		}
+		return u, nil
+
+	case GroupKind:
+		g := e.(Group)
+		gid, ok := l.Groups[g.Name]
+		if g.Gid == nil || *g.Gid >= 0 || !ok {
+			return e, nil
+		}
+
+		err := checkLockedGid(db, g.Name, gid)
+		if err != nil {
+			return e, err
+		}
+		g.Gid = &gid
+		return g, nil
+	}
+
+	return e, nil
+}
+
+// record stores the ids assigned to the entity if the spec has a
+// dynamic id. The ids are read from the database.
+func (l *IdLock) record(db *Database, e Entity) error {
+	switch e.GetKind() {
+	case UserKind:
+		u := e.(UserPasswd)
+		if u.Uid >= 0 {
+			return nil
+		}
+
+		f, err := db.GetFile(UserKind)
+		if err != nil {
+			return err
+		}
+		line, ok := f.Get(u.Username)
+		if !ok {
+			return nil
+		}
+		cur, err := parseUserLine(line)
+		if err != nil {
+			return err
+		}
+		l.Users[u.Username] = cur.Uid
+
+		if u.CreateGroup {
+			l.Groups[u.primaryGroupName()] = cur.Gid
+		}
+
+	case GroupKind:
+		g := e.(Group)
+		if g.Gid == nil || *g.Gid >= 0 {
+			return nil
+		}
+
+		f, err := db.GetFile(GroupKind)
+		if err != nil {
+			return err
+		}
+		line, ok := f.Get(g.Name)
+		if !ok {
+			return nil
+		}
+		_, cur, err := parseGroupLine(line)
+		if err != nil {
+			return err
+		}
+		l.Groups[g.Name] = *cur.Gid
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IdLock", func() {
+	Context("Sorting entities", func() {
+
+		It("Sorts by priority and name", func() {
+			gid := -1
+			store := NewEntitiesStore()
+			Expect(store.AddUser(UserPasswd{Username: "zed", Uid: -1, Priority: -1})).Should(BeNil())
+			Expect(store.AddUser(UserPasswd{Username: "bar", Uid: -1})).Should(BeNil())
+			Expect(store.AddGroup(Group{Name: "foo", Gid: &gid, Priority: 10})).Should(BeNil())
+			Expect(store.AddShadow(Shadow{Username: "foo", Password: "!"})).Should(BeNil())
+			Expect(store.AddShadow(Shadow{Username: "aaa", Password: "!"})).Should(BeNil())
+
+			Expect(store.Names()).Should(Equal([]string{"zed", "aaa", "bar", "foo"}))
+		})
+	})
+
+	Context("Pinning dynamic ids", func() {
+		var tmpdir string
+
+		BeforeEach(func() {
+			var err error
+			tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			loginDefs := filepath.Join(tmpdir, "login.defs")
+			err = ioutil.WriteFile(loginDefs, []byte("UID_MIN 1000\nGID_MIN 1000\n"), 0644)
+			Expect(err).Should(BeNil())
+			os.Setenv(ENTITY_ENV_DEF_LOGIN_DEFS, loginDefs)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv(ENTITY_ENV_DEF_LOGIN_DEFS)
+			os.RemoveAll(tmpdir)
+		})
+
+		It("Records and reuses the ids", func() {
+			usersFile, groupsFile, shadowFile, gshadowFile := prepareTxFiles(tmpdir)
+			lockFile := filepath.Join(tmpdir, "entities.lock")
+
+			apply := func(uid int) {
+				lock, err := LoadIdLock(lockFile)
+				Expect(err).Should(BeNil())
+
+				tx, err := NewTransaction(usersFile, groupsFile, shadowFile, gshadowFile)
+				Expect(err).Should(BeNil())
+				tx.SetIdLock(lock)
+
+				gid := -1
+				err = tx.Apply(Group{Name: "foo", Password: "x", Gid: &gid}, false)
+				Expect(err).Should(BeNil())
+				err = tx.Apply(UserPasswd{
+					Username: "foo", Password: "x", Uid: -1, Group: "foo",
+					Homedir: "/home/foo", Shell: "/bin/bash",
+				}, false)
+				Expect(err).Should(BeNil())
+				Expect(tx.Commit()).Should(BeNil())
+
+				Expect(lock.Users["foo"]).Should(Equal(uid))
+				Expect(lock.Write(lockFile)).Should(BeNil())
+			}
+
+			apply(1000)
+
+			lock, err := LoadIdLock(lockFile)
+			Expect(err).Should(BeNil())
+			gid, ok := lock.GetGid("foo")
+			Expect(ok).Should(BeTrue())
+			Expect(gid).Should(Equal(1000))
+
+			// The ids of the lock are reused on a different system.
+			prepareTxFiles(tmpdir)
+			lock.Users["foo"] = 1200
+			Expect(lock.Write(lockFile)).Should(BeNil())
+
+			apply(1200)
+
+			dat, err := ioutil.ReadFile(usersFile)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(ContainSubstring("foo:x:1200:1000:"))
+
+			// A conflict is reported if the id is already used.
+			prepareTxFiles(tmpdir)
+			err = ioutil.WriteFile(usersFile, []byte(
+				"root:x:0:0:root:/root:/bin/bash\nbar:x:1200:100::/home/bar:/bin/bash\n"), 0644)
+			Expect(err).Should(BeNil())
+
+			tx, err := NewTransaction(usersFile, groupsFile, shadowFile, gshadowFile)
+			Expect(err).Should(BeNil())
+			defer tx.Rollback()
+			tx.SetIdLock(lock)
+
+			err = tx.Apply(UserPasswd{Username: "foo", Password: "x", Uid: -1, Gid: 100}, false)
+			Expect(err).ShouldNot(BeNil())
+			conflict, ok := err.(*IdLockConflictError)
+			Expect(ok).Should(BeTrue())
+			Expect(conflict.UsedBy).Should(Equal("bar"))
+			Expect(conflict.Id).Should(Equal(1200))
+		})
+
+		It("Reuses the gid of the primary group", func() {
+			usersFile, groupsFile, shadowFile, gshadowFile := prepareTxFiles(tmpdir)
+
+			lock := NewIdLock()
+			lock.Users["foo"] = 1200
+			lock.Groups["foo"] = 1300
+
+			apply := func() error {
+				tx, err := NewTransaction(usersFile, groupsFile, shadowFile, gshadowFile)
+				Expect(err).Should(BeNil())
+				defer tx.Rollback()
+				tx.SetIdLock(lock)
+
+				err = tx.Apply(UserPasswd{
+					Username: "foo", Password: "x", Uid: -1, CreateGroup: true,
+					Homedir: "/home/foo", Shell: "/bin/bash",
+				}, false)
+				if err != nil {
+					return err
+				}
+				return tx.Commit()
+			}
+
+			Expect(apply()).Should(BeNil())
+			dat, err := ioutil.ReadFile(usersFile)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(ContainSubstring("foo:x:1200:1300:"))
+			dat, err = ioutil.ReadFile(groupsFile)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(ContainSubstring("foo:x:1300:"))
+			Expect(lock.Groups["foo"]).Should(Equal(1300))
+
+			// A conflict is reported if the gid is already used.
+			prepareTxFiles(tmpdir)
+			err = ioutil.WriteFile(groupsFile, []byte("root:x:0:\nbar:x:1300:\n"), 0644)
+			Expect(err).Should(BeNil())
+
+			err = apply()
+			conflict, ok := err.(*IdLockConflictError)
+			Expect(ok).Should(BeTrue())
+			Expect(conflict.Kind).Should(Equal(GroupKind))
+			Expect(conflict.UsedBy).Should(Equal("bar"))
+			Expect(conflict.Id).Should(Equal(1300))
+		})
+
+		It("Records the ids of the entities already present", func() {
+			usersFile, groupsFile, shadowFile, gshadowFile := prepareTxFiles(tmpdir)
+
+			users, err := ParseUser(usersFile)
+			Expect(err).Should(BeNil())
+			groups, err := ParseGroup(groupsFile)
+			Expect(err).Should(BeNil())
+
+			lock := NewIdLock()
+			tx, err := NewTransaction(usersFile, groupsFile, shadowFile, gshadowFile)
+			Expect(err).Should(BeNil())
+			defer tx.Rollback()
+			tx.SetIdLock(lock)
+
+			// The specs with dynamic ids merged with the current entities.
+			gid := -1
+			gspec := Group{Name: "sddm", Password: "x", Gid: &gid}
+			merged, err := groups["sddm"].Merge(gspec)
+			Expect(err).Should(BeNil())
+			Expect(tx.ApplyMerged(merged, gspec, false)).Should(BeNil())
+
+			uspec := UserPasswd{Username: "daemon", Password: "x", Uid: -1,
+				Homedir: "/sbin", Shell: "/bin/false"}
+			merged, err = users["daemon"].Merge(uspec)
+			Expect(err).Should(BeNil())
+			Expect(tx.ApplyMerged(merged, uspec, false)).Should(BeNil())
+
+			// The specs with a static id are not stored.
+			merged, err = users["bin"].Merge(UserPasswd{Username: "bin", Uid: 1})
+			Expect(err).Should(BeNil())
+			Expect(tx.ApplyMerged(merged, UserPasswd{Username: "bin", Uid: 1}, false)).Should(BeNil())
+			Expect(tx.Commit()).Should(BeNil())
+
+			Expect(lock.Users).Should(Equal(map[string]int{"daemon": 2}))
+			Expect(lock.Groups).Should(Equal(map[string]int{"sddm": 978}))
+		})
+
+		It("Locks the files of the primary group", func() {
+			u := UserPasswd{Username: "foo", Uid: -1, CreateGroup: true}
+			Expect(EntityKinds(u)).Should(Equal([]string{UserKind, GroupKind, GShadowKind}))
+			Expect(EntityKinds(UserPasswd{Username: "foo"})).Should(Equal([]string{UserKind}))
+			Expect(EntityKinds(Group{Name: "foo", MembersRemove: "bar"})).Should(
+				Equal([]string{GroupKind, GShadowKind}))
+		})
+
+		It("Reads and writes the JSON format", func() {
+			lockFile := filepath.Join(tmpdir, "entities.lock.json")
+
+			lock := NewIdLock()
+			lock.Users["foo"] = 1000
+			lock.Groups["foo"] = 1001
+			Expect(lock.Write(lockFile)).Should(BeNil())
+
+			dat, err := ioutil.ReadFile(lockFile)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(ContainSubstring(`"users": {`))
+
+			lock, err = LoadIdLock(lockFile)
+			Expect(err).Should(BeNil())
+			Expect(lock.Users).Should(Equal(map[string]int{"foo": 1000}))
+			Expect(lock.Groups).Should(Equal(map[string]int{"foo": 1001}))
+		})
+	})
+})
@@ -0,0 +1,337 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Same timeout used by lckpwdf(3)
+	defaultLockTimeout = 15 * time.Second
+	lockRetryInterval  = 100 * time.Millisecond
+	pwdLockFile        = ".pwd.lock"
+)
+
+var (
+	locksMutex sync.Mutex
+	// Counters of the locks held by the current process. The locks
+	// are reentrant because Apply calls Create and the merge command
+	// locks the files before applying the entities.
+	heldLocks    = make(map[string]int)
+	heldPwdLocks = make(map[string]*pwdLock)
+)
+
+type pwdLock struct {
+	file  *os.File
+	count int
+}
+
+// LockTimeout returns the maximum time to wait for a lock. The value
+// could be override by the env variable ENTITY_LOCK_TIMEOUT in the
+// golang duration format (e.g. 30s) or as number of seconds.
+func LockTimeout() time.Duration {
+	env := os.Getenv(ENTITY_ENV_LOCK_TIMEOUT)
+	if env != "" {
+		if d, err := time.ParseDuration(env); err == nil && d >= 0 {
+			return d
+		}
+		if secs, err := strconv.Atoi(env); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return defaultLockTimeout
+}
+
+// FilesLock contains the locks acquired for a list of files.
+type FilesLock struct {
+	files []string
+	dirs  []string
+}
+
+// LockFiles locks the files following the shadow-utils way. For every
+// file is created the file <file>.lock with the PID of the process
+// through an hard link and the directory of the file is locked with
+// the lckpwdf(3) lock file .pwd.lock.
+// The locks must be released with Unlock.
+func LockFiles(paths ...string) (*FilesLock, error) {
+	ans := &FilesLock{
+		files: []string{},
+		dirs:  []string{},
+	}
+	deadline := time.Now().Add(LockTimeout())
+
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+
+		dir := filepath.Dir(p)
+		if !stringInSlice(dir, ans.dirs) {
+			if err := lockDir(dir, deadline); err != nil {
+				ans.Unlock()
+				return nil, err
+			}
+			ans.dirs = append(ans.dirs, dir)
+		}
+
+		if stringInSlice(p, ans.files) {
+			continue
+		}
+		if err := lockFile(p, deadline); err != nil {
+			ans.Unlock()
+			return nil, err
+		}
+		ans.files = append(ans.files, p)
+	}
+
+	return ans, nil
+}
+
+// Unlock releases all the locks in the reverse order.
+func (l *FilesLock) Unlock() error {
+	var ans error
+
+	for i := len(l.files) - 1; i >= 0; i-- {
+		if err := unlockFile(l.files[i]); err != nil && ans == nil {
+			ans = err
+		}
+	}
+	for i := len(l.dirs) - 1; i >= 0; i-- {
+		if err := unlockDir(l.dirs[i]); err != nil && ans == nil {
+			ans = err
+		}
+	}
+
+	l.files = []string{}
+	l.dirs = []string{}
+
+	return ans
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func lockFile(path string, deadline time.Time) error {
+	lockPath := path + ".lock"
+	for {
+		locked, err := tryLockFile(path, lockPath)
+		if err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf(
+				"Timeout on waiting the lock %s", lockPath))
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+func tryLockFile(path, lockPath string) (bool, error) {
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+
+	if n, ok := heldLocks[path]; ok {
+		heldLocks[path] = n + 1
+		return true, nil
+	}
+
+	locked, err := tryLinkLock(path, lockPath)
+	if locked {
+		heldLocks[path] = 1
+	}
+	return locked, err
+}
+
+func unlockFile(path string) error {
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+
+	n, ok := heldLocks[path]
+	if !ok {
+		return nil
+	}
+	if n > 1 {
+		heldLocks[path] = n - 1
+		return nil
+	}
+	delete(heldLocks, path)
+
+	err := os.Remove(path + ".lock")
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Error on remove lock file")
+	}
+	return nil
+}
+
+// tryLinkLock creates the lock file like the do_lock_file() function
+// of shadow-utils: a temporary file with the PID is linked to the lock
+// file. If the lock file exists and the process that owns it is dead
+// the lock file is removed as stale.
+func tryLinkLock(path, lockPath string) (bool, error) {
+	pid := os.Getpid()
+	tmpPath := fmt.Sprintf("%s.%d", path, pid)
+
+	err := ioutil.WriteFile(tmpPath, []byte(fmt.Sprintf("%d", pid)), 0600)
+	if err != nil {
+		return false, errors.Wrap(err, "Error on create lock file "+tmpPath)
+	}
+	defer os.Remove(tmpPath)
+
+	err = os.Link(tmpPath, lockPath)
+	if err == nil {
+		return checkLinkCount(tmpPath), nil
+	}
+	if !os.IsExist(err) {
+		return false, errors.Wrap(err, "Error on create lock file "+lockPath)
+	}
+
+	// POST: the lock file exists. Check if it's stale.
+	data, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Released in the meantime.
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Error on read lock file "+lockPath)
+	}
+
+	lpid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || lpid <= 0 {
+		return false, errors.New(fmt.Sprintf(
+			"Existing lock file %s with invalid PID", lockPath))
+	}
+
+	if lpid != pid && processAlive(lpid) {
+		return false, nil
+	}
+
+	// POST: stale lock file.
+	err = os.Remove(lockPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "Error on remove stale lock file "+lockPath)
+	}
+
+	err = os.Link(tmpPath, lockPath)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Error on create lock file "+lockPath)
+	}
+
+	return checkLinkCount(tmpPath), nil
+}
+
+// checkLinkCount verifies that the link is been created correctly
+// also on filesystems where link() could return errors wrongly (NFS).
+func checkLinkCount(tmpPath string) bool {
+	st, err := os.Stat(tmpPath)
+	if err != nil {
+		return false
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return sys.Nlink == 2
+	}
+	return false
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// lockDir acquires the lckpwdf(3) lock file of the directory.
+func lockDir(dir string, deadline time.Time) error {
+	lockPath := filepath.Join(dir, pwdLockFile)
+	for {
+		locked, err := tryLockDir(dir, lockPath)
+		if err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf(
+				"Timeout on waiting the lock %s", lockPath))
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+func tryLockDir(dir, lockPath string) (bool, error) {
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+
+	if l, ok := heldPwdLocks[dir]; ok {
+		l.count++
+		return true, nil
+	}
+
+	f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return false, errors.Wrap(err, "Error on open lock file "+lockPath)
+	}
+
+	flock := unix.Flock_t{
+		Type:   unix.F_WRLCK,
+		Whence: 0,
+	}
+	err = unix.FcntlFlock(f.Fd(), unix.F_SETLK, &flock)
+	if err != nil {
+		f.Close()
+		if err == unix.EAGAIN || err == unix.EACCES {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Error on lock file "+lockPath)
+	}
+
+	heldPwdLocks[dir] = &pwdLock{file: f, count: 1}
+	return true, nil
+}
+
+func unlockDir(dir string) error {
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+
+	l, ok := heldPwdLocks[dir]
+	if !ok {
+		return nil
+	}
+	l.count--
+	if l.count > 0 {
+		return nil
+	}
+	delete(heldPwdLocks, dir)
+
+	// Closing the file releases the fcntl lock.
+	return l.file.Close()
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lock", func() {
+	Context("Locking files", func() {
+
+		It("Creates and removes the lock files", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			file := filepath.Join(tmpdir, "passwd")
+
+			lock, err := LockFiles(file)
+			Expect(err).Should(BeNil())
+
+			data, err := ioutil.ReadFile(file + ".lock")
+			Expect(err).Should(BeNil())
+			Expect(string(data)).Should(Equal(fmt.Sprintf("%d", os.Getpid())))
+
+			// Locks are reentrant
+			lock2, err := LockFiles(file)
+			Expect(err).Should(BeNil())
+			Expect(lock2.Unlock()).Should(BeNil())
+			_, err = os.Stat(file + ".lock")
+			Expect(err).Should(BeNil())
+
+			Expect(lock.Unlock()).Should(BeNil())
+			_, err = os.Stat(file + ".lock")
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+		})
+
+		It("Removes stale lock files", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			file := filepath.Join(tmpdir, "group")
+
+			// Retrieve the PID of a dead process.
+			c := exec.Command("true")
+			Expect(c.Run()).Should(BeNil())
+			err = ioutil.WriteFile(file+".lock",
+				[]byte(fmt.Sprintf("%d", c.Process.Pid)), 0600)
+			Expect(err).Should(BeNil())
+
+			lock, err := LockFiles(file)
+			Expect(err).Should(BeNil())
+			Expect(lock.Unlock()).Should(BeNil())
+		})
+
+		It("Fails on timeout", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			os.Setenv(ENTITY_ENV_LOCK_TIMEOUT, "300ms")
+			defer os.Unsetenv(ENTITY_ENV_LOCK_TIMEOUT)
+
+			file := filepath.Join(tmpdir, "shadow")
+			err = ioutil.WriteFile(file+".lock", []byte("1"), 0600)
+			Expect(err).Should(BeNil())
+
+			_, err = LockFiles(file)
+			Expect(err).ShouldNot(BeNil())
+
+			u := UserPasswd{Username: "foo", Homedir: "/home/foo"}
+			err = u.Apply(file, false)
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+})
@@ -0,0 +1,220 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Default values of shadow-utils when login.defs doesn't define them.
+const (
+	defaultIdMin = 1000
+	defaultIdMax = 60000
+	defaultSysId = 101
+)
+
+func LoginDefsDefault(s string) string {
+	if s == "" {
+		s = os.Getenv(ENTITY_ENV_DEF_LOGIN_DEFS)
+		if s == "" {
+			s = "/etc/login.defs"
+		}
+	}
+	return RootPath(s)
+}
+
+// LoginDefs contains the options defined in the login.defs file.
+type LoginDefs struct {
+	values map[string]string
+}
+
+// IdRange is a range of uids or gids. The ids are allocated from
+// Max to Min if Descending is true.
+type IdRange struct {
+	Min        int
+	Max        int
+	Descending bool
+}
+
+func (r IdRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// ParseIdRange parses a range in the format <min>-<max>.
+func ParseIdRange(s string) (IdRange, error) {
+	ans := IdRange{}
+
+	ranges := strings.Split(strings.TrimSpace(s), "-")
+	if len(ranges) != 2 {
+		return ans, errors.New("Invalid range " + s + ": expected <min>-<max>")
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(ranges[0]))
+	if err != nil {
+		return ans, errors.New("Invalid minimum id of range " + s)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(ranges[1]))
+	if err != nil {
+		return ans, errors.New("Invalid maximum id of range " + s)
+	}
+	if min < 0 || min > max {
+		return ans, errors.New("Invalid range " + s)
+	}
+
+	ans.Min = min
+	ans.Max = max
+
+	return ans, nil
+}
+
+// ParseLoginDefs reads the options of the file. A missing file is
+// handled as an empty file.
+func ParseLoginDefs(path string) (*LoginDefs, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &LoginDefs{values: make(map[string]string)}, nil
+		}
+		return nil, errors.Wrap(err, "Failed reading "+path)
+	}
+	defer file.Close()
+
+	return ParseLoginDefsReader(file)
+}
+
+// ParseLoginDefsReader consumes the contents of r and parses the options.
+func ParseLoginDefsReader(r io.Reader) (*LoginDefs, error) {
+	ans := &LoginDefs{values: make(map[string]string)}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fs := strings.Fields(line)
+		if len(fs) < 2 {
+			continue
+		}
+		ans.values[fs[0]] = strings.Trim(fs[1], "\"")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed reading login.defs")
+	}
+
+	return ans, nil
+}
+
+// Get returns the value of the option.
+func (l *LoginDefs) Get(key string) (string, bool) {
+	v, ok := l.values[key]
+	return v, ok
+}
+
+// GetInt returns the numeric value of the option or def if the option
+// is not present or invalid. Like shadow-utils the values could be
+// in decimal, octal (0 prefix) or hexadecimal (0x prefix) format.
+func (l *LoginDefs) GetInt(key string, def int) int {
+	v, ok := l.values[key]
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 0, 64)
+	if err != nil {
+		return def
+	}
+	return int(n)
+}
+
+// hasIdRange returns true if the file defines at least one of the
+// options of the ranges of the prefix.
+func (l *LoginDefs) hasIdRange(prefix string) bool {
+	for _, key := range []string{prefix + "_MIN", prefix + "_MAX",
+		"SYS_" + prefix + "_MIN", "SYS_" + prefix + "_MAX"} {
+		if _, ok := l.values[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// idRange returns the range of the prefix. The range of the legacy
+// env variable ENTITY_DYNAMIC_RANGE (by default 500-999) is used for
+// the normal and the system ids if it's defined or if the file
+// doesn't define the ranges.
+func (l *LoginDefs) idRange(prefix string, system bool) IdRange {
+	if os.Getenv(ENTITY_ENV_DEF_DYNAMIC_RANGE) != "" || !l.hasIdRange(prefix) {
+		start, end := DynamicRange()
+		return IdRange{Min: end, Max: start, Descending: true}
+	}
+
+	min := l.GetInt(prefix+"_MIN", defaultIdMin)
+	max := l.GetInt(prefix+"_MAX", defaultIdMax)
+
+	if system {
+		// Like useradd -r the system ids are allocated from the top.
+		return IdRange{
+			Min:        l.GetInt("SYS_"+prefix+"_MIN", defaultSysId),
+			Max:        l.GetInt("SYS_"+prefix+"_MAX", min-1),
+			Descending: true,
+		}
+	}
+
+	return IdRange{Min: min, Max: max}
+}
+
+// UidRange returns the range of the uids of the users or of the
+// system users.
+func (l *LoginDefs) UidRange(system bool) IdRange {
+	return l.idRange("UID", system)
+}
+
+// GidRange returns the range of the gids of the groups or of the
+// system groups.
+func (l *LoginDefs) GidRange(system bool) IdRange {
+	return l.idRange("GID", system)
+}
+
+// SubIdRange returns the range and the count of the subordinate
+// ids of the kind subuid or subgid.
+func (l *LoginDefs) SubIdRange(kind string) (IdRange, int) {
+	prefix := "SUB_UID"
+	if kind == SubGidKind {
+		prefix = "SUB_GID"
+	}
+	r := IdRange{
+		Min: l.GetInt(prefix+"_MIN", defaultSubIdMin),
+		Max: l.GetInt(prefix+"_MAX", defaultSubIdMax),
+	}
+	return r, l.GetInt(prefix+"_COUNT", defaultSubIdCount)
+}
+
+// getFreeId returns the first id of the range not present in the
+// used ids.
+func getFreeId(r IdRange, used map[int]bool) (int, bool) {
+	if r.Descending {
+		for i := r.Max; i >= r.Min; i-- {
+			if !used[i] {
+				return i, true
+			}
+		}
+	} else {
+		for i := r.Min; i <= r.Max; i++ {
+			if !used[i] {
+				return i, true
+			}
+		}
+	}
+	return -1, false
+}
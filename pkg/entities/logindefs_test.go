@@ -0,0 +1,126 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LoginDefs", func() {
+	Context("Parse login.defs", func() {
+
+		It("Returns the ranges", func() {
+			l, err := ParseLoginDefsReader(strings.NewReader(`
+# Min/max values for automatic uid selection in useradd
+UID_MIN			 2000
+UID_MAX			60000
+SYS_UID_MIN		  0x64
+#SYS_UID_MAX		  999
+GID_MIN			 1000
+ENCRYPT_METHOD "SHA512"
+`))
+			Expect(err).Should(BeNil())
+
+			v, ok := l.Get("ENCRYPT_METHOD")
+			Expect(ok).Should(BeTrue())
+			Expect(v).Should(Equal("SHA512"))
+
+			Expect(l.UidRange(false)).Should(Equal(IdRange{Min: 2000, Max: 60000}))
+			Expect(l.UidRange(true)).Should(Equal(IdRange{Min: 100, Max: 1999, Descending: true}))
+			Expect(l.GidRange(false)).Should(Equal(IdRange{Min: 1000, Max: 60000}))
+			Expect(l.GidRange(true)).Should(Equal(IdRange{Min: 101, Max: 999, Descending: true}))
+		})
+
+		It("Uses the dynamic range without the ranges of login.defs", func() {
+			l, err := ParseLoginDefsReader(strings.NewReader("ENCRYPT_METHOD SHA512\n"))
+			Expect(err).Should(BeNil())
+
+			legacy := IdRange{Min: 500, Max: 999, Descending: true}
+			Expect(l.UidRange(false)).Should(Equal(legacy))
+			Expect(l.UidRange(true)).Should(Equal(legacy))
+			Expect(l.GidRange(false)).Should(Equal(legacy))
+			Expect(l.GidRange(true)).Should(Equal(legacy))
+
+			// The env variable has priority over login.defs.
+			os.Setenv(ENTITY_ENV_DEF_DYNAMIC_RANGE, "600-700")
+			defer os.Unsetenv(ENTITY_ENV_DEF_DYNAMIC_RANGE)
+			l, err = ParseLoginDefsReader(strings.NewReader("UID_MIN 1000\nSYS_UID_MAX 999\n"))
+			Expect(err).Should(BeNil())
+			env := IdRange{Min: 600, Max: 700, Descending: true}
+			Expect(l.UidRange(false)).Should(Equal(env))
+			Expect(l.UidRange(true)).Should(Equal(env))
+		})
+
+		It("Parses a range", func() {
+			r, err := ParseIdRange("500-599")
+			Expect(err).Should(BeNil())
+			Expect(r).Should(Equal(IdRange{Min: 500, Max: 599}))
+
+			_, err = ParseIdRange("600-599")
+			Expect(err).ShouldNot(BeNil())
+		})
+
+		It("Allocates the ids from login.defs", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			loginDefs := filepath.Join(tmpdir, "login.defs")
+			err = ioutil.WriteFile(loginDefs, []byte(`UID_MIN 1000
+UID_MAX 1999
+SYS_UID_MIN 100
+SYS_UID_MAX 200
+GID_MIN 1000
+`), 0644)
+			Expect(err).Should(BeNil())
+			os.Setenv(ENTITY_ENV_DEF_LOGIN_DEFS, loginDefs)
+			defer os.Unsetenv(ENTITY_ENV_DEF_LOGIN_DEFS)
+
+			passwd := filepath.Join(tmpdir, "passwd")
+			err = ioutil.WriteFile(passwd, []byte(`root:x:0:0:root:/root:/bin/bash
+foo:x:1000:1000::/home/foo:/bin/bash
+sys:x:200:200::/:/sbin/nologin
+`), 0644)
+			Expect(err).Should(BeNil())
+			group := filepath.Join(tmpdir, "group")
+			err = ioutil.WriteFile(group, []byte("root:x:0:\n"), 0644)
+			Expect(err).Should(BeNil())
+
+			db := NewDatabase(passwd, group, "", "")
+			err = db.Create(UserPasswd{Username: "user", Password: "x", Uid: -1, Gid: 100})
+			Expect(err).Should(BeNil())
+			err = db.Create(UserPasswd{Username: "daemon", Password: "x", Uid: -1, Gid: 100, System: true})
+			Expect(err).Should(BeNil())
+			err = db.Create(UserPasswd{Username: "ranged", Password: "x", Uid: -1, Gid: 100, UidRange: "5000-5010"})
+			Expect(err).Should(BeNil())
+
+			gid := -1
+			err = db.Create(Group{Name: "sysgroup", Password: "x", Gid: &gid, System: true})
+			Expect(err).Should(BeNil())
+
+			f, err := db.GetFile(UserKind)
+			Expect(err).Should(BeNil())
+			line, _ := f.Get("user")
+			Expect(line).Should(HavePrefix("user:x:1001:"))
+			line, _ = f.Get("daemon")
+			Expect(line).Should(HavePrefix("daemon:x:199:"))
+			line, _ = f.Get("ranged")
+			Expect(line).Should(HavePrefix("ranged:x:5000:"))
+
+			f, err = db.GetFile(GroupKind)
+			Expect(err).Should(BeNil())
+			line, _ = f.Get("sysgroup")
+			Expect(line).Should(Equal("sysgroup:x:999:"))
+		})
+	})
+})
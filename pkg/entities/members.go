@@ -0,0 +1,137 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Fields of the members lists in the group and gshadow lines.
+const (
+	groupMembersField       = 3
+	gshadowAdminsField      = 2
+	gshadowMembersField     = 3
+	groupAndGShadowFieldsNr = 4
+)
+
+func splitMembers(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+func addMembers(members []string, users ...string) []string {
+	return Unique(append(members, users...))
+}
+
+func removeMembers(members []string, users ...string) []string {
+	drop := make(map[string]bool, len(users))
+	for _, u := range users {
+		drop[u] = true
+	}
+
+	ans := []string{}
+	for _, m := range members {
+		if !drop[m] {
+			ans = append(ans, m)
+		}
+	}
+	return ans
+}
+
+// updateMembers replaces the members list in the field of the line of
+// the group or gshadow file. It returns false if the line is not
+// present or malformed.
+func updateMembers(f *DatabaseFile, name string, field int,
+	edit func(members []string) []string) bool {
+
+	line, ok := f.Get(name)
+	if !ok {
+		return false
+	}
+	fs := strings.Split(line, ":")
+	if len(fs) != groupAndGShadowFieldsNr {
+		return false
+	}
+
+	members := strings.Join(edit(splitMembers(fs[field])), ",")
+	if members != fs[field] {
+		fs[field] = members
+		f.Set(name, strings.Join(fs, ":"))
+	}
+
+	return true
+}
+
+// editGroupMembers applies the edit to the members of the group in the
+// group file and in the gshadow file if the group is present.
+func editGroupMembers(db *Database, group string, edit func(members []string) []string) error {
+	groups, err := db.GetFile(GroupKind)
+	if err != nil {
+		return err
+	}
+	if !groups.Has(group) {
+		return &NotFoundError{Kind: GroupKind, Name: group, File: groups.GetPath()}
+	}
+	if !updateMembers(groups, group, groupMembersField, edit) {
+		return errors.New("Invalid entry of group " + group)
+	}
+
+	gshadows, err := db.GetFile(GShadowKind)
+	if err != nil {
+		return err
+	}
+	updateMembers(gshadows, group, gshadowMembersField, edit)
+
+	return nil
+}
+
+func checkUsers(db *Database, users []string) error {
+	f, err := db.GetFile(UserKind)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if !f.Has(u) {
+			return &NotFoundError{Kind: UserKind, Name: u, File: f.GetPath()}
+		}
+	}
+	return nil
+}
+
+// AddGroupMembers adds the users to the members of the group in the
+// group and gshadow files. The users must be present.
+func AddGroupMembers(db *Database, group string, users ...string) error {
+	err := checkUsers(db, users)
+	if err != nil {
+		return err
+	}
+	return editGroupMembers(db, group, func(members []string) []string {
+		return addMembers(members, users...)
+	})
+}
+
+// RemoveGroupMembers removes the users from the members of the group
+// in the group and gshadow files. The users not members are ignored.
+func RemoveGroupMembers(db *Database, group string, users ...string) error {
+	return editGroupMembers(db, group, func(members []string) []string {
+		return removeMembers(members, users...)
+	})
+}
+
+// SetGroupMembers replaces the members of the group in the group and
+// gshadow files. The users must be present.
+func SetGroupMembers(db *Database, group string, users ...string) error {
+	err := checkUsers(db, users)
+	if err != nil {
+		return err
+	}
+	return editGroupMembers(db, group, func(members []string) []string {
+		return Unique(users)
+	})
+}
@@ -0,0 +1,92 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Group members", func() {
+	Context("Editing the members of a group", func() {
+		var tmpdir string
+		var passwd, group, shadow, gshadow string
+
+		BeforeEach(func() {
+			var err error
+			tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+
+			passwd, group, shadow, gshadow = writeTxFiles(tmpdir, `root:x:0:0:root:/root:/bin/bash
+foo:x:1000:1000::/home/foo:/bin/bash
+bar:x:1001:1001::/home/bar:/bin/bash
+`,
+				"root:x:0:\nwheel:x:10:root\n",
+				"",
+				"root:::\nwheel::root:root\n",
+			)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpdir)
+		})
+
+		It("Adds, removes and sets the members", func() {
+			tx, err := NewTransaction(passwd, group, shadow, gshadow)
+			Expect(err).Should(BeNil())
+			Expect(tx.AddGroupMembers("wheel", "foo", "bar", "foo")).Should(BeNil())
+			Expect(tx.RemoveGroupMembers("wheel", "root")).Should(BeNil())
+			Expect(tx.Commit()).Should(BeNil())
+
+			Expect(readFile(group)).Should(Equal("root:x:0:\nwheel:x:10:foo,bar\n"))
+			Expect(readFile(gshadow)).Should(Equal("root:::\nwheel::root:foo,bar\n"))
+
+			tx, err = NewTransaction(passwd, group, shadow, gshadow)
+			Expect(err).Should(BeNil())
+			Expect(tx.SetGroupMembers("wheel", "bar")).Should(BeNil())
+			Expect(tx.Commit()).Should(BeNil())
+
+			Expect(readFile(group)).Should(Equal("root:x:0:\nwheel:x:10:bar\n"))
+			Expect(readFile(gshadow)).Should(Equal("root:::\nwheel::root:bar\n"))
+		})
+
+		It("Rejects missing users and groups", func() {
+			tx, err := NewTransaction(passwd, group, shadow, gshadow)
+			Expect(err).Should(BeNil())
+			defer tx.Rollback()
+
+			err = tx.AddGroupMembers("wheel", "missing")
+			Expect(errors.Is(err, ErrNotFound)).Should(BeTrue())
+			err = tx.AddGroupMembers("missing", "foo")
+			Expect(errors.Is(err, ErrNotFound)).Should(BeTrue())
+		})
+
+		It("Removes the members of the spec", func() {
+			err := Group{Name: "wheel", Users: "foo,bar"}.Apply(group, false)
+			Expect(err).Should(BeNil())
+			Expect(readFile(group)).Should(Equal("root:x:0:\nwheel:x:10:root,foo,bar\n"))
+
+			err = Group{Name: "wheel", MembersRemove: "root,foo"}.Apply(group, false)
+			Expect(err).Should(BeNil())
+			Expect(readFile(group)).Should(Equal("root:x:0:\nwheel:x:10:bar\n"))
+			Expect(readFile(gshadow)).Should(Equal("root:::\nwheel::root:\n"))
+		})
+
+		It("Merges the specs with the members to remove", func() {
+			gid := 10
+			g, err := Group{Name: "wheel", Gid: &gid, Users: "root,foo"}.Merge(
+				Group{Name: "wheel", Users: "bar", MembersRemove: "root"})
+			Expect(err).Should(BeNil())
+			Expect(g.(Group).Users).Should(Equal("bar,foo"))
+			Expect(g.(Group).MembersRemove).Should(Equal("root"))
+		})
+	})
+})
@@ -0,0 +1,111 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Kinds of the problems found by the parsers.
+const (
+	ParseErrorFieldsNumber = "fields-number"
+	ParseErrorEmptyName    = "empty-name"
+	ParseErrorInvalidId    = "invalid-id"
+)
+
+// ParseError describes a malformed line of a file. Field is the
+// position of the wrong field starting from 1 or 0 if the problem
+// is related to the whole line.
+type ParseError struct {
+	File      string `json:"file,omitempty" yaml:"file,omitempty"`
+	Line      int    `json:"line" yaml:"line"`
+	Field     int    `json:"field,omitempty" yaml:"field,omitempty"`
+	FieldName string `json:"field_name,omitempty" yaml:"field_name,omitempty"`
+	Kind      string `json:"kind" yaml:"kind"`
+	Content   string `json:"-" yaml:"-"`
+	Message   string `json:"message" yaml:"message"`
+}
+
+func newParseError(kind string, field int, fieldName, msg string) *ParseError {
+	return &ParseError{
+		Kind:      kind,
+		Field:     field,
+		FieldName: fieldName,
+		Message:   msg,
+	}
+}
+
+// newFieldsNumberError returns the error of a line with a wrong number
+// of fields. The file is set by the caller with toParseError.
+func newFieldsNumberError(expected, found int) *ParseError {
+	return newParseError(ParseErrorFieldsNumber, 0, "",
+		fmt.Sprintf("Unexpected number of fields: expected %d, found %d",
+			expected, found))
+}
+
+func (e *ParseError) Error() string {
+	file := e.File
+	if file == "" {
+		file = "<reader>"
+	}
+	if e.Field > 0 {
+		return fmt.Sprintf("%s:%d: field %d (%s): %s",
+			file, e.Line, e.Field, e.FieldName, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", file, e.Line, e.Message)
+}
+
+var parseWarningHandler = func(e *ParseError) {
+	fmt.Fprintln(os.Stderr, "WARN: "+e.Error())
+}
+
+// SetParseWarningHandler sets the function called for every line skipped
+// by the parsers. By default the warnings are printed to stderr. A nil
+// handler discards the warnings.
+func SetParseWarningHandler(h func(e *ParseError)) {
+	parseWarningHandler = h
+}
+
+// toParseError returns the error as ParseError with the position
+// of the line.
+func toParseError(file string, line int, content string, err error) *ParseError {
+	pe, ok := err.(*ParseError)
+	if !ok {
+		pe = newParseError("", 0, "", err.Error())
+	}
+	pe.File = file
+	pe.Line = line
+	pe.Content = content
+	return pe
+}
+
+// redactLine replaces the password of a line of the shadow or gshadow
+// file with a placeholder to never report the hashes.
+func redactLine(line string) string {
+	fs := strings.SplitN(line, ":", 3)
+	if len(fs) < 2 {
+		return redactedSecret
+	}
+	fs[1] = redactedSecret
+	return strings.Join(fs, ":")
+}
+
+// parseLineError handles the error of a malformed line. In strict mode
+// the error is returned with the position of the line, otherwise the
+// line is reported as warning and skipped.
+func parseLineError(file string, line int, content string, err error) error {
+	pe := toParseError(file, line, content, err)
+
+	if StrictMode() {
+		return pe
+	}
+
+	if parseWarningHandler != nil {
+		parseWarningHandler(pe)
+	}
+	return nil
+}
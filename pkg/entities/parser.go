@@ -16,6 +16,8 @@ const (
 	ShadowKind  = "shadow"
 	GroupKind   = "group"
 	GShadowKind = "gshadow"
+	SubUidKind  = "subuid"
+	SubGidKind  = "subgid"
 )
 
 type EntitiesParser interface {
@@ -70,6 +72,24 @@ func (p Parser) ReadEntityFromBytes(yamlFile []byte) (Entity, error) {
 			return nil, errors.Wrap(err, "Failed while parsing entity file")
 		}
 		return group, nil
+
+	case SubUidKind:
+		var sub SubUid
+
+		err = yaml.Unmarshal(yamlFile, &sub)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed while parsing entity file")
+		}
+		return sub, nil
+
+	case SubGidKind:
+		var sub SubGid
+
+		err = yaml.Unmarshal(yamlFile, &sub)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed while parsing entity file")
+		}
+		return sub, nil
 	}
 
 	return nil, errors.New("Unsupported format")
@@ -0,0 +1,117 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+const (
+	PlanAdded    = "added"
+	PlanModified = "modified"
+	PlanRemoved  = "removed"
+)
+
+// PlanChange describes the change of a line of a file.
+type PlanChange struct {
+	Action  string `json:"action" yaml:"action"`
+	Name    string `json:"name" yaml:"name"`
+	OldLine string `json:"old_line,omitempty" yaml:"old_line,omitempty"`
+	NewLine string `json:"new_line,omitempty" yaml:"new_line,omitempty"`
+}
+
+// FilePlan contains the changes that will be applied to a file.
+type FilePlan struct {
+	File    string       `json:"file" yaml:"file"`
+	Kind    string       `json:"kind" yaml:"kind"`
+	Changes []PlanChange `json:"changes" yaml:"changes"`
+	// Diff contains the changes in the unified diff format.
+	Diff string `json:"-" yaml:"-"`
+}
+
+// Plan returns the changes staged in the transaction for every
+// modified file without writing them.
+func (t *Transaction) Plan() ([]FilePlan, error) {
+	ans := []FilePlan{}
+
+	for _, kind := range txKinds {
+		// The entities could modify also files not managed
+		// directly (e.g. the primary group of a user).
+		f, ok := t.db.files[kind]
+		if !ok || !f.Modified() {
+			continue
+		}
+
+		oldContent := string(f.Original())
+		newContent := string(f.Bytes())
+		if oldContent == newContent {
+			continue
+		}
+
+		ans = append(ans, FilePlan{
+			File:    f.GetPath(),
+			Kind:    kind,
+			Changes: planChanges(oldContent, newContent),
+			Diff:    unifiedDiff(f.GetPath(), f.GetPath(), oldContent, newContent),
+		})
+	}
+
+	return ans, nil
+}
+
+// planChanges compares the lines of the two contents through the
+// entity identifier.
+func planChanges(oldContent, newContent string) []PlanChange {
+	ans := []PlanChange{}
+
+	oldLines := make(map[string]string)
+	oldKeys := []string{}
+	for _, line := range splitLines(oldContent) {
+		key := entityIdentifier(line)
+		if key == "" {
+			continue
+		}
+		if _, ok := oldLines[key]; !ok {
+			oldLines[key] = line
+			oldKeys = append(oldKeys, key)
+		}
+	}
+
+	newLines := make(map[string]string)
+	for _, line := range splitLines(newContent) {
+		key := entityIdentifier(line)
+		if key == "" {
+			continue
+		}
+		if _, ok := newLines[key]; ok {
+			continue
+		}
+		newLines[key] = line
+
+		oldLine, ok := oldLines[key]
+		if !ok {
+			ans = append(ans, PlanChange{
+				Action:  PlanAdded,
+				Name:    key,
+				NewLine: line,
+			})
+		} else if oldLine != line {
+			ans = append(ans, PlanChange{
+				Action:  PlanModified,
+				Name:    key,
+				OldLine: oldLine,
+				NewLine: line,
+			})
+		}
+	}
+
+	for _, key := range oldKeys {
+		if _, ok := newLines[key]; !ok {
+			ans = append(ans, PlanChange{
+				Action:  PlanRemoved,
+				Name:    key,
+				OldLine: oldLines[key],
+			})
+		}
+	}
+
+	return ans
+}
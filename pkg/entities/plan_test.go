@@ -0,0 +1,103 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plan", func() {
+	Context("Dry-run of entities", func() {
+		p := &Parser{}
+
+		It("Shows the changes without write them", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			file := filepath.Join(tmpdir, "passwd")
+			_, err = copy("../../testing/fixtures/simple/passwd", file)
+			Expect(err).Should(BeNil())
+
+			tx, err := NewEntityTransaction(UserKind, file)
+			Expect(err).Should(BeNil())
+			defer tx.Rollback()
+
+			entity, err := p.ReadEntity("../../testing/fixtures/simple/update.yaml")
+			Expect(err).Should(BeNil())
+			err = tx.Apply(entity, false)
+			Expect(err).Should(BeNil())
+
+			entity, err = p.ReadEntity("../../testing/fixtures/simple/user.yaml")
+			Expect(err).Should(BeNil())
+			err = tx.Apply(entity, false)
+			Expect(err).Should(BeNil())
+
+			err = tx.Delete(UserPasswd{
+				Username: "gpsd",
+				Password: "x",
+				Uid:      139,
+				Gid:      14,
+				Info:     "added by portage for gpsd",
+				Homedir:  "/dev/null",
+				Shell:    "/sbin/nologin",
+			})
+			Expect(err).Should(BeNil())
+
+			plans, err := tx.Plan()
+			Expect(err).Should(BeNil())
+			Expect(len(plans)).Should(Equal(1))
+			Expect(plans[0].File).Should(Equal(file))
+			Expect(plans[0].Kind).Should(Equal(UserKind))
+			Expect(plans[0].Changes).Should(Equal([]PlanChange{
+				{
+					Action:  PlanModified,
+					Name:    "root",
+					OldLine: "root:x:0:0:root:/root:/bin/bash",
+					NewLine: "root:x:0:0:Foo!:/home/foo:/bin/bash",
+				},
+				{
+					Action:  PlanAdded,
+					Name:    "foo",
+					NewLine: "foo:pass:0:0:Foo!:/home/foo:/bin/bash",
+				},
+				{
+					Action:  PlanRemoved,
+					Name:    "gpsd",
+					OldLine: "gpsd:x:139:14:added by portage for gpsd:/dev/null:/sbin/nologin",
+				},
+			}))
+			Expect(plans[0].Diff).Should(Equal(`--- ` + file + `
++++ ` + file + `
+@@ -1,4 +1,4 @@
+-root:x:0:0:root:/root:/bin/bash
++root:x:0:0:Foo!:/home/foo:/bin/bash
+ bin:x:1:1:bin:/bin:/bin/false
+ daemon:x:2:2:daemon:/sbin:/bin/false
+ adm:x:3:4:adm:/var/adm:/bin/false
+@@ -6,4 +6,4 @@
+ sync:x:5:0:sync:/sbin:/bin/sync
+ shutdown:x:6:0:shutdown:/sbin:/sbin/shutdown
+ unbound:x:999:955:added by portage for unbound:/etc/unbound:/sbin/nologin
+-gpsd:x:139:14:added by portage for gpsd:/dev/null:/sbin/nologin
++foo:pass:0:0:Foo!:/home/foo:/bin/bash
+`))
+
+			// The file is not modified
+			dat, err := ioutil.ReadFile(file)
+			Expect(err).Should(BeNil())
+			orig, err := ioutil.ReadFile("../../testing/fixtures/simple/passwd")
+			Expect(err).Should(BeNil())
+			Expect(dat).Should(Equal(orig))
+		})
+	})
+})
@@ -0,0 +1,117 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Maximum number of symlinks followed resolving a path like the
+// MAXSYMLINKS of Linux.
+const maxSymlinks = 40
+
+// RootDir returns the directory of the system tree managed (e.g. the
+// root of a chroot or of an image). It's empty for the real system.
+func RootDir() string {
+	root := os.Getenv(ENTITY_ENV_ROOT)
+	if root == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	if root == "/" {
+		return ""
+	}
+	return root
+}
+
+// RootPath returns the path resolved inside the root directory. The
+// paths already resolved inside the root are returned unchanged.
+func RootPath(path string) string {
+	return rootJoin(RootDir(), path)
+}
+
+func rootJoin(root, path string) string {
+	if root == "" || path == "" {
+		return path
+	}
+
+	// Avoid to resolve twice the same path.
+	if path == root {
+		path = "/"
+	} else if strings.HasPrefix(path, root+"/") {
+		path = path[len(root):]
+	}
+
+	ans, err := SecureJoin(root, path)
+	if err != nil {
+		// POST: too many links or path not readable. The access
+		//       to the file will fail in the same way.
+		return filepath.Join(root, filepath.Clean("/"+path))
+	}
+	return ans
+}
+
+// SecureJoin joins the path to the root resolving the symlinks as the
+// root was the root directory of the system: the absolute symlinks and
+// the .. components are resolved inside the root and they can't escape
+// from it. The components that don't exist are joined as they are.
+func SecureJoin(root, path string) (string, error) {
+	root = filepath.Clean(root)
+	resolved := "/"
+	links := 0
+
+	for path != "" {
+		var part string
+		if i := strings.IndexByte(path, '/'); i >= 0 {
+			part, path = path[:i], path[i+1:]
+		} else {
+			part, path = path, ""
+		}
+
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.New("Too many symlinks resolving " + next)
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(dest) {
+			resolved = "/"
+		}
+		path = dest + "/" + path
+	}
+
+	return filepath.Join(root, resolved), nil
+}
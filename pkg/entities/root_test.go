@@ -0,0 +1,76 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Root", func() {
+	Context("Resolving paths inside the root", func() {
+		var root string
+
+		BeforeEach(func() {
+			var err error
+			root, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			root, err = filepath.EvalSymlinks(root)
+			Expect(err).Should(BeNil())
+
+			Expect(os.MkdirAll(filepath.Join(root, "etc"), 0755)).Should(BeNil())
+			Expect(os.MkdirAll(filepath.Join(root, "usr", "etc"), 0755)).Should(BeNil())
+			Expect(os.Symlink("/usr/etc/passwd", filepath.Join(root, "etc", "passwd"))).Should(BeNil())
+			Expect(os.Symlink("../../../../../../var/lib/shadow", filepath.Join(root, "etc", "shadow"))).Should(BeNil())
+			Expect(os.Symlink("/", filepath.Join(root, "host"))).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			os.Unsetenv(ENTITY_ENV_ROOT)
+			os.RemoveAll(root)
+		})
+
+		It("Doesn't escape from the root", func() {
+			p, err := SecureJoin(root, "/etc/passwd")
+			Expect(err).Should(BeNil())
+			Expect(p).Should(Equal(filepath.Join(root, "usr", "etc", "passwd")))
+
+			p, err = SecureJoin(root, "/etc/shadow")
+			Expect(err).Should(BeNil())
+			Expect(p).Should(Equal(filepath.Join(root, "var", "lib", "shadow")))
+
+			p, err = SecureJoin(root, "/host/../../etc/group")
+			Expect(err).Should(BeNil())
+			Expect(p).Should(Equal(filepath.Join(root, "etc", "group")))
+		})
+
+		It("Resolves the default files", func() {
+			os.Setenv(ENTITY_ENV_ROOT, root)
+
+			Expect(UserDefault("")).Should(Equal(filepath.Join(root, "usr", "etc", "passwd")))
+			Expect(GroupsDefault("/etc/group")).Should(Equal(filepath.Join(root, "etc", "group")))
+			Expect(LoginDefsDefault("")).Should(Equal(filepath.Join(root, "etc", "login.defs")))
+
+			// The paths already resolved are not changed.
+			Expect(GroupsDefault(GroupsDefault(""))).Should(Equal(filepath.Join(root, "etc", "group")))
+
+			err := UserPasswd{
+				Username: "foo", Password: "x", Uid: 1000, Gid: 1000,
+				Homedir: "/home/foo", Shell: "/bin/bash",
+			}.Create("")
+			Expect(err).Should(BeNil())
+
+			dat, err := ioutil.ReadFile(filepath.Join(root, "usr", "etc", "passwd"))
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(ContainSubstring("foo:x:1000:1000:"))
+		})
+	})
+})
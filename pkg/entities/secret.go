@@ -0,0 +1,128 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The reader of stdin is shared to read a line for every entity with
+// password_stdin.
+var (
+	stdinFile   *os.File
+	stdinReader *bufio.Reader
+)
+
+func readStdinLine() (string, error) {
+	if stdinReader == nil || stdinFile != os.Stdin {
+		stdinFile = os.Stdin
+		stdinReader = bufio.NewReader(os.Stdin)
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.Wrap(err, "Error on read password from stdin")
+	}
+	return line, nil
+}
+
+// trimSecret drops the final newline added by the editors and the
+// helpers.
+func trimSecret(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	return strings.TrimSuffix(s, "\r")
+}
+
+// hasSecret returns true if the entity references a secret.
+func (u Shadow) hasSecret() bool {
+	return u.PasswordFile != "" || u.PasswordEnv != "" ||
+		u.PasswordStdin || u.PasswordCmd != ""
+}
+
+// redactedSecret replaces the secrets on dry-run.
+const redactedSecret = "<redacted>"
+
+// checkSecretRefs returns an error if the entity references more
+// than one password.
+func (u Shadow) checkSecretRefs() error {
+	refs := 0
+	for _, ok := range []bool{u.PasswordFile != "", u.PasswordEnv != "",
+		u.PasswordStdin, u.PasswordCmd != ""} {
+		if ok {
+			refs++
+		}
+	}
+	if refs > 1 || (refs == 1 && u.Password != "") {
+		return errors.New(
+			"Only one of password, password_file, password_env, password_stdin and password_cmd could be defined for user " +
+				u.Username)
+	}
+	return nil
+}
+
+// isCryptHash returns true if the secret is already a crypt(3) hash.
+// The DES hashes are not recognized because they can't be
+// distinguished from a password of 13 characters.
+func isCryptHash(secret string) bool {
+	info, err := ParseHash(secret)
+	return err == nil && info.Method != HashDes
+}
+
+// secret returns the password referenced by the entity. The errors
+// never contain the secret.
+func (u Shadow) secret() (string, error) {
+	if err := u.checkSecretRefs(); err != nil {
+		return "", err
+	}
+
+	var ans string
+	switch {
+	case u.PasswordFile != "":
+		data, err := os.ReadFile(u.PasswordFile)
+		if err != nil {
+			return "", errors.Wrap(err, "Error on read password file of user "+u.Username)
+		}
+		ans = trimSecret(string(data))
+
+	case u.PasswordEnv != "":
+		v, ok := os.LookupEnv(u.PasswordEnv)
+		if !ok {
+			return "", errors.New("The env variable " + u.PasswordEnv +
+				" of the password of user " + u.Username + " is not defined")
+		}
+		ans = v
+
+	case u.PasswordStdin:
+		line, err := readStdinLine()
+		if err != nil {
+			return "", err
+		}
+		ans = trimSecret(line)
+
+	case u.PasswordCmd != "":
+		var stdout bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", u.PasswordCmd)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			return "", errors.Wrap(err, "Error on run password command of user "+u.Username)
+		}
+		ans = trimSecret(stdout.String())
+	}
+
+	if ans == "" {
+		return "", errors.New("Empty password for user " + u.Username)
+	}
+
+	return ans, nil
+}
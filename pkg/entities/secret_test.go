@@ -0,0 +1,165 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Password secrets", func() {
+	var tmpdir, shadow string
+
+	BeforeEach(func() {
+		var err error
+		tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+		Expect(err).Should(BeNil())
+		shadow = filepath.Join(tmpdir, "shadow")
+		Expect(ioutil.WriteFile(shadow, []byte(""), 0640)).Should(BeNil())
+		os.Setenv(ENTITY_ENV_HASH, HashSha256)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv(ENTITY_ENV_HASH)
+		os.RemoveAll(tmpdir)
+	})
+
+	verify := func(user, secret string) {
+		entries, err := ParseShadow(shadow)
+		Expect(err).Should(BeNil())
+		Expect(entries[user].Password).Should(HavePrefix("$5$"))
+		ok, err := VerifyPassword(secret, entries[user].Password)
+		Expect(err).Should(BeNil())
+		Expect(ok).Should(BeTrue())
+
+		data, err := ioutil.ReadFile(shadow)
+		Expect(err).Should(BeNil())
+		Expect(string(data)).ShouldNot(ContainSubstring(secret))
+	}
+
+	It("Reads the password from a file", func() {
+		f := filepath.Join(tmpdir, "secret")
+		Expect(ioutil.WriteFile(f, []byte("file-secret\n"), 0600)).Should(BeNil())
+		Expect(Shadow{Username: "foo", PasswordFile: f}.Apply(shadow, false)).Should(BeNil())
+		verify("foo", "file-secret")
+	})
+
+	It("Reads the password from an env variable", func() {
+		os.Setenv("ENTITIES_TEST_SECRET", "env-secret")
+		defer os.Unsetenv("ENTITIES_TEST_SECRET")
+		Expect(Shadow{Username: "foo", PasswordEnv: "ENTITIES_TEST_SECRET"}.Apply(shadow, false)).Should(BeNil())
+		verify("foo", "env-secret")
+
+		err := Shadow{Username: "bar", PasswordEnv: "ENTITIES_TEST_MISSING"}.Apply(shadow, false)
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("Reads a line of stdin for every user", func() {
+		r, w, err := os.Pipe()
+		Expect(err).Should(BeNil())
+		stdin := os.Stdin
+		os.Stdin = r
+		defer func() { os.Stdin = stdin }()
+
+		_, err = w.WriteString("first-secret\nsecond-secret\n")
+		Expect(err).Should(BeNil())
+		w.Close()
+
+		Expect(Shadow{Username: "foo", PasswordStdin: true}.Apply(shadow, false)).Should(BeNil())
+		Expect(Shadow{Username: "bar", PasswordStdin: true}.Apply(shadow, false)).Should(BeNil())
+		verify("foo", "first-secret")
+		verify("bar", "second-secret")
+
+		err = Shadow{Username: "baz", PasswordStdin: true}.Apply(shadow, false)
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("Reads the password from a command", func() {
+		Expect(Shadow{Username: "foo", PasswordCmd: "echo cmd-secret"}.Apply(shadow, false)).Should(BeNil())
+		verify("foo", "cmd-secret")
+
+		err := Shadow{Username: "bar", PasswordCmd: "exit 1"}.Apply(shadow, false)
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("Rejects the empty secrets and more sources", func() {
+		err := Shadow{Username: "foo", PasswordCmd: "true"}.Apply(shadow, false)
+		Expect(err).ShouldNot(BeNil())
+
+		err = Shadow{Username: "foo", Password: "secret", PasswordCmd: "echo secret"}.Apply(shadow, false)
+		Expect(err).ShouldNot(BeNil())
+		Expect(err.Error()).ShouldNot(ContainSubstring("echo"))
+	})
+
+	It("Hashes the secrets that are not a valid hash", func() {
+		os.Setenv("ENTITIES_TEST_SECRET", "$not-a-hash")
+		defer os.Unsetenv("ENTITIES_TEST_SECRET")
+		Expect(Shadow{Username: "foo", PasswordEnv: "ENTITIES_TEST_SECRET"}.Apply(shadow, false)).Should(BeNil())
+		verify("foo", "$not-a-hash")
+
+		Expect(Shadow{Username: "bar", PasswordCmd: "echo '*'"}.Apply(shadow, false)).Should(BeNil())
+		verify("bar", "*")
+
+		// A password of 13 characters like a DES hash.
+		Expect(Shadow{Username: "baz", PasswordCmd: "echo abcdefghijklm"}.Apply(shadow, false)).Should(BeNil())
+		verify("baz", "abcdefghijklm")
+	})
+
+	It("Maintains the secrets already hashed", func() {
+		h, err := NewHasher(HashSha256, 0)
+		Expect(err).Should(BeNil())
+		hash, err := h.Hash("hashed-secret")
+		Expect(err).Should(BeNil())
+
+		f := filepath.Join(tmpdir, "secret")
+		Expect(ioutil.WriteFile(f, []byte(hash+"\n"), 0600)).Should(BeNil())
+		Expect(Shadow{Username: "foo", PasswordFile: f}.Apply(shadow, false)).Should(BeNil())
+
+		entries, err := ParseShadow(shadow)
+		Expect(err).Should(BeNil())
+		Expect(entries["foo"].Password).Should(Equal(hash))
+	})
+
+	It("Doesn't read the secrets on dry-run", func() {
+		marker := filepath.Join(tmpdir, "marker")
+		tx, err := NewTransactionFromPaths(map[string]string{ShadowKind: shadow})
+		Expect(err).Should(BeNil())
+		defer tx.Rollback()
+		tx.SetDryRun(true)
+
+		err = tx.Apply(Shadow{Username: "foo", PasswordCmd: "touch " + marker + "; echo secret"}, false)
+		Expect(err).Should(BeNil())
+		_, err = os.Stat(marker)
+		Expect(os.IsNotExist(err)).Should(BeTrue())
+
+		plans, err := tx.Plan()
+		Expect(err).Should(BeNil())
+		Expect(len(plans)).Should(Equal(1))
+		Expect(plans[0].Diff).Should(ContainSubstring("+foo:<redacted>:"))
+
+		// The references are checked anyway.
+		err = tx.Apply(Shadow{Username: "bar", Password: "secret", PasswordStdin: true}, false)
+		Expect(err).ShouldNot(BeNil())
+
+		Expect(tx.Commit()).ShouldNot(BeNil())
+		data, err := ioutil.ReadFile(shadow)
+		Expect(err).Should(BeNil())
+		Expect(string(data)).Should(Equal(""))
+	})
+
+	It("Never writes the secret in the spec", func() {
+		s := Shadow{Username: "foo", PasswordFile: "/run/secrets/foo"}
+		m := s.ToMap()
+		Expect(m["password_file"]).Should(Equal("/run/secrets/foo"))
+		Expect(strings.Contains(s.String(), "/run/secrets")).Should(BeFalse())
+	})
+})
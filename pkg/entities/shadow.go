@@ -7,19 +7,10 @@ package entities
 
 import (
 	"bufio"
-	"bytes"
-	"fmt"
 	"io"
-	"io/ioutil"
-	"math/rand"
 	"os"
-	"strconv"
 	"strings"
-	"time"
 
-	"github.com/tredoe/osutil/user/crypt/sha512_crypt"
-
-	permbits "github.com/phayes/permbits"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
@@ -42,22 +33,37 @@ func ParseShadow(path string) (map[string]Shadow, error) {
 
 	defer file.Close()
 
-	return ParseReader(file)
+	return parseShadowReader(path, file)
 }
 
 // ParseReader consumes the contents of r and parses it into a map from
-// usernames to Entries
+// names to Entries. Comments, empty lines and NIS entries are skipped.
+// The malformed lines are reported as warnings and skipped or
+// rejected in strict mode.
 func ParseReader(r io.Reader) (map[string]Shadow, error) {
+	return parseShadowReader("", r)
+}
+
+func parseShadowReader(file string, r io.Reader) (map[string]Shadow, error) {
 	lines := bufio.NewReader(r)
 	entries := make(map[string]Shadow)
+	n := 0
 	for {
 		line, _, err := lines.ReadLine()
 		if err != nil {
 			break
 		}
-		name, entry, err := parseLine(string(copyBytes(line)))
+		n++
+		content := string(copyBytes(line))
+		if lineKey(content) == "" {
+			continue
+		}
+		name, entry, err := parseLine(content)
 		if err != nil {
-			return nil, err
+			if err = parseLineError(file, n, redactLine(content), err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		entries[name] = entry
 	}
@@ -67,10 +73,25 @@ func ParseReader(r io.Reader) (map[string]Shadow, error) {
 func parseLine(line string) (string, Shadow, error) {
 	fs := strings.Split(line, ":")
 	if len(fs) != 9 {
-		return "", Shadow{}, errors.New("Unexpected number of fields in /etc/shadow: found " + strconv.Itoa(len(fs)))
+		return "", Shadow{}, newFieldsNumberError(9, len(fs))
+	}
+
+	if fs[0] == "" {
+		return "", Shadow{}, newParseError(ParseErrorEmptyName, 1, "username",
+			"Empty username")
 	}
 
-	return fs[0], Shadow{fs[0], fs[1], fs[2], fs[3], fs[4], fs[5], fs[6], fs[7], fs[8]}, nil
+	return fs[0], Shadow{
+		Username:       fs[0],
+		Password:       fs[1],
+		LastChanged:    fs[2],
+		MinimumChanged: fs[3],
+		MaximumChanged: fs[4],
+		Warn:           fs[5],
+		Inactive:       fs[6],
+		Expire:         fs[7],
+		Reserved:       fs[8],
+	}, nil
 }
 
 func copyBytes(x []byte) []byte {
@@ -89,6 +110,18 @@ type Shadow struct {
 	Inactive       string `yaml:"inactive" json:"inactive"`
 	Expire         string `yaml:"expire" json:"expire"`
 	Reserved       string `yaml:"reserved" json:"reserved"`
+
+	// Method and rounds used to hash the clear password: yescrypt,
+	// bcrypt, sha512 or sha256.
+	Hash       string `yaml:"hash,omitempty" json:"hash,omitempty"`
+	HashRounds int    `yaml:"hash_rounds,omitempty" json:"hash_rounds,omitempty"`
+
+	// References to the secret used instead of the clear password. The
+	// secret is read and hashed on apply and it's never stored.
+	PasswordFile  string `yaml:"password_file,omitempty" json:"password_file,omitempty"`
+	PasswordEnv   string `yaml:"password_env,omitempty" json:"password_env,omitempty"`
+	PasswordStdin bool   `yaml:"password_stdin,omitempty" json:"password_stdin,omitempty"`
+	PasswordCmd   string `yaml:"password_cmd,omitempty" json:"password_cmd,omitempty"`
 }
 
 func (u Shadow) GetKind() string { return ShadowKind }
@@ -113,35 +146,35 @@ func ShadowDefault(s string) string {
 			s = "/etc/shadow"
 		}
 	}
-	return s
+	return RootPath(s)
 }
 
-const letterBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-
-func randStringBytes(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+// hasher returns the hasher of the clear password of the entity.
+func (u Shadow) hasher(db *Database) (Hasher, error) {
+	l, err := db.GetLoginDefs()
+	if err != nil {
+		return nil, err
 	}
-	return string(b)
-}
-
-func encryptPassword(userPassword string) (string, error) {
-	salt := []byte(fmt.Sprintf("$6$%s", randStringBytes(8)))
-	c := sha512_crypt.New()
-	hash, err := c.Generate([]byte(userPassword), salt)
+	method, err := HashMethod(u.Hash, l)
+	if err != nil {
+		return nil, err
+	}
+	rounds, err := HashRounds(method, u.HashRounds, l)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return string(hash), nil
+	return NewHasher(method, rounds)
 }
 
-func (u Shadow) prepare() Shadow {
-	if u.LastChanged == "now" {
-		// POST: Set in last_changed the current days from 1970
-		now := time.Now()
-		days := now.Unix() / 24 / 60 / 60
-		u.LastChanged = fmt.Sprintf("%d", days)
+func (u Shadow) prepare(db *Database) (Shadow, error) {
+	// POST: Convert now, the dates and the durations to the days of
+	// the shadow file.
+	u, err := u.NormalizeAging()
+	if err != nil {
+		return u, err
+	}
+	if u.hasSecret() {
+		return u.prepareSecret(db)
 	}
 	/*
 	 A password field which starts with an exclamation mark means
@@ -158,123 +191,130 @@ func (u Shadow) prepare() Shadow {
 	 may log in the system by other means).
 	*/
 	if !strings.HasPrefix(u.Password, "$") && u.Password != "" &&
-		!strings.HasPrefix(u.Password, "!") && u.Password != "*" {
-		if pwd, err := encryptPassword(u.Password); err == nil {
-			u.Password = pwd
+		!strings.HasPrefix(u.Password, "!") && u.Password != "*" &&
+		!(db.dryRun && u.Password == redactedSecret) {
+		h, err := u.hasher(db)
+		if err != nil {
+			return u, err
 		}
+		pwd, err := h.Hash(u.Password)
+		if err != nil {
+			return u, errors.Wrap(err, "Error on hash password of user "+u.Username)
+		}
+		u.Password = pwd
 	}
-	return u
+	return u, nil
 }
 
-// FIXME: Delete can be shared across all of the supported Entities
-func (u Shadow) Delete(s string) error {
-	s = ShadowDefault(s)
-	input, err := ioutil.ReadFile(s)
-	if err != nil {
-		return errors.Wrap(err, "Could not read input file")
-	}
-	permissions, err := permbits.Stat(s)
-	if err != nil {
-		return errors.Wrap(err, "Failed getting permissions")
+// prepareSecret replaces the references of the secret with the hash
+// of the password. The secret is always hashed unless it's already a
+// crypt(3) hash. On dry-run the secret is not read and it's replaced
+// by a placeholder.
+func (u Shadow) prepareSecret(db *Database) (Shadow, error) {
+	var pwd string
+	if db.dryRun {
+		if err := u.checkSecretRefs(); err != nil {
+			return u, err
+		}
+		pwd = redactedSecret
+	} else {
+		secret, err := u.secret()
+		if err != nil {
+			return u, err
+		}
+		pwd = secret
+		if !isCryptHash(secret) {
+			h, err := u.hasher(db)
+			if err != nil {
+				return u, err
+			}
+			pwd, err = h.Hash(secret)
+			if err != nil {
+				return u, errors.Wrap(err, "Error on hash password of user "+u.Username)
+			}
+		}
 	}
-	lines := bytes.Replace(input, []byte(u.String()+"\n"), []byte(""), 1)
 
-	err = ioutil.WriteFile(s, []byte(lines), os.FileMode(permissions))
-	if err != nil {
-		return errors.Wrap(err, "Could not write")
-	}
+	u.Password = pwd
+	u.PasswordFile, u.PasswordEnv, u.PasswordCmd = "", "", ""
+	u.PasswordStdin = false
+	return u, nil
+}
 
-	return nil
+// FIXME: Delete can be shared across all of the supported Entities
+func (u Shadow) Delete(s string) error {
+	s = ShadowDefault(s)
+	return updateDatabaseFile(ShadowKind, s, func(db *Database) error {
+		return u.dbDelete(db)
+	})
 }
 
-// FIXME: Create can be shared across all of the supported Entities
 func (u Shadow) Create(s string) error {
-	var f *os.File
-
 	s = ShadowDefault(s)
+	return updateDatabaseFile(ShadowKind, s, func(db *Database) error {
+		return u.dbCreate(db)
+	})
+}
 
-	u = u.prepare()
+func (u Shadow) Apply(s string, safe bool) error {
+	s = ShadowDefault(s)
+	return updateDatabaseFile(ShadowKind, s, func(db *Database) error {
+		return u.dbApply(db, safe)
+	})
+}
 
-	_, err := os.Stat(s)
-	if err == nil {
-		current, err := ParseShadow(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed parsing passwd")
-		}
-		if _, ok := current[u.Username]; ok {
-			return errors.New("Entity already present")
-		}
-		permissions, err := permbits.Stat(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed getting permissions")
-		}
-		f, err = os.OpenFile(s, os.O_APPEND|os.O_WRONLY, os.FileMode(permissions))
-		if err != nil {
-			return errors.Wrap(err, "Could not read")
-		}
-	} else if os.IsNotExist(err) {
-		f, err = os.OpenFile(s, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			return errors.Wrap(err, "Could not create the file")
-		}
-	} else {
-		return errors.Wrap(err, "Error on stat file")
+func (u Shadow) dbDelete(db *Database) error {
+	f, err := db.GetFile(ShadowKind)
+	if err != nil {
+		return err
 	}
-
-	defer f.Close()
-
-	if _, err = f.WriteString(u.String() + "\n"); err != nil {
-		return errors.Wrap(err, "Could not write")
+	if !f.Exists() {
+		return errors.New("Could not read input file " + f.GetPath())
 	}
-	return nil
+
+	// Drop the line which match the username.
+	return removeEntity(f, u.Username)
 }
 
-func (u Shadow) Apply(s string, safe bool) error {
-	s = ShadowDefault(s)
+func (u Shadow) dbCreate(db *Database) error {
+	u, err := u.prepare(db)
+	if err != nil {
+		return err
+	}
 
-	u = u.prepare()
+	f, err := db.GetFile(ShadowKind)
+	if err != nil {
+		return err
+	}
+	if f.Has(u.Username) {
+		return errors.New("Entity already present")
+	}
 
-	_, err := os.Stat(s)
-	if err == nil {
-		current, err := ParseShadow(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed parsing passwd")
-		}
-		permissions, err := permbits.Stat(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed getting permissions")
-		}
+	f.Set(u.Username, u.String())
 
-		if _, ok := current[u.Username]; ok {
-			input, err := ioutil.ReadFile(s)
-			if err != nil {
-				return errors.Wrap(err, "Could not read input file")
-			}
+	return nil
+}
 
-			lines := strings.Split(string(input), "\n")
+func (u Shadow) dbApply(db *Database, safe bool) error {
+	u, err := u.prepare(db)
+	if err != nil {
+		return err
+	}
 
-			for i, line := range lines {
-				if entityIdentifier(line) == u.Username && !safe {
-					lines[i] = u.String()
-				}
-			}
-			output := strings.Join(lines, "\n")
-			err = ioutil.WriteFile(s, []byte(output), os.FileMode(permissions))
-			if err != nil {
-				return errors.Wrap(err, "Could not write")
-			}
+	f, err := db.GetFile(ShadowKind)
+	if err != nil {
+		return err
+	}
 
-		} else {
-			// Add it
-			return u.Create(s)
+	if f.Has(u.Username) {
+		if !safe {
+			f.Set(u.Username, u.String())
 		}
-	} else if os.IsNotExist(err) {
-		return u.Create(s)
-	} else {
-		return errors.Wrap(err, "Could not stat file")
+		return nil
 	}
 
-	return nil
+	// Add it
+	return u.dbCreate(db)
 }
 
 func (s Shadow) Merge(e Entity) (Entity, error) {
@@ -301,6 +341,16 @@ func (s Shadow) Merge(e Entity) (Entity, error) {
 		s.Inactive = toMerge.Inactive
 	}
 
+	if toMerge.Expire != "" {
+		s.Expire = toMerge.Expire
+	}
+
+	// A last change equal to now is used only on creation, otherwise
+	// every merge resets the age of the password.
+	if toMerge.LastChanged != "" && toMerge.LastChanged != "now" {
+		s.LastChanged = toMerge.LastChanged
+	}
+
 	// NOTE: i avoid to change current password.
 	return s, nil
 }
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"regexp"
+	"sort"
 )
 
 type EntitiesStore struct {
@@ -16,6 +17,8 @@ type EntitiesStore struct {
 	Groups   map[string]Group
 	Shadows  map[string]Shadow
 	GShadows map[string]GShadow
+	SubUids  map[string]SubUid
+	SubGids  map[string]SubGid
 }
 
 func NewEntitiesStore() *EntitiesStore {
@@ -24,6 +27,8 @@ func NewEntitiesStore() *EntitiesStore {
 		Groups:   make(map[string]Group, 0),
 		Shadows:  make(map[string]Shadow, 0),
 		GShadows: make(map[string]GShadow, 0),
+		SubUids:  make(map[string]SubUid, 0),
+		SubGids:  make(map[string]SubGid, 0),
 	}
 }
 
@@ -71,6 +76,10 @@ func (s *EntitiesStore) AddEntity(e Entity) error {
 		err = s.AddShadow((e.(Shadow)))
 	case GShadowKind:
 		err = s.AddGShadow((e.(GShadow)))
+	case SubUidKind:
+		err = s.AddSubUid((e.(SubUid)))
+	case SubGidKind:
+		err = s.AddSubGid((e.(SubGid)))
 	default:
 		err = errors.New("Invalid entity")
 	}
@@ -150,6 +159,42 @@ func (s *EntitiesStore) AddGShadow(e GShadow) error {
 	return nil
 }
 
+func (s *EntitiesStore) AddSubUid(e SubUid) error {
+	if e.Username == "" {
+		return errors.New("Invalid username field")
+	}
+
+	if ne, ok := s.SubUids[e.Username]; ok {
+		newEntity, err := ne.Merge(e)
+		if err != nil {
+			return err
+		}
+		s.SubUids[e.Username] = newEntity.(SubUid)
+	} else {
+		s.SubUids[e.Username] = e
+	}
+
+	return nil
+}
+
+func (s *EntitiesStore) AddSubGid(e SubGid) error {
+	if e.Username == "" {
+		return errors.New("Invalid username field")
+	}
+
+	if ne, ok := s.SubGids[e.Username]; ok {
+		newEntity, err := ne.Merge(e)
+		if err != nil {
+			return err
+		}
+		s.SubGids[e.Username] = newEntity.(SubGid)
+	} else {
+		s.SubGids[e.Username] = e
+	}
+
+	return nil
+}
+
 func (s *EntitiesStore) GetShadow(name string) (Shadow, bool) {
 	if e, ok := s.Shadows[name]; ok {
 		return e, true
@@ -181,3 +226,74 @@ func (s *EntitiesStore) GetGroup(name string) (Group, bool) {
 		return Group{}, false
 	}
 }
+
+func (s *EntitiesStore) GetSubUid(name string) (SubUid, bool) {
+	if e, ok := s.SubUids[name]; ok {
+		return e, true
+	} else {
+		return SubUid{}, false
+	}
+}
+
+func (s *EntitiesStore) GetSubGid(name string) (SubGid, bool) {
+	if e, ok := s.SubGids[name]; ok {
+		return e, true
+	} else {
+		return SubGid{}, false
+	}
+}
+
+// Names returns the names of all the entities of the store sorted by
+// priority and then by name. The priority of a name is the lowest
+// priority of its user and group.
+func (s *EntitiesStore) Names() []string {
+	priorities := make(map[string]int, 0)
+
+	setPriority := func(name string, p int) {
+		if cur, ok := priorities[name]; !ok || p < cur {
+			priorities[name] = p
+		}
+	}
+
+	for k, u := range s.Users {
+		setPriority(k, u.Priority)
+	}
+	for k, g := range s.Groups {
+		setPriority(k, g.Priority)
+	}
+
+	// The other entities use the priority of the user or group
+	// with the same name or the default priority.
+	others := []string{}
+	for k := range s.Shadows {
+		others = append(others, k)
+	}
+	for k := range s.GShadows {
+		others = append(others, k)
+	}
+	for k := range s.SubUids {
+		others = append(others, k)
+	}
+	for k := range s.SubGids {
+		others = append(others, k)
+	}
+	for _, k := range others {
+		if _, ok := priorities[k]; !ok {
+			priorities[k] = 0
+		}
+	}
+
+	ans := []string{}
+	for k := range priorities {
+		ans = append(ans, k)
+	}
+
+	sort.Slice(ans, func(i, j int) bool {
+		if priorities[ans[i]] != priorities[ans[j]] {
+			return priorities[ans[i]] < priorities[ans[j]]
+		}
+		return ans[i] < ans[j]
+	})
+
+	return ans
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Strategies used to merge the specs with the current entities.
+const (
+	// Add the members of the spec to the current members and
+	// maintain the current uid, gid and password. It's the default.
+	MergeStrategyUnion = "union"
+	// Replace the current members, uid, gid and password with the
+	// values of the spec.
+	MergeStrategyReplace = "replace"
+	// Remove the members of the spec from the current members.
+	MergeStrategyRemove = "remove"
+)
+
+// CheckMergeStrategy returns an error if the strategy is not valid. An
+// empty strategy is handled as union.
+func CheckMergeStrategy(s string) error {
+	switch s {
+	case "", MergeStrategyUnion, MergeStrategyReplace, MergeStrategyRemove:
+		return nil
+	}
+	return errors.New("Invalid merge strategy " + s + ": expected union, replace or remove")
+}
+
+// CheckUserMergeStrategy returns an error if the strategy is not
+// valid for the users. The users don't have members to remove.
+func CheckUserMergeStrategy(s string) error {
+	if s == MergeStrategyRemove {
+		return errors.New("Invalid merge strategy " + s + " for users: expected union or replace")
+	}
+	return CheckMergeStrategy(s)
+}
+
+// SetMergeStrategy sets the strategy of the users, groups and gshadow
+// entities without a strategy. The remove strategy is set only on
+// the groups and gshadow entities.
+func (s *EntitiesStore) SetMergeStrategy(strategy string) error {
+	err := CheckMergeStrategy(strategy)
+	if err != nil {
+		return err
+	}
+
+	for k, e := range s.Users {
+		if e.MergeStrategy == "" && strategy != MergeStrategyRemove {
+			e.MergeStrategy = strategy
+			s.Users[k] = e
+		}
+	}
+	for k, e := range s.Groups {
+		if e.MergeStrategy == "" {
+			e.MergeStrategy = strategy
+			s.Groups[k] = e
+		}
+	}
+	for k, e := range s.GShadows {
+		if e.MergeStrategy == "" {
+			e.MergeStrategy = strategy
+			s.GShadows[k] = e
+		}
+	}
+
+	return nil
+}
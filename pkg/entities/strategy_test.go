@@ -0,0 +1,173 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Merge strategy", func() {
+	Context("Merging the specs", func() {
+		It("Rejects invalid strategies", func() {
+			Expect(CheckMergeStrategy("")).Should(BeNil())
+			Expect(CheckMergeStrategy(MergeStrategyRemove)).Should(BeNil())
+			Expect(CheckMergeStrategy("append")).ShouldNot(BeNil())
+
+			_, err := UserPasswd{Username: "foo"}.Merge(
+				UserPasswd{Username: "foo", MergeStrategy: "append"})
+			Expect(err).ShouldNot(BeNil())
+		})
+
+		It("Rejects the remove strategy for the users", func() {
+			Expect(CheckUserMergeStrategy(MergeStrategyReplace)).Should(BeNil())
+			Expect(CheckUserMergeStrategy(MergeStrategyRemove)).ShouldNot(BeNil())
+
+			_, err := UserPasswd{Username: "foo", Uid: 1000}.Merge(
+				UserPasswd{Username: "foo", Uid: 1000, MergeStrategy: MergeStrategyRemove})
+			Expect(err).ShouldNot(BeNil())
+
+			err = NewDatabase("", "", "", "").Apply(
+				UserPasswd{Username: "foo", Uid: 1000, MergeStrategy: MergeStrategyRemove}, false)
+			Expect(err).ShouldNot(BeNil())
+
+			// The option of the merge command doesn't set it on the users.
+			store := NewEntitiesStore()
+			Expect(store.AddUser(UserPasswd{Username: "foo", Uid: 1000})).Should(BeNil())
+			Expect(store.AddGroup(Group{Name: "wheel"})).Should(BeNil())
+			Expect(store.SetMergeStrategy(MergeStrategyRemove)).Should(BeNil())
+			Expect(store.Users["foo"].MergeStrategy).Should(Equal(""))
+			Expect(store.Groups["wheel"].MergeStrategy).Should(Equal(MergeStrategyRemove))
+		})
+
+		It("Merges the group users", func() {
+			gid := 10
+			cur := Group{Name: "wheel", Gid: &gid, Users: "root,foo"}
+
+			g, err := cur.Merge(Group{Name: "wheel", Users: "bar"})
+			Expect(err).Should(BeNil())
+			Expect(g.(Group).Users).Should(Equal("bar,foo,root"))
+
+			g, err = cur.Merge(Group{Name: "wheel", Users: "bar",
+				MergeStrategy: MergeStrategyReplace})
+			Expect(err).Should(BeNil())
+			Expect(g.(Group).Users).Should(Equal("bar"))
+
+			g, err = cur.Merge(Group{Name: "wheel", Users: "root",
+				MergeStrategy: MergeStrategyRemove})
+			Expect(err).Should(BeNil())
+			Expect(g.(Group).Users).Should(Equal("foo"))
+		})
+
+		It("Merges the gshadow administrators and members", func() {
+			cur := GShadow{Name: "wheel", Administrators: "root", Members: "root,foo"}
+
+			s, err := cur.Merge(GShadow{Name: "wheel", Members: "bar",
+				MergeStrategy: MergeStrategyReplace})
+			Expect(err).Should(BeNil())
+			Expect(s.(GShadow).Administrators).Should(Equal(""))
+			Expect(s.(GShadow).Members).Should(Equal("bar"))
+
+			s, err = cur.Merge(GShadow{Name: "wheel", Administrators: "root",
+				Members: "foo", MergeStrategy: MergeStrategyRemove})
+			Expect(err).Should(BeNil())
+			Expect(s.(GShadow).Administrators).Should(Equal(""))
+			Expect(s.(GShadow).Members).Should(Equal("root"))
+		})
+
+		It("Replaces the uid, gid and password of the user", func() {
+			cur := UserPasswd{Username: "foo", Password: "x", Uid: 1000, Gid: 1000}
+			spec := UserPasswd{Username: "foo", Password: "y", Uid: 2000, Gid: 2001}
+
+			u, err := cur.Merge(spec)
+			Expect(err).Should(BeNil())
+			Expect(u.(UserPasswd).Uid).Should(Equal(1000))
+			Expect(u.(UserPasswd).Gid).Should(Equal(1000))
+			Expect(u.(UserPasswd).Password).Should(Equal("x"))
+
+			spec.MergeStrategy = MergeStrategyReplace
+			u, err = cur.Merge(spec)
+			Expect(err).Should(BeNil())
+			Expect(u.(UserPasswd).Uid).Should(Equal(2000))
+			Expect(u.(UserPasswd).Gid).Should(Equal(2001))
+			Expect(u.(UserPasswd).Password).Should(Equal("y"))
+		})
+
+		It("Sets the strategy of the specs without it", func() {
+			store := NewEntitiesStore()
+			Expect(store.AddGroup(Group{Name: "wheel"})).Should(BeNil())
+			Expect(store.AddGroup(Group{Name: "audio",
+				MergeStrategy: MergeStrategyUnion})).Should(BeNil())
+
+			Expect(store.SetMergeStrategy("append")).ShouldNot(BeNil())
+			Expect(store.SetMergeStrategy(MergeStrategyReplace)).Should(BeNil())
+			Expect(store.Groups["wheel"].MergeStrategy).Should(Equal(MergeStrategyReplace))
+			Expect(store.Groups["audio"].MergeStrategy).Should(Equal(MergeStrategyUnion))
+		})
+	})
+
+	Context("Applying the specs", func() {
+		var tmpdir, group, gshadow string
+
+		BeforeEach(func() {
+			var err error
+			tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+
+			_, group, _, gshadow = writeTxFiles(tmpdir, "", "wheel:x:10:root,foo\n", "",
+				"wheel::root:root,foo\n")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpdir)
+		})
+
+		It("Replaces and removes the group members", func() {
+			err := Group{Name: "wheel", Users: "bar",
+				MergeStrategy: MergeStrategyReplace}.Apply(group, false)
+			Expect(err).Should(BeNil())
+			Expect(readFile(group)).Should(Equal("wheel:x:10:bar\n"))
+			Expect(readFile(gshadow)).Should(Equal("wheel::root:bar\n"))
+
+			err = Group{Name: "wheel", Users: "bar",
+				MergeStrategy: MergeStrategyRemove}.Apply(group, false)
+			Expect(err).Should(BeNil())
+			Expect(readFile(group)).Should(Equal("wheel:x:10:\n"))
+			Expect(readFile(gshadow)).Should(Equal("wheel::root:\n"))
+		})
+
+		It("Uses the allocation options of the users only on creation", func() {
+			passwd := filepath.Join(tmpdir, "passwd")
+			Expect(ioutil.WriteFile(passwd, []byte("foo:x:1000:10:foo:/:/bin/sh\n"), 0644)).Should(BeNil())
+
+			spec := UserPasswd{Username: "foo", Uid: -1, Gid: -1, Shell: "/bin/bash",
+				System: true, UidRange: "500-600", CreateGroup: true, Priority: 10}
+			u, err := UserPasswd{Username: "foo", Password: "x", Uid: 1000, Gid: 10, Info: "foo",
+				Homedir: "/", Shell: "/bin/sh"}.Merge(spec)
+			Expect(err).Should(BeNil())
+			Expect(u).Should(Equal(UserPasswd{Username: "foo", Password: "x", Uid: 1000,
+				Gid: 10, Info: "foo", Homedir: "/", Shell: "/bin/bash"}))
+
+			db := NewDatabase(passwd, group, "", gshadow)
+			Expect(db.Apply(u, false)).Should(BeNil())
+			Expect(db.Save()).Should(BeNil())
+			Expect(readFile(passwd)).Should(Equal("foo:x:1000:10:foo:/:/bin/bash\n"))
+			Expect(readFile(group)).Should(Equal("wheel:x:10:root,foo\n"))
+		})
+
+		It("Removes the gshadow members", func() {
+			err := GShadow{Name: "wheel", Members: "foo",
+				MergeStrategy: MergeStrategyRemove}.Apply(gshadow, false)
+			Expect(err).Should(BeNil())
+			Expect(readFile(gshadow)).Should(Equal("wheel::root:root\n"))
+		})
+	})
+})
@@ -0,0 +1,448 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Default values of shadow-utils for the subordinate ids.
+const (
+	defaultSubIdMin   = 100000
+	defaultSubIdMax   = 600100000
+	defaultSubIdCount = 65536
+)
+
+func SubUidDefault(s string) string {
+	if s == "" {
+		s = os.Getenv(ENTITY_ENV_DEF_SUBUID)
+		if s == "" {
+			s = "/etc/subuid"
+		}
+	}
+	return RootPath(s)
+}
+
+func SubGidDefault(s string) string {
+	if s == "" {
+		s = os.Getenv(ENTITY_ENV_DEF_SUBGID)
+		if s == "" {
+			s = "/etc/subgid"
+		}
+	}
+	return RootPath(s)
+}
+
+// SubId is a range of subordinate ids of an user. A Start lower or
+// equal to zero means a range allocated dynamically and a Count
+// equal to zero the count defined in login.defs.
+type SubId struct {
+	Username string `yaml:"username" json:"username"`
+	Start    int    `yaml:"start" json:"start"`
+	Count    int    `yaml:"count" json:"count"`
+}
+
+// SubUid is a range of the subordinate uids of /etc/subuid.
+type SubUid struct {
+	SubId `yaml:",inline"`
+}
+
+// SubGid is a range of the subordinate gids of /etc/subgid.
+type SubGid struct {
+	SubId `yaml:",inline"`
+}
+
+// ParseSubUid opens the file and parses it into a map from usernames to
+// Entries. Only the first range of every user is returned.
+func ParseSubUid(path string) (map[string]SubUid, error) {
+	ans := make(map[string]SubUid)
+	ranges, err := parseSubIdFile(path)
+	if err != nil {
+		return ans, err
+	}
+	for name, s := range ranges {
+		ans[name] = SubUid{s}
+	}
+	return ans, nil
+}
+
+// ParseSubGid opens the file and parses it into a map from usernames to
+// Entries. Only the first range of every user is returned.
+func ParseSubGid(path string) (map[string]SubGid, error) {
+	ans := make(map[string]SubGid)
+	ranges, err := parseSubIdFile(path)
+	if err != nil {
+		return ans, err
+	}
+	for name, s := range ranges {
+		ans[name] = SubGid{s}
+	}
+	return ans, nil
+}
+
+func parseSubIdFile(path string) (map[string]SubId, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		ans := make(map[string]SubId, 0)
+		if os.IsNotExist(err) {
+			return ans, nil
+		}
+		return ans, errors.Wrap(err, "Failed check file "+path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return parseSubIdReader(path, file)
+}
+
+// ParseSubIdReader consumes the contents of r and parses it into a map from
+// usernames to Entries. Only the first range of every user is returned.
+// Comments and empty lines are skipped. The malformed lines are reported
+// as warnings and skipped or rejected in strict mode.
+func ParseSubIdReader(r io.Reader) (map[string]SubId, error) {
+	return parseSubIdReader("", r)
+}
+
+func parseSubIdReader(file string, r io.Reader) (map[string]SubId, error) {
+	lines := bufio.NewReader(r)
+	entries := make(map[string]SubId)
+	n := 0
+	for {
+		line, _, err := lines.ReadLine()
+		if err != nil {
+			break
+		}
+		n++
+		content := string(copyBytes(line))
+		if lineKey(content) == "" {
+			continue
+		}
+		entry, err := parseSubIdLine(content)
+		if err != nil {
+			if err = parseLineError(file, n, content, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, ok := entries[entry.Username]; !ok {
+			entries[entry.Username] = entry
+		}
+	}
+	return entries, nil
+}
+
+func parseSubIdLine(line string) (SubId, error) {
+	fs := strings.Split(line, ":")
+	if len(fs) != 3 {
+		return SubId{}, newFieldsNumberError(3, len(fs))
+	}
+
+	if fs[0] == "" {
+		return SubId{}, newParseError(ParseErrorEmptyName, 1, "username",
+			"Empty username")
+	}
+
+	start, err := strconv.Atoi(fs[1])
+	if err != nil || start < 0 {
+		return SubId{}, newParseError(ParseErrorInvalidId, 2, "start",
+			fmt.Sprintf("Invalid start '%s' for user %s", fs[1], fs[0]))
+	}
+	count, err := strconv.Atoi(fs[2])
+	if err != nil || count <= 0 {
+		return SubId{}, newParseError(ParseErrorInvalidId, 3, "count",
+			fmt.Sprintf("Invalid count '%s' for user %s", fs[2], fs[0]))
+	}
+
+	return SubId{
+		Username: fs[0],
+		Start:    start,
+		Count:    count,
+	}, nil
+}
+
+func (s SubId) String() string {
+	return strings.Join([]string{
+		s.Username,
+		strconv.Itoa(s.Start),
+		strconv.Itoa(s.Count),
+	}, ":")
+}
+
+// End returns the last id of the range.
+func (s SubId) End() int {
+	return s.Start + s.Count - 1
+}
+
+// Overlaps returns true if the two ranges have ids in common.
+func (s SubId) Overlaps(o SubId) bool {
+	return s.Start <= o.End() && o.Start <= s.End()
+}
+
+// subIdRanges returns all the ranges of the file sorted by start.
+func subIdRanges(f *DatabaseFile) []SubId {
+	ans := []SubId{}
+	for _, line := range f.Lines() {
+		if lineKey(line) == "" {
+			continue
+		}
+		if s, err := parseSubIdLine(line); err == nil {
+			ans = append(ans, s)
+		}
+	}
+	sort.SliceStable(ans, func(i, j int) bool {
+		return ans[i].Start < ans[j].Start
+	})
+	return ans
+}
+
+// subIdGetFreeStart returns the lowest start of the range r where count
+// ids are not used by the ranges of other users.
+func subIdGetFreeStart(f *DatabaseFile, r IdRange, count int) (int, error) {
+	start := r.Min
+	for _, s := range subIdRanges(f) {
+		if start+count-1 < s.Start {
+			break
+		}
+		if s.End() >= start {
+			start = s.End() + 1
+		}
+	}
+
+	if start+count-1 > r.Max {
+		return -1, errors.New(fmt.Sprintf(
+			"No free range of %d ids found in range %s", count, r))
+	}
+
+	return start, nil
+}
+
+func (s SubId) prepare(db *Database, kind string) (SubId, error) {
+	if s.Count > 0 && s.Start > 0 {
+		return s, nil
+	}
+
+	l, err := db.GetLoginDefs()
+	if err != nil {
+		return s, err
+	}
+	r, count := l.SubIdRange(kind)
+
+	if s.Count <= 0 {
+		s.Count = count
+	}
+
+	if s.Start <= 0 {
+		f, err := db.GetFile(kind)
+		if err != nil {
+			return s, err
+		}
+
+		if line, ok := f.Get(s.Username); ok {
+			// Maintain the range already assigned if it's
+			// big enough.
+			if cur, err := parseSubIdLine(line); err == nil && cur.Count >= s.Count {
+				s.Start = cur.Start
+				s.Count = cur.Count
+				return s, nil
+			}
+		}
+
+		start, err := subIdGetFreeStart(f, r, s.Count)
+		if err != nil {
+			return s, err
+		}
+		s.Start = start
+	}
+
+	return s, nil
+}
+
+func (s SubId) dbDelete(db *Database, kind string) error {
+	f, err := db.GetFile(kind)
+	if err != nil {
+		return err
+	}
+	if !f.Exists() {
+		return errors.New("Could not read input file " + f.GetPath())
+	}
+
+	// Drop all the ranges of the user.
+	err = removeEntity(f, s.Username)
+	if err != nil {
+		return err
+	}
+	for f.Remove(s.Username) {
+	}
+
+	return nil
+}
+
+func (s SubId) dbCreate(db *Database, kind string) error {
+	f, err := db.GetFile(kind)
+	if err != nil {
+		return err
+	}
+	if f.Has(s.Username) {
+		return errors.New("Entity already present")
+	}
+
+	s, err = s.prepare(db, kind)
+	if err != nil {
+		return errors.Wrap(err, "Failed entity preparation")
+	}
+
+	f.Set(s.Username, s.String())
+
+	return nil
+}
+
+func (s SubId) dbApply(db *Database, kind string, safe bool) error {
+	if s.Username == "" {
+		return errors.New("Empty username field")
+	}
+
+	f, err := db.GetFile(kind)
+	if err != nil {
+		return err
+	}
+
+	if f.Has(s.Username) && safe {
+		// Maintain the existing range.
+		return nil
+	}
+
+	s, err = s.prepare(db, kind)
+	if err != nil {
+		return errors.Wrap(err, "Failed entity preparation")
+	}
+
+	if safe {
+		for _, o := range subIdRanges(f) {
+			if o.Username != s.Username && o.Overlaps(s) {
+				return errors.New(fmt.Sprintf(
+					"Range %d-%d overlaps the range of the user %s",
+					s.Start, s.End(), o.Username))
+			}
+		}
+	}
+
+	f.Set(s.Username, s.String())
+
+	return nil
+}
+
+func (s SubId) merge(o SubId) SubId {
+	// Maintains the original range if not defined.
+	if o.Start > 0 {
+		s.Start = o.Start
+	}
+	if o.Count > 0 {
+		s.Count = o.Count
+	}
+	return s
+}
+
+func subIdToMap(s interface{}, kind string) map[interface{}]interface{} {
+	ans := make(map[interface{}]interface{}, 0)
+	d, _ := yaml.Marshal(s)
+	yaml.Unmarshal(d, &ans)
+	ans["kind"] = kind
+
+	return ans
+}
+
+func (s SubUid) GetKind() string { return SubUidKind }
+
+func (s SubUid) Delete(file string) error {
+	file = SubUidDefault(file)
+	return updateDatabaseFile(SubUidKind, file, func(db *Database) error {
+		return s.dbDelete(db)
+	})
+}
+
+func (s SubUid) Create(file string) error {
+	file = SubUidDefault(file)
+	return updateDatabaseFile(SubUidKind, file, func(db *Database) error {
+		return s.dbCreate(db)
+	})
+}
+
+func (s SubUid) Apply(file string, safe bool) error {
+	file = SubUidDefault(file)
+	return updateDatabaseFile(SubUidKind, file, func(db *Database) error {
+		return s.dbApply(db, safe)
+	})
+}
+
+func (s SubUid) dbDelete(db *Database) error { return s.SubId.dbDelete(db, SubUidKind) }
+func (s SubUid) dbCreate(db *Database) error { return s.SubId.dbCreate(db, SubUidKind) }
+func (s SubUid) dbApply(db *Database, safe bool) error {
+	return s.SubId.dbApply(db, SubUidKind, safe)
+}
+
+func (s SubUid) Merge(e Entity) (Entity, error) {
+	if e.GetKind() != SubUidKind {
+		return s, errors.New("merge possible only for entities of the same kind")
+	}
+	return SubUid{s.SubId.merge(e.(SubUid).SubId)}, nil
+}
+
+func (s SubUid) ToMap() map[interface{}]interface{} {
+	return subIdToMap(&s, s.GetKind())
+}
+
+func (s SubGid) GetKind() string { return SubGidKind }
+
+func (s SubGid) Delete(file string) error {
+	file = SubGidDefault(file)
+	return updateDatabaseFile(SubGidKind, file, func(db *Database) error {
+		return s.dbDelete(db)
+	})
+}
+
+func (s SubGid) Create(file string) error {
+	file = SubGidDefault(file)
+	return updateDatabaseFile(SubGidKind, file, func(db *Database) error {
+		return s.dbCreate(db)
+	})
+}
+
+func (s SubGid) Apply(file string, safe bool) error {
+	file = SubGidDefault(file)
+	return updateDatabaseFile(SubGidKind, file, func(db *Database) error {
+		return s.dbApply(db, safe)
+	})
+}
+
+func (s SubGid) dbDelete(db *Database) error { return s.SubId.dbDelete(db, SubGidKind) }
+func (s SubGid) dbCreate(db *Database) error { return s.SubId.dbCreate(db, SubGidKind) }
+func (s SubGid) dbApply(db *Database, safe bool) error {
+	return s.SubId.dbApply(db, SubGidKind, safe)
+}
+
+func (s SubGid) Merge(e Entity) (Entity, error) {
+	if e.GetKind() != SubGidKind {
+		return s, errors.New("merge possible only for entities of the same kind")
+	}
+	return SubGid{s.SubId.merge(e.(SubGid).SubId)}, nil
+}
+
+func (s SubGid) ToMap() map[interface{}]interface{} {
+	return subIdToMap(&s, s.GetKind())
+}
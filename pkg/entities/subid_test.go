@@ -0,0 +1,138 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SubId", func() {
+	Context("Parse subuid", func() {
+
+		It("Returns the first range of the users", func() {
+			ranges, err := ParseSubIdReader(strings.NewReader(`# comment
+foo:100000:65536
+bar:165536:65536
+foo:300000:1000
+`))
+			Expect(err).Should(BeNil())
+			Expect(len(ranges)).Should(Equal(2))
+			Expect(ranges["foo"]).Should(Equal(SubId{
+				Username: "foo", Start: 100000, Count: 65536,
+			}))
+			Expect(ranges["bar"].End()).Should(Equal(231071))
+		})
+
+		It("Rejects invalid lines in strict mode", func() {
+			os.Setenv(ENTITY_ENV_STRICT, "true")
+			defer os.Unsetenv(ENTITY_ENV_STRICT)
+
+			_, err := ParseSubIdReader(strings.NewReader("foo:abc:65536\n"))
+			Expect(err).ShouldNot(BeNil())
+		})
+
+		It("Reports the path of the file with the malformed line", func() {
+			os.Setenv(ENTITY_ENV_STRICT, "true")
+			defer os.Unsetenv(ENTITY_ENV_STRICT)
+
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			subgid := filepath.Join(tmpdir, "subgid")
+			err = ioutil.WriteFile(subgid, []byte("foo:100000:65536\nbar:165536\n"), 0644)
+			Expect(err).Should(BeNil())
+
+			_, err = ParseSubGid(subgid)
+			Expect(err).ShouldNot(BeNil())
+			Expect(err.Error()).Should(HavePrefix(subgid + ":2: "))
+			Expect(err.Error()).ShouldNot(ContainSubstring("/etc/"))
+		})
+	})
+
+	Context("Allocate subordinate ids", func() {
+		var tmpdir string
+		var subuid string
+
+		BeforeEach(func() {
+			var err error
+			tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+
+			// Use the shadow-utils defaults.
+			os.Setenv(ENTITY_ENV_DEF_LOGIN_DEFS, filepath.Join(tmpdir, "login.defs"))
+
+			subuid = filepath.Join(tmpdir, "subuid")
+			err = ioutil.WriteFile(subuid, []byte("foo:100000:65536\n"), 0644)
+			Expect(err).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			os.Unsetenv(ENTITY_ENV_DEF_LOGIN_DEFS)
+			os.RemoveAll(tmpdir)
+		})
+
+		It("Allocates a range not overlapping", func() {
+			err := SubUid{SubId{Username: "bar"}}.Create(subuid)
+			Expect(err).Should(BeNil())
+
+			ranges, err := ParseSubUid(subuid)
+			Expect(err).Should(BeNil())
+			Expect(ranges["bar"].SubId).Should(Equal(SubId{
+				Username: "bar", Start: 165536, Count: 65536,
+			}))
+		})
+
+		It("Maintains the existing range", func() {
+			err := SubUid{SubId{Username: "foo"}}.Apply(subuid, false)
+			Expect(err).Should(BeNil())
+
+			data, err := ioutil.ReadFile(subuid)
+			Expect(err).Should(BeNil())
+			Expect(string(data)).Should(Equal("foo:100000:65536\n"))
+		})
+
+		It("Rejects overlapping ranges in safe mode", func() {
+			err := SubUid{SubId{Username: "bar", Start: 150000, Count: 65536}}.Apply(subuid, true)
+			Expect(err).ShouldNot(BeNil())
+		})
+
+		It("Deletes all the ranges of the user", func() {
+			err := ioutil.WriteFile(subuid, []byte(
+				"foo:100000:65536\nbar:165536:65536\nfoo:300000:1000\n"), 0644)
+			Expect(err).Should(BeNil())
+
+			err = SubUid{SubId{Username: "foo"}}.Delete(subuid)
+			Expect(err).Should(BeNil())
+
+			data, err := ioutil.ReadFile(subuid)
+			Expect(err).Should(BeNil())
+			Expect(string(data)).Should(Equal("bar:165536:65536\n"))
+		})
+	})
+
+	Context("Read specs", func() {
+
+		It("Reads a subgid entity", func() {
+			p := &Parser{}
+			e, err := p.ReadEntityFromBytes([]byte(`kind: subgid
+username: foo
+count: 1000
+`))
+			Expect(err).Should(BeNil())
+			Expect(e.GetKind()).Should(Equal(SubGidKind))
+			Expect(e.(SubGid).Count).Should(Equal(1000))
+			Expect(e.(SubGid).Start).Should(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,466 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Transaction stages the changes of the passwd, group, shadow, gshadow,
+// subuid and subgid files and writes all of them or none on Commit.
+//
+// The changes are applied in memory through the Database. The managed
+// files are locked and loaded on creation and remain locked until
+// Commit or Rollback.
+type Transaction struct {
+	db      *Database
+	managed map[string]bool
+	lock    *FilesLock
+	touched map[string]map[string]bool
+	idLock  *IdLock
+}
+
+// Kinds of the files managed by a transaction in the order used to
+// write them.
+var txKinds = []string{
+	UserKind, GroupKind, ShadowKind, GShadowKind, SubUidKind, SubGidKind,
+}
+
+// EntityKinds returns the kinds of the files that the operations on
+// the entity could modify: the users with create_group write the
+// primary group in the group and gshadow files and the groups that
+// remove or replace the members update gshadow too.
+func EntityKinds(e Entity) []string {
+	ans := []string{e.GetKind()}
+	switch v := e.(type) {
+	case UserPasswd:
+		if v.CreateGroup {
+			ans = append(ans, GroupKind, GShadowKind)
+		}
+	case Group:
+		if v.updatesGShadow() {
+			ans = append(ans, GShadowKind)
+		}
+	}
+	return ans
+}
+
+// NewTransaction locks the files and loads them. Empty paths are
+// resolved with the default files.
+func NewTransaction(usersFile, groupsFile, shadowFile, gShadowFile string) (*Transaction, error) {
+	return newTransaction(NewDatabase(usersFile, groupsFile, shadowFile, gShadowFile),
+		[]string{UserKind, GroupKind, ShadowKind, GShadowKind})
+}
+
+// NewTransactionFromPaths creates a transaction that manages the files
+// of the kinds present in the map. Empty paths are resolved with the
+// default files.
+func NewTransactionFromPaths(paths map[string]string) (*Transaction, error) {
+	kinds := []string{}
+	for _, kind := range txKinds {
+		if _, ok := paths[kind]; ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	if len(kinds) != len(paths) {
+		return nil, errors.New("Unsupported entity kind in transaction paths")
+	}
+
+	return newTransaction(newDatabase(paths), kinds)
+}
+
+// NewEntityTransaction creates a transaction that manages only the
+// file of the entity kind. The other files are only read from the
+// default paths.
+func NewEntityTransaction(kind, file string) (*Transaction, error) {
+	if !stringInSlice(kind, txKinds) {
+		return nil, errors.New("Unsupported entity kind " + kind)
+	}
+
+	return newTransaction(newDatabase(map[string]string{kind: file}),
+		[]string{kind})
+}
+
+func newTransaction(db *Database, kinds []string) (*Transaction, error) {
+	ans := &Transaction{
+		db:      db,
+		managed: make(map[string]bool),
+		touched: make(map[string]map[string]bool),
+	}
+
+	paths := []string{}
+	for _, kind := range kinds {
+		ans.managed[kind] = true
+		paths = append(paths, db.GetPath(kind))
+	}
+
+	lock, err := LockFiles(paths...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error on lock files")
+	}
+	ans.lock = lock
+
+	// Load the files with the lock acquired.
+	for _, kind := range kinds {
+		_, err = db.GetFile(kind)
+		if err != nil {
+			ans.release()
+			return nil, err
+		}
+	}
+
+	return ans, nil
+}
+
+// GetFile returns the path of the real file of the kind.
+func (t *Transaction) GetFile(kind string) string {
+	return t.db.GetPath(kind)
+}
+
+// GetDatabase returns the database with the staged changes.
+func (t *Transaction) GetDatabase() *Database {
+	return t.db
+}
+
+func (t *Transaction) check(e Entity) error {
+	if t.lock == nil {
+		return errors.New("Transaction already closed")
+	}
+	if !t.managed[e.GetKind()] {
+		return errors.New("Unsupported entity kind " + e.GetKind())
+	}
+	return nil
+}
+
+func (t *Transaction) touch(e Entity) {
+	name := entityIdentifier(e.String())
+	if _, ok := t.touched[e.GetKind()]; !ok {
+		t.touched[e.GetKind()] = make(map[string]bool)
+	}
+	t.touched[e.GetKind()][name] = true
+}
+
+// SetIdLock sets the lock of the dynamic ids. The dynamic entities
+// applied or created reuse the ids of the lock if they are free and
+// the ids assigned are stored in the lock.
+func (t *Transaction) SetIdLock(l *IdLock) {
+	t.idLock = l
+}
+
+// SetDryRun sets the dry-run mode of the database. The transaction
+// in dry-run is only used for the plan and the secrets of the entities
+// are replaced by a placeholder.
+func (t *Transaction) SetDryRun(dryRun bool) {
+	t.db.SetDryRun(dryRun)
+}
+
+// Apply stages the apply of the entity.
+func (t *Transaction) Apply(e Entity, safe bool) error {
+	return t.ApplyMerged(e, e, safe)
+}
+
+// ApplyMerged stages the apply of the entity obtained by the merge of
+// the spec with the current entity. The ids of the entity are stored
+// in the lock if the spec has a dynamic id, also if the entity
+// already exists with a real id.
+func (t *Transaction) ApplyMerged(e, spec Entity, safe bool) error {
+	if err := t.check(e); err != nil {
+		return err
+	}
+	t.touch(e)
+
+	if t.idLock == nil {
+		return t.db.Apply(e, safe)
+	}
+
+	pinned, err := t.idLock.pin(t.db, e)
+	if err != nil {
+		return err
+	}
+	err = t.db.Apply(pinned, safe)
+	if err != nil {
+		return err
+	}
+	return t.idLock.record(t.db, spec)
+}
+
+// Create stages the creation of the entity.
+func (t *Transaction) Create(e Entity) error {
+	if err := t.check(e); err != nil {
+		return err
+	}
+	t.touch(e)
+
+	if t.idLock == nil {
+		return t.db.Create(e)
+	}
+
+	pinned, err := t.idLock.pin(t.db, e)
+	if err != nil {
+		return err
+	}
+	err = t.db.Create(pinned)
+	if err != nil {
+		return err
+	}
+	return t.idLock.record(t.db, e)
+}
+
+// Delete stages the remove of the entity.
+func (t *Transaction) Delete(e Entity) error {
+	if err := t.check(e); err != nil {
+		return err
+	}
+	return t.db.Delete(e)
+}
+
+// checkKinds checks that the transaction is open and that it manages
+// the files of the kinds.
+func (t *Transaction) checkKinds(kinds ...string) error {
+	if t.lock == nil {
+		return errors.New("Transaction already closed")
+	}
+	for _, kind := range kinds {
+		if !t.managed[kind] {
+			return errors.New("The transaction doesn't manage the " + kind + " file")
+		}
+	}
+	return nil
+}
+
+// DeleteUser stages the remove of the user from all the files.
+func (t *Transaction) DeleteUser(name string, opts DeleteUserOptions) error {
+	err := t.checkKinds(UserKind, GroupKind, ShadowKind, GShadowKind)
+	if err != nil {
+		return err
+	}
+	return DeleteUser(t.db, name, opts)
+}
+
+// AddGroupMembers stages the add of the users to the members of the
+// group.
+func (t *Transaction) AddGroupMembers(group string, users ...string) error {
+	err := t.checkKinds(GroupKind, GShadowKind)
+	if err != nil {
+		return err
+	}
+	return AddGroupMembers(t.db, group, users...)
+}
+
+// RemoveGroupMembers stages the remove of the users from the members
+// of the group.
+func (t *Transaction) RemoveGroupMembers(group string, users ...string) error {
+	err := t.checkKinds(GroupKind, GShadowKind)
+	if err != nil {
+		return err
+	}
+	return RemoveGroupMembers(t.db, group, users...)
+}
+
+// SetGroupMembers stages the replace of the members of the group.
+func (t *Transaction) SetGroupMembers(group string, users ...string) error {
+	err := t.checkKinds(GroupKind, GShadowKind)
+	if err != nil {
+		return err
+	}
+	return SetGroupMembers(t.db, group, users...)
+}
+
+// LockUser stages the lock of the password of the user.
+func (t *Transaction) LockUser(name string) error {
+	err := t.checkKinds(ShadowKind)
+	if err != nil {
+		return err
+	}
+	return LockUser(t.db, name)
+}
+
+// UnlockUser stages the unlock of the password of the user.
+func (t *Transaction) UnlockUser(name string) error {
+	err := t.checkKinds(ShadowKind)
+	if err != nil {
+		return err
+	}
+	return UnlockUser(t.db, name)
+}
+
+// ExpireUser stages the change of the account expiration of the user.
+func (t *Transaction) ExpireUser(name string, day int) error {
+	err := t.checkKinds(ShadowKind)
+	if err != nil {
+		return err
+	}
+	return ExpireUser(t.db, name, day)
+}
+
+// ForcePasswordChange stages the forced password change of the user.
+func (t *Transaction) ForcePasswordChange(name string) error {
+	err := t.checkKinds(ShadowKind)
+	if err != nil {
+		return err
+	}
+	return ForcePasswordChange(t.db, name)
+}
+
+// Validate checks the consistency between the staged files for the
+// entities created or modified in the transaction.
+func (t *Transaction) Validate() error {
+	problems := []string{}
+
+	users, err := t.db.GetFile(UserKind)
+	if err != nil {
+		return err
+	}
+	mUsers := make(map[string]UserPasswd)
+	for _, name := range users.Names() {
+		line, _ := users.Get(name)
+		if u, err := parseUserLine(line); err == nil {
+			mUsers[name] = u
+		}
+	}
+
+	groups, err := t.db.GetFile(GroupKind)
+	if err != nil {
+		return err
+	}
+	mGroups := make(map[string]Group)
+	for _, name := range groups.Names() {
+		line, _ := groups.Get(name)
+		if _, g, err := parseGroupLine(line); err == nil {
+			mGroups[name] = g
+		}
+	}
+
+	for name := range t.touched[UserKind] {
+		u, ok := mUsers[name]
+		if !ok {
+			continue
+		}
+		for _, e := range mUsers {
+			if e.Uid == u.Uid && e.Username != u.Username {
+				problems = append(problems, fmt.Sprintf(
+					"uid %d of user %s is already used by user %s", u.Uid, name, e.Username))
+			}
+		}
+	}
+
+	for name := range t.touched[GroupKind] {
+		g, ok := mGroups[name]
+		if !ok || g.Gid == nil {
+			continue
+		}
+		for _, e := range mGroups {
+			if e.Gid != nil && *e.Gid == *g.Gid && e.Name != g.Name {
+				problems = append(problems, fmt.Sprintf(
+					"gid %d of group %s is already used by group %s", *g.Gid, name, e.Name))
+			}
+		}
+	}
+
+	if len(t.touched[ShadowKind]) > 0 {
+		shadows, err := t.db.GetFile(ShadowKind)
+		if err != nil {
+			return err
+		}
+		for name := range t.touched[ShadowKind] {
+			if shadows.Has(name) && !users.Has(name) {
+				problems = append(problems, fmt.Sprintf(
+					"shadow entry %s without user", name))
+			}
+		}
+	}
+
+	if len(t.touched[GShadowKind]) > 0 {
+		gshadows, err := t.db.GetFile(GShadowKind)
+		if err != nil {
+			return err
+		}
+		for name := range t.touched[GShadowKind] {
+			if gshadows.Has(name) && !groups.Has(name) {
+				problems = append(problems, fmt.Sprintf(
+					"gshadow entry %s without group", name))
+			}
+		}
+	}
+
+	for _, kind := range []string{SubUidKind, SubGidKind} {
+		if len(t.touched[kind]) == 0 {
+			continue
+		}
+		subs, err := t.db.GetFile(kind)
+		if err != nil {
+			return err
+		}
+		ranges := subIdRanges(subs)
+		for _, s := range ranges {
+			if !t.touched[kind][s.Username] {
+				continue
+			}
+			for _, o := range ranges {
+				if o.Username != s.Username && o.Overlaps(s) {
+					problems = append(problems, fmt.Sprintf(
+						"%s range %d-%d of user %s overlaps the range of user %s",
+						kind, s.Start, s.End(), s.Username, o.Username))
+				}
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Inconsistent entities: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Commit validates the staged changes and replaces the modified files.
+// If one of the files can't be replaced the files already replaced are
+// restored. The transaction is closed in any case.
+func (t *Transaction) Commit() error {
+	if t.lock == nil {
+		return errors.New("Transaction already closed")
+	}
+	defer t.release()
+
+	err := t.Validate()
+	if err != nil {
+		return err
+	}
+
+	// The files not locked by the transaction are never written.
+	for _, kind := range t.db.modifiedKinds() {
+		if !t.managed[kind] {
+			return errors.New("The transaction doesn't manage the modified " + kind + " file")
+		}
+	}
+	kinds := []string{}
+	for _, kind := range txKinds {
+		if t.managed[kind] {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	return t.db.save(kinds)
+}
+
+// Rollback drops the staged changes and releases the locks.
+func (t *Transaction) Rollback() error {
+	if t.lock == nil {
+		return nil
+	}
+	return t.release()
+}
+
+func (t *Transaction) release() error {
+	var ans error
+	if t.lock != nil {
+		ans = t.lock.Unlock()
+		t.lock = nil
+	}
+	return ans
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func prepareTxFiles(tmpdir string) (string, string, string, string) {
+	usersFile := filepath.Join(tmpdir, "passwd")
+	groupsFile := filepath.Join(tmpdir, "group")
+	shadowFile := filepath.Join(tmpdir, "shadow")
+	gshadowFile := filepath.Join(tmpdir, "gshadow")
+
+	_, err := copy("../../testing/fixtures/simple/passwd", usersFile)
+	Expect(err).Should(BeNil())
+	_, err = copy("../../testing/fixtures/group/group", groupsFile)
+	Expect(err).Should(BeNil())
+	_, err = copy("../../testing/fixtures/shadow/shadow", shadowFile)
+	Expect(err).Should(BeNil())
+	_, err = copy("../../testing/fixtures/gshadow/gshadow", gshadowFile)
+	Expect(err).Should(BeNil())
+
+	return usersFile, groupsFile, shadowFile, gshadowFile
+}
+
+// writeTxFiles writes the passwd, group, shadow and gshadow files with
+// the contents and returns their paths.
+func writeTxFiles(tmpdir, passwd, group, shadow, gshadow string) (string, string, string, string) {
+	usersFile := filepath.Join(tmpdir, "passwd")
+	groupsFile := filepath.Join(tmpdir, "group")
+	shadowFile := filepath.Join(tmpdir, "shadow")
+	gshadowFile := filepath.Join(tmpdir, "gshadow")
+
+	files := map[string]string{
+		usersFile:   passwd,
+		groupsFile:  group,
+		shadowFile:  shadow,
+		gshadowFile: gshadow,
+	}
+	for f, content := range files {
+		Expect(ioutil.WriteFile(f, []byte(content), 0644)).Should(BeNil())
+	}
+
+	return usersFile, groupsFile, shadowFile, gshadowFile
+}
+
+func readFile(f string) string {
+	dat, err := ioutil.ReadFile(f)
+	Expect(err).Should(BeNil())
+	return string(dat)
+}
+
+var _ = Describe("Transaction", func() {
+	Context("Applying entities", func() {
+
+		It("Commits all files", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			usersFile, groupsFile, shadowFile, gshadowFile := prepareTxFiles(tmpdir)
+
+			tx, err := NewTransaction(usersFile, groupsFile, shadowFile, gshadowFile)
+			Expect(err).Should(BeNil())
+
+			gid := 1500
+			err = tx.Apply(Group{Name: "foo", Password: "x", Gid: &gid}, false)
+			Expect(err).Should(BeNil())
+			err = tx.Apply(UserPasswd{
+				Username: "foo",
+				Password: "x",
+				Uid:      1500,
+				Group:    "foo",
+				Info:     "Foo",
+				Homedir:  "/home/foo",
+				Shell:    "/bin/bash",
+			}, false)
+			Expect(err).Should(BeNil())
+			err = tx.Apply(Shadow{Username: "foo", Password: "!"}, false)
+			Expect(err).Should(BeNil())
+
+			// Nothing is written before the commit.
+			dat, err := ioutil.ReadFile(usersFile)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).ShouldNot(ContainSubstring("foo"))
+
+			err = tx.Commit()
+			Expect(err).Should(BeNil())
+
+			dat, err = ioutil.ReadFile(usersFile)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(ContainSubstring("foo:x:1500:1500:Foo:/home/foo:/bin/bash\n"))
+			dat, err = ioutil.ReadFile(groupsFile)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(ContainSubstring("foo:x:1500:\n"))
+			dat, err = ioutil.ReadFile(shadowFile)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(ContainSubstring("foo:!:::::::\n"))
+
+			_, err = os.Stat(usersFile + ".lock")
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+		})
+
+		It("Writes nothing on inconsistent changes", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			usersFile, groupsFile, shadowFile, gshadowFile := prepareTxFiles(tmpdir)
+
+			tx, err := NewTransaction(usersFile, groupsFile, shadowFile, gshadowFile)
+			Expect(err).Should(BeNil())
+
+			gid := 1500
+			err = tx.Apply(Group{Name: "foo", Password: "x", Gid: &gid}, false)
+			Expect(err).Should(BeNil())
+			err = tx.Apply(Shadow{Username: "foo", Password: "!"}, false)
+			Expect(err).Should(BeNil())
+
+			err = tx.Commit()
+			Expect(err).ShouldNot(BeNil())
+
+			dat, err := ioutil.ReadFile(groupsFile)
+			Expect(err).Should(BeNil())
+			orig, err := ioutil.ReadFile("../../testing/fixtures/group/group")
+			Expect(err).Should(BeNil())
+			Expect(dat).Should(Equal(orig))
+		})
+
+		It("Writes only the managed files", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			usersFile, groupsFile, _, gshadowFile := prepareTxFiles(tmpdir)
+			os.Setenv(ENTITY_ENV_DEF_GROUPS, groupsFile)
+			os.Setenv(ENTITY_ENV_DEF_GSHADOW, gshadowFile)
+			defer os.Unsetenv(ENTITY_ENV_DEF_GROUPS)
+			defer os.Unsetenv(ENTITY_ENV_DEF_GSHADOW)
+
+			tx, err := NewEntityTransaction(UserKind, usersFile)
+			Expect(err).Should(BeNil())
+
+			// The primary group changes the unlocked group and gshadow files.
+			err = tx.Apply(UserPasswd{
+				Username:    "foo",
+				Password:    "x",
+				Uid:         1500,
+				CreateGroup: true,
+				Homedir:     "/home/foo",
+				Shell:       "/bin/bash",
+			}, false)
+			Expect(err).Should(BeNil())
+
+			err = tx.Commit()
+			Expect(err).ShouldNot(BeNil())
+			Expect(err.Error()).Should(ContainSubstring("doesn't manage the modified group file"))
+
+			for file, fixture := range map[string]string{
+				usersFile:  "../../testing/fixtures/simple/passwd",
+				groupsFile: "../../testing/fixtures/group/group",
+			} {
+				dat, err := ioutil.ReadFile(file)
+				Expect(err).Should(BeNil())
+				orig, err := ioutil.ReadFile(fixture)
+				Expect(err).Should(BeNil())
+				Expect(dat).Should(Equal(orig))
+			}
+		})
+	})
+})
@@ -5,16 +5,14 @@ See AUTHORS and LICENSE for the license details and contributors.
 package entities
 
 import (
-	"bytes"
+	"bufio"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"strconv"
 	"strings"
 
-	permbits "github.com/phayes/permbits"
 	"github.com/pkg/errors"
-	passwd "github.com/willdonnelly/passwd"
 	"gopkg.in/yaml.v3"
 )
 
@@ -26,32 +24,27 @@ func UserDefault(s string) string {
 			s = "/etc/passwd"
 		}
 	}
-	return s
+	return RootPath(s)
 }
 
-func userGetFreeUid(path string) (int, error) {
-	uidStart, uidEnd := DynamicRange()
-	mUids := make(map[int]*UserPasswd)
-	ans := -1
+func userGetFreeUid(db *Database, r IdRange) (int, error) {
+	mUids := make(map[int]bool)
 
-	current, err := ParseUser(path)
+	f, err := db.GetFile(UserKind)
 	if err != nil {
-		return ans, err
+		return -1, err
 	}
 
-	for _, e := range current {
-		mUids[e.Uid] = &e
-	}
-
-	for i := uidStart; i >= uidEnd; i-- {
-		if _, ok := mUids[i]; !ok {
-			ans = i
-			break
+	for _, name := range f.Names() {
+		line, _ := f.Get(name)
+		if e, err := parseUserLine(line); err == nil {
+			mUids[e.Uid] = true
 		}
 	}
 
-	if ans < 0 {
-		return ans, errors.New("No free UID found")
+	ans, ok := getFreeId(r, mUids)
+	if !ok {
+		return ans, errors.New("No free UID found in range " + r.String())
 	}
 
 	return ans, nil
@@ -66,89 +59,357 @@ type UserPasswd struct {
 	Info     string `yaml:"info" json:"info"`
 	Homedir  string `yaml:"homedir" json:"homedir"`
 	Shell    string `yaml:"shell" json:"shell"`
+
+	// Options used on dynamic uid allocation
+	System   bool   `yaml:"system,omitempty" json:"system,omitempty"`
+	UidRange string `yaml:"uid_range,omitempty" json:"uid_range,omitempty"`
+
+	// Create the primary group with the name of the user (or the
+	// name defined in Group) and the gid equal to the uid if free.
+	CreateGroup bool `yaml:"create_group,omitempty" json:"create_group,omitempty"`
+	// Set the gid with the value of the uid. It's defined in the
+	// specs with gid: same-as-uid.
+	GidSameAsUid bool `yaml:"-" json:"-"`
+
+	// Options used on the home directory management. The paths are
+	// resolved under the home prefix.
+	CreateHome  bool   `yaml:"create_home,omitempty" json:"create_home,omitempty"`
+	HomeMode    string `yaml:"home_mode,omitempty" json:"home_mode,omitempty"`
+	Skel        string `yaml:"skel,omitempty" json:"skel,omitempty"`
+	RemoveHome  bool   `yaml:"remove_home,omitempty" json:"remove_home,omitempty"`
+	ArchiveHome string `yaml:"archive_home,omitempty" json:"archive_home,omitempty"`
+
+	// Order of the merge of the entity. Lower values are merged first.
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
+
+	// Strategy used to merge the uid, gid and password: union
+	// maintains the current values, replace uses the values of
+	// the spec.
+	MergeStrategy string `yaml:"merge_strategy,omitempty" json:"merge_strategy,omitempty"`
+
+	// The primary group to create on write.
+	primaryGroup *Group
+	// The gid of the primary group to create pinned by the lock file.
+	primaryGid *int
 }
 
-func ParseUser(path string) (map[string]UserPasswd, error) {
-	ans := make(map[string]UserPasswd, 0)
+// GidSameAsUidValue is the value of the gid field of the specs
+// that sets the gid with the same value of the uid.
+const GidSameAsUidValue = "same-as-uid"
+
+// UnmarshalYAML handles the gid field with the value same-as-uid.
+func (u *UserPasswd) UnmarshalYAML(value *yaml.Node) error {
+	type plain UserPasswd
+
+	sameAsUid := false
+	if value.Kind == yaml.MappingNode {
+		node := *value
+		node.Content = make([]*yaml.Node, len(value.Content))
+		copy(node.Content, value.Content)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v := node.Content[i+1]
+			if node.Content[i].Value == "gid" && v.Kind == yaml.ScalarNode &&
+				v.Value == GidSameAsUidValue {
+				sameAsUid = true
+				node.Content[i+1] = &yaml.Node{
+					Kind:  yaml.ScalarNode,
+					Tag:   "!!int",
+					Value: "-1",
+				}
+			}
+		}
+		value = &node
+	}
+
+	var p plain
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	*u = UserPasswd(p)
+	u.GidSameAsUid = sameAsUid
+
+	return nil
+}
 
-	// Check if file exists and avoid to call ParseFile
-	// if the file is not present.
+// ParseUser opens the file and parses it into a map from usernames to Entries
+func ParseUser(path string) (map[string]UserPasswd, error) {
 	_, err := os.Stat(path)
 	if err != nil {
+		ans := make(map[string]UserPasswd, 0)
 		if os.IsNotExist(err) {
 			return ans, nil
 		}
 		return ans, errors.Wrap(err, "Failed check file "+path)
 	}
 
-	current, err := passwd.ParseFile(path)
+	file, err := os.Open(path)
 	if err != nil {
-		return ans, errors.Wrap(err, "Failed parsing passwd")
-	}
-	_, err = permbits.Stat(path)
-	if err != nil {
-		return ans, errors.Wrap(err, "Failed getting permissions")
+		return nil, err
 	}
 
-	for k, v := range current {
+	defer file.Close()
+
+	return parsePasswdReader(path, file)
+}
+
+// ParsePasswdReader consumes the contents of r and parses it into a map from
+// usernames to Entries. Comments, empty lines and NIS entries are skipped.
+// The malformed lines are reported as warnings and skipped or
+// rejected in strict mode.
+func ParsePasswdReader(r io.Reader) (map[string]UserPasswd, error) {
+	return parsePasswdReader("", r)
+}
 
-		uid, err := strconv.Atoi(v.Uid)
+func parsePasswdReader(file string, r io.Reader) (map[string]UserPasswd, error) {
+	lines := bufio.NewReader(r)
+	entries := make(map[string]UserPasswd)
+	n := 0
+	for {
+		line, _, err := lines.ReadLine()
 		if err != nil {
-			fmt.Println(fmt.Sprintf(
-				"WARN: Found invalid uid for user %s: %s.\nSetting 0. Check the file soon.",
-				k, err.Error(),
-			))
-			uid = 0
+			break
 		}
-
-		gid, err := strconv.Atoi(v.Gid)
+		n++
+		content := string(copyBytes(line))
+		if lineKey(content) == "" {
+			continue
+		}
+		entry, err := parseUserLine(content)
 		if err != nil {
-			fmt.Println(fmt.Sprintf(
-				"WARN: Found invalid gid for user %s and uid %d: %s",
-				k, uid, err.Error(),
-			))
-			// Set gid with the same value of uid
-			gid = uid
+			if err = parseLineError(file, n, content, err); err != nil {
+				return nil, err
+			}
+			continue
 		}
+		entries[entry.Username] = entry
+	}
+	return entries, nil
+}
+
+func parseUserLine(line string) (UserPasswd, error) {
+	fs := strings.Split(line, ":")
+	if len(fs) != 7 {
+		return UserPasswd{}, newFieldsNumberError(7, len(fs))
+	}
+
+	if fs[0] == "" {
+		return UserPasswd{}, newParseError(ParseErrorEmptyName, 1, "username",
+			"Empty username")
+	}
+
+	uid, err := strconv.Atoi(fs[2])
+	if err != nil || uid < 0 {
+		return UserPasswd{}, newParseError(ParseErrorInvalidId, 3, "uid",
+			fmt.Sprintf("Invalid uid '%s' for user %s", fs[2], fs[0]))
+	}
+	gid, err := strconv.Atoi(fs[3])
+	if err != nil || gid < 0 {
+		return UserPasswd{}, newParseError(ParseErrorInvalidId, 4, "gid",
+			fmt.Sprintf("Invalid gid '%s' for user %s", fs[3], fs[0]))
+	}
+
+	return UserPasswd{
+		Username: fs[0],
+		Password: fs[1],
+		Uid:      uid,
+		Gid:      gid,
+		Info:     fs[4],
+		Homedir:  fs[5],
+		Shell:    fs[6],
+	}, nil
+}
 
-		ans[k] = UserPasswd{
-			Username: k,
-			Password: v.Pass,
-			Uid:      uid,
-			Gid:      gid,
-			Info:     v.Gecos,
-			Homedir:  v.Home,
-			Shell:    v.Shell,
+func (u UserPasswd) GetKind() string { return UserKind }
+
+// uidRange returns the range of the dynamic uid: the range of the
+// entity or the users or system users range of login.defs.
+func (u UserPasswd) uidRange(db *Database) (IdRange, error) {
+	if u.UidRange != "" {
+		return ParseIdRange(u.UidRange)
+	}
+	l, err := db.GetLoginDefs()
+	if err != nil {
+		return IdRange{}, err
+	}
+	return l.UidRange(u.System), nil
+}
+
+// getFreeUidGid returns the highest id of the range not used as uid
+// and as gid.
+func getFreeUidGid(db *Database, r IdRange) (int, error) {
+	used := make(map[int]bool)
+
+	users, err := db.GetFile(UserKind)
+	if err != nil {
+		return -1, err
+	}
+	for _, name := range users.Names() {
+		line, _ := users.Get(name)
+		if e, err := parseUserLine(line); err == nil {
+			used[e.Uid] = true
 		}
 	}
 
+	groups, err := db.GetFile(GroupKind)
+	if err != nil {
+		return -1, err
+	}
+	for _, name := range groups.Names() {
+		line, _ := groups.Get(name)
+		if _, e, err := parseGroupLine(line); err == nil {
+			used[*e.Gid] = true
+		}
+	}
+
+	// The joint ids are always allocated from the top of the range.
+	r.Descending = true
+	ans, ok := getFreeId(r, used)
+	if !ok {
+		return ans, errors.New("No free UID/GID found in range " + r.String())
+	}
+
 	return ans, nil
 }
 
-func (u UserPasswd) GetKind() string { return UserKind }
+// primaryGroupName returns the name of the primary group to create.
+func (u UserPasswd) primaryGroupName() string {
+	if u.Group != "" {
+		return u.Group
+	}
+	return u.Username
+}
+
+// preparePrimaryGroup sets the gid of the user with the gid of the
+// group to create or with the gid of the existing group.
+func (u UserPasswd) preparePrimaryGroup(db *Database) (UserPasswd, error) {
+	name := u.primaryGroupName()
+
+	groups, err := db.GetFile(GroupKind)
+	if err != nil {
+		return u, errors.Wrap(err, "Error on retrieve group information")
+	}
+
+	if groups.Has(name) {
+		// The group is already present. The gid is retrieved
+		// from the groups file.
+		u.Group = name
+		return u, nil
+	}
 
-func (u UserPasswd) prepare(s string) (UserPasswd, error) {
+	// Use the gid of the lock file, the uid as gid if it's free or a
+	// gid of the range.
+	gid := u.Uid
+	if u.primaryGid != nil {
+		gid = *u.primaryGid
+	} else {
+		for _, n := range groups.Names() {
+			line, _ := groups.Get(n)
+			if _, g, err := parseGroupLine(line); err == nil && *g.Gid == gid {
+				gid = -1
+				break
+			}
+		}
+	}
+
+	u.primaryGroup = &Group{
+		Name:     name,
+		Password: "x",
+		Gid:      &gid,
+		System:   u.System,
+	}
+	if gid < 0 {
+		gr, err := u.primaryGroup.gidRange(db)
+		if err != nil {
+			return u, err
+		}
+		gid, err = groupGetFreeGid(db, gr)
+		if err != nil {
+			return u, err
+		}
+	}
+	u.Gid = gid
+	u.Group = ""
+
+	return u, nil
+}
+
+// createPrimaryGroup writes the primary group prepared and the
+// gshadow entry if the gshadow file is present.
+func (u UserPasswd) createPrimaryGroup(db *Database) error {
+	if u.primaryGroup == nil {
+		return nil
+	}
+
+	err := u.primaryGroup.dbCreate(db)
+	if err != nil {
+		return errors.Wrap(err, "Error on create primary group")
+	}
+
+	gshadows, err := db.GetFile(GShadowKind)
+	if err != nil {
+		return err
+	}
+	if gshadows.Exists() && !gshadows.Has(u.primaryGroup.Name) {
+		gshadows.Set(u.primaryGroup.Name, GShadow{
+			Name:     u.primaryGroup.Name,
+			Password: "!",
+		}.String())
+	}
+
+	return nil
+}
+
+func (u UserPasswd) prepare(db *Database) (UserPasswd, error) {
 
 	if u.Uid < 0 {
 		// POST: dynamic user
 
-		uid, err := userGetFreeUid(s)
+		r, err := u.uidRange(db)
+		if err != nil {
+			return u, err
+		}
+		var uid int
+		if u.CreateGroup || u.GidSameAsUid {
+			// Search an id free for the user and the group.
+			uid, err = getFreeUidGid(db, r)
+		} else {
+			uid, err = userGetFreeUid(db, r)
+		}
 		if err != nil {
 			return u, err
 		}
 		u.Uid = uid
 	}
 
+	if u.GidSameAsUid {
+		u.Gid = u.Uid
+		u.GidSameAsUid = false
+	}
+
+	if u.CreateGroup {
+		var err error
+		u, err = u.preparePrimaryGroup(db)
+		if err != nil {
+			return u, err
+		}
+		// Avoid this operation if prepare is called multiple times.
+		u.CreateGroup = false
+	}
+
 	if u.Group != "" {
 		// POST: gid must be retrieved by existing file.
-		mGroups, err := ParseGroup(GroupsDefault(""))
+		groups, err := db.GetFile(GroupKind)
 		if err != nil {
 			return u, errors.Wrap(err, "Error on retrieve group information")
 		}
 
-		g, ok := mGroups[u.Group]
+		line, ok := groups.Get(u.Group)
 		if !ok {
-			return u, errors.Wrap(err, fmt.Sprintf("The group %s is not present", u.Group))
+			return u, errors.New(fmt.Sprintf("The group %s is not present", u.Group))
+		}
+		_, g, err := parseGroupLine(line)
+		if err != nil {
+			return u, errors.Wrap(err, "Error on retrieve group information")
 		}
 
 		u.Gid = *g.Gid
@@ -176,147 +437,126 @@ func (u UserPasswd) String() string {
 
 func (u UserPasswd) Delete(s string) error {
 	s = UserDefault(s)
-	input, err := ioutil.ReadFile(s)
-	if err != nil {
-		return errors.Wrap(err, "Could not read input file")
+	return updateDatabaseFile(UserKind, s, func(db *Database) error {
+		return u.dbDelete(db)
+	})
+}
+
+func (u UserPasswd) Create(s string) error {
+	s = UserDefault(s)
+	return updateDatabaseFile(UserKind, s, func(db *Database) error {
+		return u.dbCreate(db)
+	}, EntityKinds(u)...)
+}
+
+func (u UserPasswd) Apply(s string, safe bool) error {
+	if u.Username == "" {
+		return errors.New("Empty username field")
 	}
-	permissions, err := permbits.Stat(s)
+
+	s = UserDefault(s)
+	return updateDatabaseFile(UserKind, s, func(db *Database) error {
+		return u.dbApply(db, safe)
+	}, EntityKinds(u)...)
+}
+
+func (u UserPasswd) dbDelete(db *Database) error {
+	f, err := db.GetFile(UserKind)
 	if err != nil {
-		return errors.Wrap(err, "Failed getting permissions")
+		return err
+	}
+	if !f.Exists() {
+		return errors.New("Could not read input file " + f.GetPath())
+	}
+
+	// Drop the line which match the username. The home directory
+	// is retrieved from the current entry.
+	homedir, uid := u.Homedir, u.Uid
+	if line, ok := f.Get(u.Username); ok {
+		if cur, err := parseUserLine(line); err == nil {
+			homedir, uid = cur.Homedir, cur.Uid
+		}
 	}
-	lines := bytes.Replace(input, []byte(u.String()+"\n"), []byte(""), 1)
 
-	err = ioutil.WriteFile(s, []byte(lines), os.FileMode(permissions))
+	err = removeEntity(f, u.Username)
 	if err != nil {
-		return errors.Wrap(err, "Could not write")
+		return err
 	}
 
-	return nil
+	return u.prepareHomeRemove(db, homedir, uid)
 }
 
-func (u UserPasswd) Create(s string) error {
-	var f *os.File
-
-	s = UserDefault(s)
-
-	u, err := u.prepare(s)
+func (u UserPasswd) dbCreate(db *Database) error {
+	u, err := u.prepare(db)
 	if err != nil {
 		return errors.Wrap(err, "Failed entity preparation")
 	}
 
-	_, err = os.Stat(s)
-	if err == nil {
-		current, err := passwd.ParseFile(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed parsing passwd")
-		}
-		if _, ok := current[u.Username]; ok {
-			return errors.New("Entity already present")
-		}
-		permissions, err := permbits.Stat(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed getting permissions")
-		}
-		f, err = os.OpenFile(s, os.O_APPEND|os.O_WRONLY, os.FileMode(permissions))
-		if err != nil {
-			return errors.Wrap(err, "Could not read")
-		}
-
-	} else if os.IsNotExist(err) {
-		f, err = os.OpenFile(s, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			return errors.Wrap(err, "Could not create the file")
-		}
-	} else {
-		return errors.Wrap(err, "Error on stat file")
+	f, err := db.GetFile(UserKind)
+	if err != nil {
+		return err
+	}
+	if f.Has(u.Username) {
+		return errors.New("Entity already present")
 	}
 
-	defer f.Close()
+	f.Set(u.Username, u.String())
 
-	if _, err = f.WriteString(u.String() + "\n"); err != nil {
-		return errors.Wrap(err, "Could not write")
+	err = u.prepareHome(db)
+	if err != nil {
+		return err
 	}
-	return nil
+
+	return u.createPrimaryGroup(db)
 }
 
-func (u UserPasswd) Apply(s string, safe bool) error {
+func (u UserPasswd) dbApply(db *Database, safe bool) error {
 	if u.Username == "" {
 		return errors.New("Empty username field")
 	}
+	if err := CheckUserMergeStrategy(u.MergeStrategy); err != nil {
+		return err
+	}
 
-	s = UserDefault(s)
-
-	u, err := u.prepare(s)
+	u, err := u.prepare(db)
 	if err != nil {
 		return errors.Wrap(err, "Failed entity preparation")
 	}
 
-	_, err = os.Stat(s)
-	if err == nil {
-
-		current, err := ParseUser(s)
-		if err != nil {
-			return err
-		}
-
-		permissions, err := permbits.Stat(s)
-		if err != nil {
-			return errors.Wrap(err, "Failed getting permissions")
-		}
-
-		if safe {
-			mUids := make(map[int]*UserPasswd)
-
-			// Create uids map to check uid mismatch
-			// Maybe could be done always
-			for _, e := range current {
-				mUids[e.Uid] = &e
-			}
+	f, err := db.GetFile(UserKind)
+	if err != nil {
+		return err
+	}
 
-			if e, present := mUids[u.Uid]; present {
-				if e.Username != u.Username {
-					return errors.Wrap(err,
-						fmt.Sprintf("Uid %d is already used on user %s",
-							u.Uid, e.Username))
-				}
+	if safe {
+		// Check uid mismatch
+		for _, name := range f.Names() {
+			line, _ := f.Get(name)
+			e, err := parseUserLine(line)
+			if err == nil && e.Uid == u.Uid && e.Username != u.Username {
+				return errors.New(
+					fmt.Sprintf("Uid %d is already used on user %s",
+						u.Uid, e.Username))
 			}
 		}
+	}
 
-		if _, ok := current[u.Username]; ok {
-
-			input, err := ioutil.ReadFile(s)
-			if err != nil {
-				return errors.Wrap(err, "Could not read input file")
-			}
-
-			lines := strings.Split(string(input), "\n")
-
-			for i, line := range lines {
-				if entityIdentifier(line) == u.Username {
-					if !safe {
-						lines[i] = u.String()
-					}
-				}
-			}
-			output := strings.Join(lines, "\n")
-			err = ioutil.WriteFile(s, []byte(output), os.FileMode(permissions))
-			if err != nil {
-				return errors.Wrap(err, "Could not write")
-			}
-
-		} else {
-			// Add it
-			return u.Create(s)
+	if f.Has(u.Username) {
+		if !safe {
+			f.Set(u.Username, u.String())
+			return u.createPrimaryGroup(db)
 		}
-	} else if os.IsNotExist(err) {
-		return u.Create(s)
-	} else {
-		return errors.Wrap(err, "Could not stat file")
+		return nil
 	}
 
-	return nil
+	// Add it
+	return u.dbCreate(db)
 }
 
+// Merge merges the spec with the existing user. The options of the
+// dynamic allocation (system, uid_range and create_group) are used only
+// on the creation of the user and the priority and the merge strategy
+// only to merge the spec, so they aren't copied.
 func (u UserPasswd) Merge(e Entity) (Entity, error) {
 
 	if e.GetKind() != UserKind {
@@ -325,7 +565,29 @@ func (u UserPasswd) Merge(e Entity) (Entity, error) {
 
 	toMerge := e.(UserPasswd)
 
-	// Maintains original uid/gid, group and password.
+	err := CheckUserMergeStrategy(toMerge.MergeStrategy)
+	if err != nil {
+		return u, err
+	}
+
+	if toMerge.MergeStrategy == MergeStrategyReplace {
+		if toMerge.Uid >= 0 {
+			u.Uid = toMerge.Uid
+		}
+		if toMerge.GidSameAsUid {
+			u.Gid = u.Uid
+		} else if toMerge.Group != "" {
+			u.Group = toMerge.Group
+		} else if toMerge.Gid >= 0 {
+			u.Gid = toMerge.Gid
+		}
+		if toMerge.Password != "" {
+			u.Password = toMerge.Password
+		}
+	}
+
+	// Without the replace strategy maintains original uid/gid,
+	// group and password.
 
 	if toMerge.Info != "" {
 		u.Info = toMerge.Info
@@ -339,6 +601,22 @@ func (u UserPasswd) Merge(e Entity) (Entity, error) {
 		u.Shell = toMerge.Shell
 	}
 
+	if toMerge.CreateHome {
+		u.CreateHome = true
+	}
+	if toMerge.HomeMode != "" {
+		u.HomeMode = toMerge.HomeMode
+	}
+	if toMerge.Skel != "" {
+		u.Skel = toMerge.Skel
+	}
+	if toMerge.RemoveHome {
+		u.RemoveHome = true
+	}
+	if toMerge.ArchiveHome != "" {
+		u.ArchiveHome = toMerge.ArchiveHome
+	}
+
 	return u, nil
 }
 
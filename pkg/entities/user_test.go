@@ -5,9 +5,12 @@
 package entities_test
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	. "github.com/geaaru/entities/pkg/entities"
 
@@ -103,6 +106,36 @@ gpsd:x:139:14:added by portage for gpsd:/dev/null:/sbin/nologin
 `))
 		})
 
+		It("Deletes an entry by username", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			passwd := filepath.Join(tmpdir, "passwd")
+			err = ioutil.WriteFile(passwd, []byte(`root:x:0:0:root:/root:/bin/bash
+foo:x:1000:1000:Created by entities:/home/foo:/bin/bash
+`), 0644)
+			Expect(err).Should(BeNil())
+
+			err = UserPasswd{Username: "foo"}.Delete(passwd)
+			Expect(err).Should(BeNil())
+
+			dat, err := ioutil.ReadFile(passwd)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).To(Equal("root:x:0:0:root:/root:/bin/bash\n"))
+
+			err = UserPasswd{Username: "foo"}.Delete(passwd)
+			Expect(errors.Is(err, ErrNotFound)).Should(BeTrue())
+			Expect(err.(*NotFoundError).Name).Should(Equal("foo"))
+
+			gid := 1000
+			err = Group{Name: "foo", Gid: &gid}.Delete(filepath.Join(tmpdir, "passwd"))
+			Expect(errors.Is(err, ErrNotFound)).Should(BeTrue())
+			dat, err = ioutil.ReadFile(passwd)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).To(Equal("root:x:0:0:root:/root:/bin/bash\n"))
+		})
+
 		It("Read broken file", func() {
 			tmpFile, err := ioutil.TempFile(os.TempDir(), "pre-")
 			if err != nil {
@@ -123,26 +156,6 @@ gpsd:x:139:14:added by portage for gpsd:/dev/null:/sbin/nologin
 					Homedir:  "/home/foo",
 					Shell:    "/bin/bash",
 				},
-				"brokenuid": UserPasswd{
-					Username: "brokenuid",
-					Password: "x",
-					Uid:      0,
-					Gid:      100,
-					Group:    "",
-					Info:     "group",
-					Homedir:  "/home/broken",
-					Shell:    "/bin/bash",
-				},
-				"brokengid": UserPasswd{
-					Username: "brokengid",
-					Password: "x",
-					Uid:      100,
-					Gid:      100,
-					Group:    "",
-					Info:     "group",
-					Homedir:  "/home/broken",
-					Shell:    "/bin/bash",
-				},
 			}
 
 			dat := `root:x:0:0:Foo!:/home/foo:/bin/bash
@@ -153,11 +166,158 @@ brokengid:x:100::group:/home/broken:/bin/bash
 			tmpFile.WriteString(dat)
 			tmpFile.Close()
 
+			warnings := []*ParseError{}
+			SetParseWarningHandler(func(w *ParseError) {
+				warnings = append(warnings, w)
+			})
+			defer SetParseWarningHandler(nil)
+
+			// The broken users are skipped and never mapped to uid 0.
 			m, err := ParseUser(tmpFile.Name())
 			Expect(err).Should(BeNil())
 			Expect(m).Should(Equal(expectedMap))
+			Expect(len(warnings)).Should(Equal(2))
+			Expect(warnings[0].Error()).Should(Equal(
+				tmpFile.Name() + ":2: field 3 (uid): Invalid uid '' for user brokenuid"))
+			Expect(warnings[0].Kind).Should(Equal(ParseErrorInvalidId))
+			Expect(warnings[1].Line).Should(Equal(3))
+
+			os.Setenv(ENTITY_ENV_STRICT, "1")
+			defer os.Unsetenv(ENTITY_ENV_STRICT)
+
+			_, err = ParseUser(tmpFile.Name())
+			Expect(err).ShouldNot(BeNil())
+			Expect(err.Error()).Should(Equal(
+				tmpFile.Name() + ":2: field 3 (uid): Invalid uid '' for user brokenuid"))
+			pe, ok := err.(*ParseError)
+			Expect(ok).Should(BeTrue())
+			Expect(pe.Line).Should(Equal(2))
+			Expect(pe.Field).Should(Equal(3))
+		})
+
+		It("Read from reader", func() {
+			m, err := ParsePasswdReader(strings.NewReader(`# comment
+root:x:0:0:root:/root:/bin/bash
+
++@nisusers
+bin:x:1:1:bin:/bin:/bin/false
+`))
+			Expect(err).Should(BeNil())
+			Expect(len(m)).Should(Equal(2))
+			Expect(m["bin"].Homedir).Should(Equal("/bin"))
+		})
+
+	})
+
+	Context("Primary group", func() {
+		p := &Parser{}
+
+		It("Allocates the same id for user and group", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			// Use the default ranges of a missing login.defs
+			os.Setenv(ENTITY_ENV_DEF_LOGIN_DEFS, filepath.Join(tmpdir, "login.defs"))
+			defer os.Unsetenv(ENTITY_ENV_DEF_LOGIN_DEFS)
+
+			passwd := filepath.Join(tmpdir, "passwd")
+			group := filepath.Join(tmpdir, "group")
+			gshadow := filepath.Join(tmpdir, "gshadow")
+			err = ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/bash\n"), 0644)
+			Expect(err).Should(BeNil())
+			// The uid 999 is free but the gid 999 is used.
+			err = ioutil.WriteFile(group, []byte("root:x:0:\nother:x:999:\n"), 0644)
+			Expect(err).Should(BeNil())
+			err = ioutil.WriteFile(gshadow, []byte("root:!::\nother:!::\n"), 0644)
+			Expect(err).Should(BeNil())
+
+			entity, err := p.ReadEntityFromBytes([]byte(`
+kind: user
+username: foo
+password: x
+uid: -1
+system: true
+create_group: true
+homedir: /var/lib/foo
+shell: /sbin/nologin
+`))
+			Expect(err).Should(BeNil())
+			Expect(entity.(UserPasswd).CreateGroup).Should(BeTrue())
+
+			entity2, err := p.ReadEntityFromBytes([]byte(`
+kind: user
+username: bar
+password: x
+uid: -1
+gid: same-as-uid
+system: true
+homedir: /var/lib/bar
+shell: /sbin/nologin
+`))
+			Expect(err).Should(BeNil())
+			Expect(entity2.(UserPasswd).GidSameAsUid).Should(BeTrue())
+
+			db := NewDatabase(passwd, group, "", gshadow)
+			err = db.Apply(entity, true)
+			Expect(err).Should(BeNil())
+			err = db.Apply(entity2, true)
+			Expect(err).Should(BeNil())
+			err = db.Save()
+			Expect(err).Should(BeNil())
 
+			dat, err := ioutil.ReadFile(passwd)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(Equal(`root:x:0:0:root:/root:/bin/bash
+foo:x:998:998:Created by entities:/var/lib/foo:/sbin/nologin
+bar:x:997:997:Created by entities:/var/lib/bar:/sbin/nologin
+`))
+			dat, err = ioutil.ReadFile(group)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(Equal("root:x:0:\nother:x:999:\nfoo:x:998:\n"))
+			dat, err = ioutil.ReadFile(gshadow)
+			Expect(err).Should(BeNil())
+			Expect(string(dat)).Should(Equal("root:!::\nother:!::\nfoo:!::\n"))
 		})
 
+		It("Allocates the highest id free for user and group", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			loginDefs := filepath.Join(tmpdir, "login.defs")
+			err = ioutil.WriteFile(loginDefs, []byte("UID_MIN 2000\nUID_MAX 2010\n"), 0644)
+			Expect(err).Should(BeNil())
+			os.Setenv(ENTITY_ENV_DEF_LOGIN_DEFS, loginDefs)
+			defer os.Unsetenv(ENTITY_ENV_DEF_LOGIN_DEFS)
+
+			passwd := filepath.Join(tmpdir, "passwd")
+			group := filepath.Join(tmpdir, "group")
+			gshadow := filepath.Join(tmpdir, "gshadow")
+			err = ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/bash\nfirst:x:2000:2000::/:/bin/sh\n"), 0644)
+			Expect(err).Should(BeNil())
+			// The uid 2010 is free but the gid 2010 is used.
+			err = ioutil.WriteFile(group, []byte("root:x:0:\nother:x:2010:\n"), 0644)
+			Expect(err).Should(BeNil())
+			err = ioutil.WriteFile(gshadow, []byte(""), 0644)
+			Expect(err).Should(BeNil())
+
+			db := NewDatabase(passwd, group, "", gshadow)
+			err = db.Apply(UserPasswd{
+				Username:    "foo",
+				Password:    "x",
+				Uid:         -1,
+				CreateGroup: true,
+				Homedir:     "/home/foo",
+				Shell:       "/bin/bash",
+			}, true)
+			Expect(err).Should(BeNil())
+			Expect(db.Save()).Should(BeNil())
+
+			users, err := ParseUser(passwd)
+			Expect(err).Should(BeNil())
+			Expect(users["foo"].Uid).Should(Equal(2009))
+			Expect(users["foo"].Gid).Should(Equal(2009))
+		})
 	})
 })
@@ -0,0 +1,122 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"github.com/pkg/errors"
+)
+
+// DeleteUserOptions defines the optional operations of DeleteUser.
+type DeleteUserOptions struct {
+	// Remove the group with the name of the user if it's the primary
+	// group of the user and it isn't used by other users, like
+	// userdel does.
+	RemoveGroup bool
+	// Remove the home directory of the user.
+	RemoveHome bool
+	// Directory where to archive the home directory before the remove.
+	ArchiveHome string
+}
+
+// removeMember drops the user from the members lists of the fields of
+// the group or gshadow lines.
+func removeMember(f *DatabaseFile, user string, fields ...int) {
+	for _, name := range f.Names() {
+		for _, field := range fields {
+			updateMembers(f, name, field, func(members []string) []string {
+				return removeMembers(members, user)
+			})
+		}
+	}
+}
+
+// DeleteUser removes the user from the passwd and shadow files and from
+// the members lists of the group and gshadow files.
+func DeleteUser(db *Database, name string, opts DeleteUserOptions) error {
+	users, err := db.GetFile(UserKind)
+	if err != nil {
+		return err
+	}
+	line, ok := users.Get(name)
+	if !ok {
+		return &NotFoundError{Kind: UserKind, Name: name, File: users.GetPath()}
+	}
+	user, err := parseUserLine(line)
+	if err != nil {
+		return errors.Wrap(err, "Error on parse user "+name)
+	}
+	users.Remove(name)
+
+	shadows, err := db.GetFile(ShadowKind)
+	if err != nil {
+		return err
+	}
+	shadows.Remove(name)
+
+	groups, err := db.GetFile(GroupKind)
+	if err != nil {
+		return err
+	}
+	removeMember(groups, name, groupMembersField)
+
+	gshadows, err := db.GetFile(GShadowKind)
+	if err != nil {
+		return err
+	}
+	removeMember(gshadows, name, gshadowAdminsField, gshadowMembersField)
+
+	if opts.RemoveGroup {
+		err = removePrimaryGroup(db, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return UserPasswd{
+		Username:    name,
+		RemoveHome:  opts.RemoveHome,
+		ArchiveHome: opts.ArchiveHome,
+	}.prepareHomeRemove(db, user.Homedir, user.Uid)
+}
+
+// removePrimaryGroup removes the group with the name of the user if
+// it's the primary group of the user, it hasn't members and it isn't
+// the primary group of other users.
+func removePrimaryGroup(db *Database, user UserPasswd) error {
+	groups, err := db.GetFile(GroupKind)
+	if err != nil {
+		return err
+	}
+
+	line, ok := groups.Get(user.Username)
+	if !ok {
+		return nil
+	}
+	_, g, err := parseGroupLine(line)
+	if err != nil || *g.Gid != user.Gid || g.Users != "" {
+		return nil
+	}
+
+	users, err := db.GetFile(UserKind)
+	if err != nil {
+		return err
+	}
+	for _, name := range users.Names() {
+		line, _ := users.Get(name)
+		if u, err := parseUserLine(line); err == nil && u.Gid == user.Gid {
+			return nil
+		}
+	}
+
+	groups.Remove(user.Username)
+
+	gshadows, err := db.GetFile(GShadowKind)
+	if err != nil {
+		return err
+	}
+	gshadows.Remove(user.Username)
+
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DeleteUser", func() {
+	Context("Deleting a user from all files", func() {
+		var tmpdir string
+		var passwd, group, shadow, gshadow string
+
+		BeforeEach(func() {
+			var err error
+			tmpdir, err = ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+
+			passwd, group, shadow, gshadow = writeTxFiles(tmpdir, `root:x:0:0:root:/root:/bin/bash
+foo:x:1000:1000::/home/foo:/bin/bash
+bar:x:1001:1001::/home/bar:/bin/bash
+baz:x:1002:1000::/home/baz:/bin/bash
+`, `root:x:0:
+wheel:x:10:root,foo,bar
+foo:x:1000:
+bar:x:1001:
+`, `root:*:19000:0:99999:7:::
+foo:!:19000:0:99999:7:::
+bar:!:19000:0:99999:7:::
+baz:!:19000:0:99999:7:::
+`, `root:::
+wheel::foo:root,foo,bar
+foo:!::
+bar:!::
+`)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpdir)
+		})
+
+		It("Removes the user and the primary group", func() {
+			tx, err := NewTransaction(passwd, group, shadow, gshadow)
+			Expect(err).Should(BeNil())
+			Expect(tx.DeleteUser("bar", DeleteUserOptions{RemoveGroup: true})).Should(BeNil())
+			Expect(tx.Commit()).Should(BeNil())
+
+			Expect(readFile(passwd)).ShouldNot(ContainSubstring("bar"))
+			Expect(readFile(shadow)).ShouldNot(ContainSubstring("bar"))
+			Expect(readFile(group)).Should(Equal(`root:x:0:
+wheel:x:10:root,foo
+foo:x:1000:
+`))
+			Expect(readFile(gshadow)).Should(Equal(`root:::
+wheel::foo:root,foo
+foo:!::
+`))
+		})
+
+		It("Maintains the primary group used by other users", func() {
+			tx, err := NewTransaction(passwd, group, shadow, gshadow)
+			Expect(err).Should(BeNil())
+			Expect(tx.DeleteUser("foo", DeleteUserOptions{RemoveGroup: true})).Should(BeNil())
+			Expect(tx.Commit()).Should(BeNil())
+
+			Expect(readFile(group)).Should(Equal(`root:x:0:
+wheel:x:10:root,bar
+foo:x:1000:
+bar:x:1001:
+`))
+			Expect(readFile(gshadow)).Should(Equal(`root:::
+wheel:::root,bar
+foo:!::
+bar:!::
+`))
+		})
+
+		It("Refuses to remove the root and the shared homes", func() {
+			os.Setenv(ENTITY_ENV_HOME_PREFIX, tmpdir)
+			defer os.Unsetenv(ENTITY_ENV_HOME_PREFIX)
+
+			err := ioutil.WriteFile(passwd, []byte(`root:x:0:0:root:/root:/bin/bash
+foo:x:1000:1000::/home/foo:/bin/bash
+bar:x:1001:1001::/home/foo:/bin/bash
+baz:x:1002:1000::/:/bin/bash
+`), 0644)
+			Expect(err).Should(BeNil())
+			Expect(os.MkdirAll(filepath.Join(tmpdir, "home", "foo"), 0755)).Should(BeNil())
+
+			for _, name := range []string{"baz", "foo"} {
+				tx, err := NewTransaction(passwd, group, shadow, gshadow)
+				Expect(err).Should(BeNil())
+				err = tx.DeleteUser(name, DeleteUserOptions{RemoveHome: true})
+				Expect(err).ShouldNot(BeNil())
+				Expect(tx.Rollback()).Should(BeNil())
+			}
+
+			Expect(readFile(passwd)).Should(ContainSubstring("baz:x:1002"))
+			_, err = os.Stat(filepath.Join(tmpdir, "home", "foo"))
+			Expect(err).Should(BeNil())
+			_, err = os.Stat(passwd)
+			Expect(err).Should(BeNil())
+		})
+
+		It("Returns an error for a missing user", func() {
+			tx, err := NewTransaction(passwd, group, shadow, gshadow)
+			Expect(err).Should(BeNil())
+			defer tx.Rollback()
+			Expect(tx.DeleteUser("missing", DeleteUserOptions{})).ShouldNot(BeNil())
+		})
+	})
+})
@@ -0,0 +1,364 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	ValidationError   = "error"
+	ValidationWarning = "warning"
+)
+
+// Checks executed by the validation.
+const (
+	CheckParse           = "parse"
+	CheckDuplicateName   = "duplicate-name"
+	CheckDuplicateId     = "duplicate-id"
+	CheckMissingShadow   = "missing-shadow"
+	CheckShadowNoUser    = "shadow-without-user"
+	CheckMissingGShadow  = "missing-gshadow"
+	CheckGShadowNoGroup  = "gshadow-without-group"
+	CheckMembersMismatch = "members-mismatch"
+	CheckMissingGroup    = "missing-group"
+	CheckMissingHome     = "missing-home"
+	CheckInvalidShell    = "invalid-shell"
+	CheckDanglingMember  = "dangling-member"
+	CheckEmptyPassword   = "empty-password"
+	CheckWeakHash        = "weak-hash"
+	CheckInvalidHash     = "invalid-hash"
+)
+
+// ValidationProblem describes an inconsistency found in the files.
+type ValidationProblem struct {
+	Severity string      `json:"severity" yaml:"severity"`
+	Check    string      `json:"check" yaml:"check"`
+	Kind     string      `json:"kind" yaml:"kind"`
+	Name     string      `json:"name,omitempty" yaml:"name,omitempty"`
+	File     string      `json:"file" yaml:"file"`
+	Line     int         `json:"line,omitempty" yaml:"line,omitempty"`
+	Message  string      `json:"message" yaml:"message"`
+	Error    *ParseError `json:"parse_error,omitempty" yaml:"parse_error,omitempty"`
+}
+
+// ValidationReport contains the problems found by the validation.
+type ValidationReport struct {
+	Problems []ValidationProblem `json:"problems" yaml:"problems"`
+	Errors   int                 `json:"errors" yaml:"errors"`
+	Warnings int                 `json:"warnings" yaml:"warnings"`
+}
+
+func (r *ValidationReport) add(p ValidationProblem) {
+	r.Problems = append(r.Problems, p)
+	if p.Severity == ValidationError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+// Valid returns true if no errors are been found. The warnings
+// are ignored.
+func (r *ValidationReport) Valid() bool { return r.Errors == 0 }
+
+// validationEntry is a parsed line with its position.
+type validationEntry struct {
+	line   int
+	fields []string
+}
+
+// validationFile contains the valid entries of a file indexed by name.
+type validationFile struct {
+	file    *DatabaseFile
+	entries []validationEntry
+	byName  map[string]validationEntry
+}
+
+func (v *validationFile) has(name string) bool {
+	_, ok := v.byName[name]
+	return ok
+}
+
+// loadValidationFile parses the lines of the file reporting the malformed
+// lines and the duplicated names. The entries with the same name after
+// the first are not indexed.
+func loadValidationFile(db *Database, kind string, r *ValidationReport,
+	parse func(line string) error) (*validationFile, error) {
+
+	f, err := db.GetFile(kind)
+	if err != nil {
+		return nil, err
+	}
+	ans := &validationFile{
+		file:   f,
+		byName: make(map[string]validationEntry),
+	}
+
+	for i, line := range f.Lines() {
+		if lineKey(line) == "" {
+			continue
+		}
+		if err := parse(line); err != nil {
+			// The passwords of the secret files are never reported.
+			content := line
+			if kind == ShadowKind || kind == GShadowKind {
+				content = redactLine(line)
+			}
+			pe := toParseError(f.GetPath(), i+1, content, err)
+			r.add(ValidationProblem{
+				Severity: ValidationError,
+				Check:    CheckParse,
+				Kind:     kind,
+				Name:     entityIdentifier(content),
+				File:     f.GetPath(),
+				Line:     i + 1,
+				Message:  pe.Message,
+				Error:    pe,
+			})
+			continue
+		}
+
+		e := validationEntry{line: i + 1, fields: strings.Split(line, ":")}
+		name := e.fields[0]
+		if prev, ok := ans.byName[name]; ok {
+			r.add(ValidationProblem{
+				Severity: ValidationError,
+				Check:    CheckDuplicateName,
+				Kind:     kind,
+				Name:     name,
+				File:     f.GetPath(),
+				Line:     e.line,
+				Message: fmt.Sprintf("%s is already defined at line %d",
+					name, prev.line),
+			})
+			continue
+		}
+		ans.byName[name] = e
+		ans.entries = append(ans.entries, e)
+	}
+
+	return ans, nil
+}
+
+// checkDuplicateIds reports the entries with an id already used by
+// a previous entry.
+func checkDuplicateIds(v *validationFile, kind, idName string, r *ValidationReport) {
+	ids := make(map[string]string)
+	for _, e := range v.entries {
+		if prev, ok := ids[e.fields[2]]; ok {
+			r.add(ValidationProblem{
+				Severity: ValidationError,
+				Check:    CheckDuplicateId,
+				Kind:     kind,
+				Name:     e.fields[0],
+				File:     v.file.GetPath(),
+				Line:     e.line,
+				Message: fmt.Sprintf("%s %s of %s is already used by %s",
+					idName, e.fields[2], e.fields[0], prev),
+			})
+			continue
+		}
+		ids[e.fields[2]] = e.fields[0]
+	}
+}
+
+// checkMembers reports the members of the list that aren't present
+// in the users file.
+func checkMembers(v *validationFile, e validationEntry, field int, descr string,
+	users *validationFile, r *ValidationReport) {
+	for _, m := range Unique(strings.Split(e.fields[field], ",")) {
+		if !users.has(m) {
+			r.add(ValidationProblem{
+				Severity: ValidationError,
+				Check:    CheckDanglingMember,
+				Kind:     v.file.GetKind(),
+				Name:     e.fields[0],
+				File:     v.file.GetPath(),
+				Line:     e.line,
+				Message: fmt.Sprintf("%s %s of group %s is not present",
+					descr, m, e.fields[0]),
+			})
+		}
+	}
+}
+
+// ValidateDatabase checks the consistency of the passwd, group, shadow
+// and gshadow files like pwck and grpck do. The shadow and gshadow
+// checks are executed only if the files are present.
+func ValidateDatabase(db *Database) (*ValidationReport, error) {
+	r := &ValidationReport{Problems: []ValidationProblem{}}
+
+	users, err := loadValidationFile(db, UserKind, r, func(line string) error {
+		_, err := parseUserLine(line)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	groups, err := loadValidationFile(db, GroupKind, r, func(line string) error {
+		_, _, err := parseGroupLine(line)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	shadows, err := loadValidationFile(db, ShadowKind, r, func(line string) error {
+		_, _, err := parseLine(line)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	gshadows, err := loadValidationFile(db, GShadowKind, r, func(line string) error {
+		_, _, err := parseGShadowLine(line)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	checkDuplicateIds(users, UserKind, "uid", r)
+	checkDuplicateIds(groups, GroupKind, "gid", r)
+
+	gids := make(map[string]bool)
+	for _, e := range groups.entries {
+		gids[e.fields[2]] = true
+	}
+
+	// Check users
+	for _, e := range users.entries {
+		name := e.fields[0]
+		problem := ValidationProblem{
+			Kind: UserKind,
+			Name: name,
+			File: users.file.GetPath(),
+			Line: e.line,
+		}
+
+		if shadows.file.Exists() && !shadows.has(name) {
+			p := problem
+			p.Severity = ValidationError
+			p.Check = CheckMissingShadow
+			p.Message = fmt.Sprintf("user %s has no entry in %s",
+				name, shadows.file.GetPath())
+			r.add(p)
+		}
+
+		if !gids[e.fields[3]] {
+			p := problem
+			p.Severity = ValidationWarning
+			p.Check = CheckMissingGroup
+			p.Message = fmt.Sprintf("group %s of user %s is not present",
+				e.fields[3], name)
+			r.add(p)
+		}
+
+		home := e.fields[5]
+		if home != "" && home != "/nonexistent" {
+			if _, err := os.Stat(homePath(home)); err != nil {
+				p := problem
+				p.Severity = ValidationWarning
+				p.Check = CheckMissingHome
+				p.Message = fmt.Sprintf("directory %s of user %s does not exist",
+					home, name)
+				r.add(p)
+			}
+		}
+
+		shell := e.fields[6]
+		if shell != "" {
+			st, err := os.Stat(RootPath(shell))
+			if err != nil || st.IsDir() || st.Mode()&0111 == 0 {
+				p := problem
+				p.Severity = ValidationWarning
+				p.Check = CheckInvalidShell
+				p.Message = fmt.Sprintf("shell %s of user %s is not an executable",
+					shell, name)
+				r.add(p)
+			}
+		}
+	}
+
+	// Check shadow
+	for _, e := range shadows.entries {
+		if !users.has(e.fields[0]) {
+			r.add(ValidationProblem{
+				Severity: ValidationError,
+				Check:    CheckShadowNoUser,
+				Kind:     ShadowKind,
+				Name:     e.fields[0],
+				File:     shadows.file.GetPath(),
+				Line:     e.line,
+				Message:  fmt.Sprintf("no matching user %s", e.fields[0]),
+			})
+		}
+	}
+
+	// Check groups
+	for _, e := range groups.entries {
+		name := e.fields[0]
+		checkMembers(groups, e, 3, "member", users, r)
+
+		if !gshadows.file.Exists() {
+			continue
+		}
+
+		gs, ok := gshadows.byName[name]
+		if !ok {
+			r.add(ValidationProblem{
+				Severity: ValidationError,
+				Check:    CheckMissingGShadow,
+				Kind:     GroupKind,
+				Name:     name,
+				File:     groups.file.GetPath(),
+				Line:     e.line,
+				Message: fmt.Sprintf("group %s has no entry in %s",
+					name, gshadows.file.GetPath()),
+			})
+			continue
+		}
+
+		gMembers := Unique(strings.Split(e.fields[3], ","))
+		gsMembers := Unique(strings.Split(gs.fields[3], ","))
+		sort.Strings(gMembers)
+		sort.Strings(gsMembers)
+		if strings.Join(gMembers, ",") != strings.Join(gsMembers, ",") {
+			r.add(ValidationProblem{
+				Severity: ValidationWarning,
+				Check:    CheckMembersMismatch,
+				Kind:     GShadowKind,
+				Name:     name,
+				File:     gshadows.file.GetPath(),
+				Line:     gs.line,
+				Message: fmt.Sprintf("members of group %s are different: %s (%s) - %s (%s)",
+					name, strings.Join(gMembers, ","), groups.file.GetPath(),
+					strings.Join(gsMembers, ","), gshadows.file.GetPath()),
+			})
+		}
+	}
+
+	// Check gshadow
+	for _, e := range gshadows.entries {
+		if !groups.has(e.fields[0]) {
+			r.add(ValidationProblem{
+				Severity: ValidationError,
+				Check:    CheckGShadowNoGroup,
+				Kind:     GShadowKind,
+				Name:     e.fields[0],
+				File:     gshadows.file.GetPath(),
+				Line:     e.line,
+				Message:  fmt.Sprintf("no matching group %s", e.fields[0]),
+			})
+		}
+		checkMembers(gshadows, e, 2, "administrator", users, r)
+		checkMembers(gshadows, e, 3, "member", users, r)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validate", func() {
+	Context("Check entities files", func() {
+
+		writeFiles := func(dir string, files map[string]string) {
+			for name, content := range files {
+				err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+				Expect(err).Should(BeNil())
+			}
+		}
+
+		It("Reports the inconsistencies", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			writeFiles(tmpdir, map[string]string{
+				"passwd": `root:x:0:0:root:/:/bin/sh
+foo:x:1000:100::/:/bin/sh
+foo:x:1001:100::/:/bin/sh
+bar:x:0:0::/:/bin/sh
+bad:x:abc:0::/:/bin/sh
+`,
+				"group": `root:x:0:
+users:x:100:foo,ghost
+`,
+				"shadow": `root:!:::::::
+foo:!:::::::
+zed:!:::::::
+`,
+				"gshadow": `root:!::
+users:!::foo,ghost
+old:!::
+`,
+			})
+
+			db := NewDatabase(
+				filepath.Join(tmpdir, "passwd"),
+				filepath.Join(tmpdir, "group"),
+				filepath.Join(tmpdir, "shadow"),
+				filepath.Join(tmpdir, "gshadow"),
+			)
+			report, err := ValidateDatabase(db)
+			Expect(err).Should(BeNil())
+			Expect(report.Valid()).Should(BeFalse())
+
+			checks := map[string][]string{}
+			for _, p := range report.Problems {
+				checks[p.Check] = append(checks[p.Check], p.Name)
+			}
+			Expect(checks).Should(Equal(map[string][]string{
+				CheckDuplicateName:  []string{"foo"},
+				CheckParse:          []string{"bad"},
+				CheckDuplicateId:    []string{"bar"},
+				CheckMissingShadow:  []string{"bar"},
+				CheckShadowNoUser:   []string{"zed"},
+				CheckDanglingMember: []string{"users", "users"},
+				CheckGShadowNoGroup: []string{"old"},
+			}))
+			Expect(report.Errors).Should(Equal(8))
+			Expect(report.Warnings).Should(Equal(0))
+
+			for _, p := range report.Problems {
+				if p.Check == CheckParse {
+					Expect(p.Line).Should(Equal(5))
+					Expect(p.Error.Field).Should(Equal(3))
+					Expect(p.Error.Kind).Should(Equal(ParseErrorInvalidId))
+				}
+			}
+		})
+
+		It("Never reports the passwords of the malformed lines", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			writeFiles(tmpdir, map[string]string{
+				"passwd":  "root:x:0:0:root:/:/bin/sh\n",
+				"group":   "root:x:0:\n",
+				"shadow":  "root:!:::::::\nbad:$6$x$LEAKEDHASH:1:2\n",
+				"gshadow": "root:!::\nbad:$6$x$LEAKEDGHASH\n",
+			})
+
+			var warnings []*ParseError
+			SetParseWarningHandler(func(e *ParseError) {
+				warnings = append(warnings, e)
+			})
+			defer SetParseWarningHandler(nil)
+
+			db := NewDatabase(
+				filepath.Join(tmpdir, "passwd"),
+				filepath.Join(tmpdir, "group"),
+				filepath.Join(tmpdir, "shadow"),
+				filepath.Join(tmpdir, "gshadow"),
+			)
+			report, err := ValidateDatabase(db)
+			Expect(err).Should(BeNil())
+
+			parse := 0
+			for _, p := range report.Problems {
+				if p.Check == CheckParse {
+					parse++
+					Expect(p.Error.Content).Should(HavePrefix("bad:<redacted>"))
+				}
+			}
+			Expect(parse).Should(Equal(2))
+
+			data, err := json.Marshal(report)
+			Expect(err).Should(BeNil())
+			Expect(string(data)).ShouldNot(ContainSubstring("LEAKED"))
+
+			_, err = ParseShadow(filepath.Join(tmpdir, "shadow"))
+			Expect(err).Should(BeNil())
+			_, err = ParseGShadow(filepath.Join(tmpdir, "gshadow"))
+			Expect(err).Should(BeNil())
+			Expect(warnings).Should(HaveLen(2))
+			for _, w := range warnings {
+				Expect(w.Content).ShouldNot(ContainSubstring("LEAKED"))
+			}
+		})
+
+		It("Accepts consistent files", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			writeFiles(tmpdir, map[string]string{
+				"passwd": "# comment\nroot:x:0:0:root:/:/bin/sh\n+@nis\n",
+				"group":  "root:x:0:root\n",
+			})
+
+			db := NewDatabase(
+				filepath.Join(tmpdir, "passwd"),
+				filepath.Join(tmpdir, "group"),
+				filepath.Join(tmpdir, "shadow"),
+				filepath.Join(tmpdir, "gshadow"),
+			)
+			report, err := ValidateDatabase(db)
+			Expect(err).Should(BeNil())
+			Expect(report.Valid()).Should(BeTrue())
+			Expect(len(report.Problems)).Should(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,274 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Weak methods supported only to verify the old hashes.
+const (
+	HashMd5 = "md5"
+	HashDes = "des"
+)
+
+// ErrWeakHash is the error matched by errors.Is when the hash doesn't
+// meet the policy.
+var ErrWeakHash = errors.New("Weak password hash")
+
+// WeakHashError is returned when the hash doesn't meet the policy.
+type WeakHashError struct {
+	Method string
+	Rounds int
+	Reason string
+}
+
+func (e *WeakHashError) Error() string {
+	return e.Reason
+}
+
+// Is permits to check the error with errors.Is(err, ErrWeakHash).
+func (e *WeakHashError) Is(target error) bool {
+	return target == ErrWeakHash
+}
+
+// HashInfo describes the method and the rounds of a crypt(3) hash.
+// The rounds are the rounds of SHA-crypt and MD5-crypt, the cost of
+// bcrypt or the cost factor of yescrypt.
+type HashInfo struct {
+	Method string `json:"method" yaml:"method"`
+	Rounds int    `json:"rounds,omitempty" yaml:"rounds,omitempty"`
+}
+
+func isDesHash(hash string) bool {
+	if len(hash) != 13 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if cryptAtoi64(hash[i]) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseHash returns the method and the rounds of the hash. It returns
+// an error for the values that are not a hash (e.g. the locked
+// passwords).
+func ParseHash(hash string) (HashInfo, error) {
+	switch {
+	case strings.HasPrefix(hash, "$y$"):
+		fields := strings.Split(hash[3:], "$")
+		p, err := decodeYescryptParams(fields[0])
+		if err != nil {
+			return HashInfo{}, err
+		}
+		// The inverse of the parameters of the cost factor.
+		cost := bits.TrailingZeros64(p.n) + bits.Len32(p.r) - 1 - 12
+		return HashInfo{Method: HashYescrypt, Rounds: cost}, nil
+
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"),
+		strings.HasPrefix(hash, "$2y$"):
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return HashInfo{}, err
+		}
+		return HashInfo{Method: HashBcrypt, Rounds: cost}, nil
+
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		info := HashInfo{Method: HashSha512, Rounds: 5000}
+		if hash[1] == '5' {
+			info.Method = HashSha256
+		}
+		fields := strings.Split(hash[3:], "$")
+		if strings.HasPrefix(fields[0], "rounds=") {
+			n, err := strconv.Atoi(fields[0][7:])
+			if err != nil {
+				return HashInfo{}, errors.New("Invalid rounds of SHA-crypt hash")
+			}
+			info.Rounds = n
+		}
+		return info, nil
+
+	case strings.HasPrefix(hash, "$1$"):
+		return HashInfo{Method: HashMd5, Rounds: 1000}, nil
+
+	case isDesHash(hash):
+		return HashInfo{Method: HashDes, Rounds: 25}, nil
+	}
+
+	return HashInfo{}, errors.New("Unsupported password hash")
+}
+
+// VerifyPassword returns true if the password matches the crypt(3)
+// hash. It supports the yescrypt, bcrypt, SHA-crypt, MD5-crypt and DES
+// hashes.
+func VerifyPassword(password, hash string) (bool, error) {
+	info, err := ParseHash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	if info.Method == HashBcrypt {
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	check, err := Crypt(password, hash)
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare([]byte(check), []byte(hash)) == 1, nil
+}
+
+// HashPolicy defines the method and the minimum rounds of the password
+// hashes. With an empty method all the methods except MD5 and DES are
+// accepted.
+type HashPolicy struct {
+	Method    string `json:"method,omitempty" yaml:"method,omitempty"`
+	MinRounds int    `json:"min_rounds,omitempty" yaml:"min_rounds,omitempty"`
+}
+
+// NewHashPolicy returns the policy of the ENTITY_HASH and
+// ENTITY_HASH_ROUNDS env variables or of the ENCRYPT_METHOD and the
+// rounds of login.defs.
+func NewHashPolicy(l *LoginDefs) (HashPolicy, error) {
+	ans := HashPolicy{}
+
+	method := os.Getenv(ENTITY_ENV_HASH)
+	if method == "" && l != nil {
+		method, _ = l.Get("ENCRYPT_METHOD")
+		switch strings.ToUpper(method) {
+		case "DES", "MD5":
+			method = ""
+		}
+	}
+	if method == "" {
+		return ans, nil
+	}
+
+	method, err := ParseHashMethod(method)
+	if err != nil {
+		return ans, err
+	}
+	rounds, err := HashRounds(method, 0, l)
+	if err != nil {
+		return ans, err
+	}
+
+	ans.Method = method
+	ans.MinRounds = rounds
+	return ans, nil
+}
+
+// Check returns a WeakHashError if the hash doesn't meet the policy.
+func (p HashPolicy) Check(hash string) error {
+	info, err := ParseHash(hash)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Method == HashMd5 || info.Method == HashDes:
+		return &WeakHashError{Method: info.Method, Rounds: info.Rounds,
+			Reason: fmt.Sprintf("The %s method is weak", info.Method)}
+	case p.Method != "" && info.Method != p.Method:
+		return &WeakHashError{Method: info.Method, Rounds: info.Rounds,
+			Reason: fmt.Sprintf("The %s method is used instead of %s", info.Method, p.Method)}
+	case info.Rounds < p.MinRounds:
+		return &WeakHashError{Method: info.Method, Rounds: info.Rounds,
+			Reason: fmt.Sprintf("The %s hash has %d rounds instead of %d",
+				info.Method, info.Rounds, p.MinRounds)}
+	}
+
+	return nil
+}
+
+// CheckPasswordHashes checks the hashes of the shadow file with the
+// policy. The hashes are never reported. The empty passwords and the
+// weak hashes are errors, the weak hashes of the locked passwords and
+// the unsupported hashes are warnings. The locked passwords without a
+// hash are ignored.
+func CheckPasswordHashes(db *Database, p HashPolicy) (*ValidationReport, error) {
+	r := &ValidationReport{Problems: []ValidationProblem{}}
+
+	f, err := db.GetFile(ShadowKind)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, line := range f.Lines() {
+		if lineKey(line) == "" {
+			continue
+		}
+		name, s, err := parseLine(line)
+		if err != nil {
+			content := redactLine(line)
+			pe := toParseError(f.GetPath(), i+1, content, err)
+			r.add(ValidationProblem{
+				Severity: ValidationError,
+				Check:    CheckParse,
+				Kind:     ShadowKind,
+				Name:     entityIdentifier(content),
+				File:     f.GetPath(),
+				Line:     i + 1,
+				Message:  pe.Message,
+				Error:    pe,
+			})
+			continue
+		}
+
+		problem := ValidationProblem{
+			Severity: ValidationError,
+			Kind:     ShadowKind,
+			Name:     name,
+			File:     f.GetPath(),
+			Line:     i + 1,
+		}
+
+		hash := s.Password
+		if hash == "" {
+			problem.Check = CheckEmptyPassword
+			problem.Message = "The user has an empty password"
+			r.add(problem)
+			continue
+		}
+		if strings.HasPrefix(hash, "!") {
+			hash = strings.TrimLeft(hash, "!")
+			problem.Severity = ValidationWarning
+		}
+		if hash == "" || hash == "*" || hash == "x" {
+			continue
+		}
+
+		err = p.Check(hash)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrWeakHash) {
+			problem.Check = CheckWeakHash
+		} else {
+			// The unsupported hashes could not be checked.
+			problem.Check = CheckInvalidHash
+			problem.Severity = ValidationWarning
+		}
+		problem.Message = err.Error()
+		r.add(problem)
+	}
+
+	return r, nil
+}
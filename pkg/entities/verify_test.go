@@ -0,0 +1,177 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/geaaru/entities/pkg/entities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Password verification", func() {
+	hashes := map[string]string{
+		HashYescrypt: "$y$j9T$abcdefghijklmnop$7asOTx5b6Exfl3myM6K0pLBn.I2hsEvu7G0F7NMfaO.",
+		HashSha512:   "$6$rounds=5000$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/",
+		HashMd5:      "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/",
+		HashDes:      "abJnggxhB/yWI",
+	}
+
+	Context("Verifying the passwords", func() {
+		It("Verifies the hashes of all the methods", func() {
+			h, err := NewHasher(HashBcrypt, 4)
+			Expect(err).Should(BeNil())
+			bcryptHash, err := h.Hash("password")
+			Expect(err).Should(BeNil())
+
+			all := map[string]string{HashBcrypt: bcryptHash}
+			for method, hash := range hashes {
+				all[method] = hash
+			}
+
+			for method, hash := range all {
+				ok, err := VerifyPassword("password", hash)
+				Expect(err).Should(BeNil())
+				Expect(ok).Should(BeTrue(), method)
+
+				ok, err = VerifyPassword("wrong", hash)
+				Expect(err).Should(BeNil())
+				Expect(ok).Should(BeFalse(), method)
+
+				info, err := ParseHash(hash)
+				Expect(err).Should(BeNil())
+				Expect(info.Method).Should(Equal(method))
+			}
+		})
+
+		It("Uses only the first 8 characters of DES", func() {
+			ok, err := VerifyPassword("verylongpassword12", "abosjNU668tCk")
+			Expect(err).Should(BeNil())
+			Expect(ok).Should(BeTrue())
+			ok, err = VerifyPassword("verylong", "abosjNU668tCk")
+			Expect(err).Should(BeNil())
+			Expect(ok).Should(BeTrue())
+		})
+
+		It("Rejects the values that are not a hash", func() {
+			for _, v := range []string{"", "!", "*", "!$6$salt$hash", "$9$unknown"} {
+				_, err := VerifyPassword("password", v)
+				Expect(err).ShouldNot(BeNil(), v)
+			}
+		})
+
+		It("Parses the rounds of the hashes", func() {
+			info, err := ParseHash(hashes[HashYescrypt])
+			Expect(err).Should(BeNil())
+			Expect(info.Rounds).Should(Equal(5))
+
+			info, err = ParseHash("$5$rounds=10000$salt$hash")
+			Expect(err).Should(BeNil())
+			Expect(info).Should(Equal(HashInfo{Method: HashSha256, Rounds: 10000}))
+
+			info, err = ParseHash("$6$salt$hash")
+			Expect(err).Should(BeNil())
+			Expect(info).Should(Equal(HashInfo{Method: HashSha512, Rounds: 5000}))
+		})
+	})
+
+	Context("Checking the policy", func() {
+		It("Reports the weak hashes", func() {
+			p := HashPolicy{}
+			Expect(p.Check(hashes[HashSha512])).Should(BeNil())
+			Expect(p.Check(hashes[HashYescrypt])).Should(BeNil())
+			Expect(errors.Is(p.Check(hashes[HashMd5]), ErrWeakHash)).Should(BeTrue())
+			Expect(errors.Is(p.Check(hashes[HashDes]), ErrWeakHash)).Should(BeTrue())
+
+			p = HashPolicy{Method: HashYescrypt, MinRounds: 5}
+			Expect(p.Check(hashes[HashYescrypt])).Should(BeNil())
+			Expect(errors.Is(p.Check(hashes[HashSha512]), ErrWeakHash)).Should(BeTrue())
+
+			p = HashPolicy{Method: HashSha512, MinRounds: 10000}
+			err := p.Check(hashes[HashSha512])
+			Expect(errors.Is(err, ErrWeakHash)).Should(BeTrue())
+			Expect(err.Error()).Should(ContainSubstring("5000 rounds instead of 10000"))
+		})
+
+		It("Reads the policy from login.defs", func() {
+			l, err := ParseLoginDefsReader(strings.NewReader(
+				"ENCRYPT_METHOD SHA512\nSHA_CRYPT_MIN_ROUNDS 8000\n"))
+			Expect(err).Should(BeNil())
+			p, err := NewHashPolicy(l)
+			Expect(err).Should(BeNil())
+			Expect(p).Should(Equal(HashPolicy{Method: HashSha512, MinRounds: 8000}))
+
+			l, err = ParseLoginDefsReader(strings.NewReader("ENCRYPT_METHOD MD5\n"))
+			Expect(err).Should(BeNil())
+			p, err = NewHashPolicy(l)
+			Expect(err).Should(BeNil())
+			Expect(p).Should(Equal(HashPolicy{}))
+		})
+
+		It("Checks the hashes of the shadow file", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			shadow := filepath.Join(tmpdir, "shadow")
+			content := strings.Join([]string{
+				"root:" + hashes[HashYescrypt] + ":19000:0:99999:7:::",
+				"daemon:*:19000:0:99999:7:::",
+				"old:" + hashes[HashMd5] + ":19000:0:99999:7:::",
+				"locked:!" + hashes[HashDes] + ":19000:0:99999:7:::",
+				"empty::19000:0:99999:7:::",
+				"",
+			}, "\n")
+			Expect(ioutil.WriteFile(shadow, []byte(content), 0640)).Should(BeNil())
+
+			db := NewDatabaseFromPaths(map[string]string{ShadowKind: shadow})
+			r, err := CheckPasswordHashes(db, HashPolicy{})
+			Expect(err).Should(BeNil())
+			Expect(r.Errors).Should(Equal(2))
+			Expect(r.Warnings).Should(Equal(1))
+
+			checks := map[string]string{}
+			for _, p := range r.Problems {
+				checks[p.Name] = p.Check
+				for _, h := range hashes {
+					Expect(p.Message).ShouldNot(ContainSubstring(h))
+				}
+			}
+			Expect(checks).Should(Equal(map[string]string{
+				"old":    CheckWeakHash,
+				"locked": CheckWeakHash,
+				"empty":  CheckEmptyPassword,
+			}))
+		})
+
+		It("Never reports the hash of the malformed lines", func() {
+			tmpdir, err := ioutil.TempDir(os.TempDir(), "entities-")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(tmpdir)
+
+			shadow := filepath.Join(tmpdir, "shadow")
+			err = ioutil.WriteFile(shadow, []byte("bad:$6$x$LEAKEDHASH:1:2\nnofields$6$x$LEAKEDHASH\n"), 0640)
+			Expect(err).Should(BeNil())
+
+			db := NewDatabaseFromPaths(map[string]string{ShadowKind: shadow})
+			r, err := CheckPasswordHashes(db, HashPolicy{})
+			Expect(err).Should(BeNil())
+			Expect(r.Errors).Should(Equal(2))
+			Expect(r.Problems[0].Error.Content).Should(Equal("bad:<redacted>:1:2"))
+
+			data, err := json.Marshal(r)
+			Expect(err).Should(BeNil())
+			Expect(string(data)).ShouldNot(ContainSubstring("LEAKEDHASH"))
+			Expect(string(data)).Should(ContainSubstring(`"parse_error"`))
+		})
+	})
+})
@@ -0,0 +1,657 @@
+/*
+Copyright © 2022 Funtoo Macaroni OS Linux
+See AUTHORS and LICENSE for the license details and contributors.
+*/
+package entities
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Implementation of the yescrypt hashes of libxcrypt ($y$) with the
+// default pwxform settings, without ROM and hash upgrades. It follows
+// the reference implementation of yescrypt 1.1.
+
+const (
+	yescryptRW       = 0x002
+	yescryptDefaults = 0x0b6
+	yescryptPrehash  = 0x10000000
+
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	pwxWords  = pwxGather * pwxSimple * 2
+	sWidth    = 8
+	sWords    = 3 * (1 << sWidth) * pwxSimple * 2
+	sMask     = ((1 << sWidth) - 1) * pwxSimple * 8
+	sBoxWords = (1 << sWidth) * pwxSimple * 2
+)
+
+const cryptItoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+type yescryptParams struct {
+	flags uint32
+	n     uint64
+	r     uint32
+	p     uint32
+	t     uint32
+}
+
+// yescryptCostParams returns the parameters of the cost factor (1-11)
+// like the YESCRYPT_COST_FACTOR of login.defs.
+func yescryptCostParams(cost int) (yescryptParams, error) {
+	if cost < 1 || cost > 11 {
+		return yescryptParams{}, errors.Errorf("Invalid yescrypt cost factor %d: expected 1-11", cost)
+	}
+	ans := yescryptParams{flags: yescryptDefaults, p: 1}
+	if cost < 3 {
+		ans.r = 8
+		ans.n = 1 << uint(cost+9)
+	} else {
+		ans.r = 32
+		ans.n = 1 << uint(cost+7)
+	}
+	return ans, nil
+}
+
+func cryptAtoi64(c byte) uint32 {
+	i := strings.IndexByte(cryptItoa64, c)
+	if i < 0 {
+		return 64
+	}
+	return uint32(i)
+}
+
+// encode64 is the little-endian base64 encoding of yescrypt.
+func yescryptEncode64(src []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(src); {
+		value, nbits := uint32(0), 0
+		for nbits < 24 && i < len(src) {
+			value |= uint32(src[i]) << uint(nbits)
+			nbits += 8
+			i++
+		}
+		for b := 0; b < nbits; b += 6 {
+			sb.WriteByte(cryptItoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	return sb.String()
+}
+
+func yescryptDecode64(src string) ([]byte, error) {
+	ans := []byte{}
+	for len(src) > 0 {
+		value, nbits := uint32(0), 0
+		for len(src) > 0 && nbits < 24 {
+			c := cryptAtoi64(src[0])
+			if c > 63 {
+				return nil, errors.New("Invalid character in yescrypt encoding")
+			}
+			src = src[1:]
+			value |= c << uint(nbits)
+			nbits += 6
+		}
+		if nbits < 12 {
+			return nil, errors.New("Invalid length of yescrypt encoding")
+		}
+		for nbits >= 8 {
+			ans = append(ans, byte(value))
+			value >>= 8
+			nbits -= 8
+		}
+		if value != 0 {
+			return nil, errors.New("Invalid trailing bits in yescrypt encoding")
+		}
+	}
+	return ans, nil
+}
+
+func yescryptEncodeUint32(src, min uint32) string {
+	start, end, chars, nbits := uint32(0), uint32(47), 1, uint(0)
+
+	src -= min
+	for {
+		count := (end + 1 - start) << nbits
+		if src < count {
+			break
+		}
+		start = end + 1
+		end = start + (62-end)/2
+		src -= count
+		chars++
+		nbits += 6
+	}
+
+	var sb strings.Builder
+	sb.WriteByte(cryptItoa64[start+(src>>nbits)])
+	for chars--; chars > 0; chars-- {
+		nbits -= 6
+		sb.WriteByte(cryptItoa64[(src>>nbits)&0x3f])
+	}
+	return sb.String()
+}
+
+func yescryptDecodeUint32(src string, min uint32) (uint32, string, error) {
+	start, end, chars, nbits := uint32(0), uint32(47), 1, uint(0)
+
+	if src == "" {
+		return 0, src, errors.New("Truncated yescrypt parameters")
+	}
+	c := cryptAtoi64(src[0])
+	if c > 63 {
+		return 0, src, errors.New("Invalid yescrypt parameters")
+	}
+	src = src[1:]
+
+	ans := min
+	for c > end {
+		ans += (end + 1 - start) << nbits
+		start = end + 1
+		end = start + (62-end)/2
+		chars++
+		nbits += 6
+	}
+	ans += (c - start) << nbits
+
+	for chars--; chars > 0; chars-- {
+		if src == "" {
+			return 0, src, errors.New("Truncated yescrypt parameters")
+		}
+		c = cryptAtoi64(src[0])
+		if c > 63 {
+			return 0, src, errors.New("Invalid yescrypt parameters")
+		}
+		src = src[1:]
+		nbits -= 6
+		ans += c << nbits
+	}
+
+	return ans, src, nil
+}
+
+func (p yescryptParams) encode() string {
+	flavor := p.flags
+	if flavor >= yescryptRW {
+		flavor = yescryptRW + (p.flags >> 2)
+	}
+
+	ans := "$y$" + yescryptEncodeUint32(flavor, 0) +
+		yescryptEncodeUint32(uint32(bits.TrailingZeros64(p.n)), 1) +
+		yescryptEncodeUint32(p.r, 1)
+
+	have := uint32(0)
+	if p.p != 1 {
+		have |= 1
+	}
+	if p.t != 0 {
+		have |= 2
+	}
+	if have != 0 {
+		ans += yescryptEncodeUint32(have, 1)
+	}
+	if p.p != 1 {
+		ans += yescryptEncodeUint32(p.p, 2)
+	}
+	if p.t != 0 {
+		ans += yescryptEncodeUint32(p.t, 1)
+	}
+
+	return ans
+}
+
+func decodeYescryptParams(s string) (yescryptParams, error) {
+	ans := yescryptParams{p: 1}
+
+	flavor, s, err := yescryptDecodeUint32(s, 0)
+	if err != nil {
+		return ans, err
+	}
+	if flavor < yescryptRW {
+		ans.flags = flavor
+	} else if flavor <= yescryptRW+(0x3fc>>2) {
+		ans.flags = yescryptRW + ((flavor - yescryptRW) << 2)
+	} else {
+		return ans, errors.New("Invalid yescrypt flavor")
+	}
+	if ans.flags != yescryptDefaults {
+		return ans, errors.New("Unsupported yescrypt flavor")
+	}
+
+	nlog2, s, err := yescryptDecodeUint32(s, 1)
+	if err != nil {
+		return ans, err
+	}
+	if nlog2 > 63 {
+		return ans, errors.New("Invalid yescrypt N")
+	}
+	ans.n = uint64(1) << nlog2
+
+	ans.r, s, err = yescryptDecodeUint32(s, 1)
+	if err != nil {
+		return ans, err
+	}
+
+	if s != "" {
+		var have uint32
+		have, s, err = yescryptDecodeUint32(s, 1)
+		if err != nil {
+			return ans, err
+		}
+		if have&^3 != 0 {
+			return ans, errors.New("Unsupported yescrypt hash upgrades or ROM")
+		}
+		if have&1 != 0 {
+			ans.p, s, err = yescryptDecodeUint32(s, 2)
+			if err != nil {
+				return ans, err
+			}
+		}
+		if have&2 != 0 {
+			ans.t, s, err = yescryptDecodeUint32(s, 1)
+			if err != nil {
+				return ans, err
+			}
+		}
+		if s != "" {
+			return ans, errors.New("Invalid yescrypt parameters")
+		}
+	}
+
+	if ans.r == 0 || ans.p == 0 || ans.n < 4 ||
+		uint64(ans.r)*uint64(ans.p) >= 1<<30 ||
+		ans.n > (1<<32)/uint64(ans.r)/128 || uint64(ans.p) > ans.n {
+		return ans, errors.New("Invalid yescrypt parameters")
+	}
+
+	return ans, nil
+}
+
+// yescryptHash returns the crypt(3) string of the password with the
+// setting $y$<params>$<salt>.
+func yescryptHash(password, setting string) (string, error) {
+	if !strings.HasPrefix(setting, "$y$") {
+		return "", errors.New("Invalid yescrypt setting")
+	}
+	fields := strings.Split(setting[3:], "$")
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", errors.New("Invalid yescrypt setting")
+	}
+
+	params, err := decodeYescryptParams(fields[0])
+	if err != nil {
+		return "", err
+	}
+	salt, err := yescryptDecode64(fields[1])
+	if err != nil {
+		return "", err
+	}
+
+	dk, err := yescryptKdf([]byte(password), salt, params, 32)
+	if err != nil {
+		return "", err
+	}
+
+	return "$y$" + fields[0] + "$" + fields[1] + "$" + yescryptEncode64(dk), nil
+}
+
+func hmacSha256(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+func yescryptKdf(passwd, salt []byte, p yescryptParams, dkLen int) ([]byte, error) {
+	if p.n/uint64(p.p) >= 0x100 && p.n/uint64(p.p)*uint64(p.r) >= 0x20000 {
+		pre := p
+		pre.flags |= yescryptPrehash
+		pre.n >>= 6
+		pre.t = 0
+		dk, err := yescryptKdfBody(passwd, salt, pre, 32)
+		if err != nil {
+			return nil, err
+		}
+		passwd = dk
+	}
+	return yescryptKdfBody(passwd, salt, p, dkLen)
+}
+
+func yescryptKdfBody(passwd, salt []byte, p yescryptParams, dkLen int) ([]byte, error) {
+	key := "yescrypt"
+	if p.flags&yescryptPrehash != 0 {
+		key = "yescrypt-prehash"
+	}
+	passwd = hmacSha256([]byte(key), passwd)
+
+	b, err := pbkdf2.Key(sha256.New, string(passwd), salt, 1, 128*int(p.r)*int(p.p))
+	if err != nil {
+		return nil, err
+	}
+	passwd = append([]byte{}, b[:32]...)
+
+	s := 32 * int(p.r)
+	bw := make([]uint32, s*int(p.p))
+	for i := range bw {
+		bw[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+
+	passwd = yescryptSmix(bw, p, passwd)
+
+	for i := range bw {
+		binary.LittleEndian.PutUint32(b[4*i:], bw[i])
+	}
+
+	dk, err := pbkdf2.Key(sha256.New, string(passwd), b, 1, dkLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.flags&yescryptPrehash == 0 {
+		// The final steps match the StoredKey of SCRAM.
+		clientKey := hmacSha256(dk[:32], []byte("Client Key"))
+		storedKey := sha256.Sum256(clientKey)
+		copy(dk, storedKey[:])
+	}
+
+	return dk, nil
+}
+
+type pwxformCtx struct {
+	s          []uint32
+	s0, s1, s2 []uint32
+	w          int
+}
+
+func p2floor(x uint64) uint64 {
+	for y := x & (x - 1); y != 0; y = x & (x - 1) {
+		x = y
+	}
+	return x
+}
+
+func wrap(x, i uint64) uint64 {
+	n := p2floor(i)
+	return (x & (n - 1)) + (i - n)
+}
+
+func yescryptSmix(b []uint32, p yescryptParams, passwd []byte) []byte {
+	r := int(p.r)
+	s := 32 * r
+	n := p.n
+	nchunk := n / uint64(p.p)
+
+	nloopAll := nchunk
+	if p.t <= 1 {
+		if p.t != 0 {
+			nloopAll *= 2
+		}
+		nloopAll = (nloopAll + 2) / 3
+	} else {
+		nloopAll *= uint64(p.t) - 1
+	}
+	nloopRw := nloopAll / uint64(p.p)
+
+	nchunk &^= 1
+	nloopAll = (nloopAll + 1) &^ 1
+	nloopRw = (nloopRw + 1) &^ 1
+
+	v := make([]uint32, uint64(s)*n)
+	xy := make([]uint32, 2*s)
+	ctxs := make([]*pwxformCtx, p.p)
+
+	vchunk := uint64(0)
+	for i := 0; i < int(p.p); i++ {
+		np := nchunk
+		if i == int(p.p)-1 {
+			np = n - vchunk
+		}
+		bp := b[i*s : (i+1)*s]
+		vp := v[vchunk*uint64(s):]
+
+		ctx := &pwxformCtx{s: make([]uint32, sWords)}
+		smix1(bp, 1, sWords/32, 0, ctx.s, xy, nil)
+		ctx.s2 = ctx.s[0:sBoxWords]
+		ctx.s1 = ctx.s[sBoxWords : 2*sBoxWords]
+		ctx.s0 = ctx.s[2*sBoxWords:]
+		ctxs[i] = ctx
+
+		if i == 0 {
+			passwd = hmacSha256(u32ToBytes(bp[s-16:]), passwd)
+		}
+
+		smix1(bp, r, np, p.flags, vp, xy, ctx)
+		smix2(bp, r, p2floor(np), nloopRw, p.flags, vp, xy, ctx)
+
+		vchunk += nchunk
+	}
+
+	for i := 0; i < int(p.p); i++ {
+		smix2(b[i*s:(i+1)*s], r, n, nloopAll-nloopRw, p.flags&^yescryptRW, v, xy, ctxs[i])
+	}
+
+	return passwd
+}
+
+func u32ToBytes(w []uint32) []byte {
+	ans := make([]byte, 4*len(w))
+	for i, x := range w {
+		binary.LittleEndian.PutUint32(ans[4*i:], x)
+	}
+	return ans
+}
+
+// shuffle and unshuffle convert between the original order of the
+// salsa20 words and the SIMD order used by pwxform.
+func shuffle(x, b []uint32) {
+	for k := 0; k < len(b)/16; k++ {
+		for i := 0; i < 16; i++ {
+			x[k*16+i] = b[k*16+(i*5%16)]
+		}
+	}
+}
+
+func unshuffle(b, x []uint32) {
+	for k := 0; k < len(b)/16; k++ {
+		for i := 0; i < 16; i++ {
+			b[k*16+(i*5%16)] = x[k*16+i]
+		}
+	}
+}
+
+func integerify(b []uint32, r int) uint64 {
+	x := b[(2*r-1)*16:]
+	return uint64(x[13])<<32 + uint64(x[0])
+}
+
+func smix1(b []uint32, r int, n uint64, flags uint32, v, xy []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	x := xy[:s]
+	y := xy[s : 2*s]
+
+	shuffle(x, b[:s])
+
+	for i := uint64(0); i < n; i++ {
+		copy(v[i*uint64(s):(i+1)*uint64(s)], x)
+
+		if flags&yescryptRW != 0 && i > 1 {
+			j := wrap(integerify(x, r), i)
+			blkxor(x, v[j*uint64(s):(j+1)*uint64(s)])
+		}
+
+		if ctx != nil {
+			blockmixPwxform(x, r, ctx)
+		} else {
+			blockmixSalsa8(x, y, r)
+		}
+	}
+
+	unshuffle(b[:s], x)
+}
+
+func smix2(b []uint32, r int, n, nloop uint64, flags uint32, v, xy []uint32, ctx *pwxformCtx) {
+	if nloop == 0 {
+		return
+	}
+
+	s := 32 * r
+	x := xy[:s]
+	y := xy[s : 2*s]
+
+	shuffle(x, b[:s])
+
+	for i := uint64(0); i < nloop; i++ {
+		j := integerify(x, r) & (n - 1)
+		vj := v[j*uint64(s) : (j+1)*uint64(s)]
+		blkxor(x, vj)
+		if flags&yescryptRW != 0 {
+			copy(vj, x)
+		}
+
+		if ctx != nil {
+			blockmixPwxform(x, r, ctx)
+		} else {
+			blockmixSalsa8(x, y, r)
+		}
+	}
+
+	unshuffle(b[:s], x)
+}
+
+func blkxor(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func salsa20(b []uint32, rounds int) {
+	var x [16]uint32
+
+	for i := 0; i < 16; i++ {
+		x[i*5%16] = b[i]
+	}
+
+	for i := 0; i < rounds; i += 2 {
+		// Columns
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+		// Rows
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+
+	for i := 0; i < 16; i++ {
+		b[i] += x[i*5%16]
+	}
+}
+
+func blockmixSalsa8(b, y []uint32, r int) {
+	var x [16]uint32
+
+	copy(x[:], b[(2*r-1)*16:2*r*16])
+	for i := 0; i < 2*r; i++ {
+		blkxor(x[:], b[i*16:(i+1)*16])
+		salsa20(x[:], 8)
+		copy(y[i*16:(i+1)*16], x[:])
+	}
+
+	for i := 0; i < r; i++ {
+		copy(b[i*16:(i+1)*16], y[(2*i)*16:(2*i+1)*16])
+		copy(b[(i+r)*16:(i+r+1)*16], y[(2*i+1)*16:(2*i+2)*16])
+	}
+}
+
+func pwxform(b []uint32, ctx *pwxformCtx) {
+	s0, s1, s2 := ctx.s0, ctx.s1, ctx.s2
+	w := ctx.w
+
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			base := j * pwxSimple * 2
+			p0 := (b[base] & sMask) / 4
+			p1 := (b[base+1] & sMask) / 4
+
+			for k := 0; k < pwxSimple; k++ {
+				s0v := uint64(s0[p0+uint32(2*k)+1])<<32 + uint64(s0[p0+uint32(2*k)])
+				s1v := uint64(s1[p1+uint32(2*k)+1])<<32 + uint64(s1[p1+uint32(2*k)])
+
+				xl := b[base+2*k]
+				xh := b[base+2*k+1]
+
+				x := uint64(xh) * uint64(xl)
+				x += s0v
+				x ^= s1v
+
+				b[base+2*k] = uint32(x)
+				b[base+2*k+1] = uint32(x >> 32)
+
+				if i != 0 && i != pwxRounds-1 {
+					s2[2*w] = uint32(x)
+					s2[2*w+1] = uint32(x >> 32)
+					w++
+				}
+			}
+		}
+	}
+
+	ctx.s0, ctx.s1, ctx.s2 = s2, s0, s1
+	ctx.w = w & ((1<<sWidth)*pwxSimple - 1)
+}
+
+func blockmixPwxform(b []uint32, r int, ctx *pwxformCtx) {
+	var x [pwxWords]uint32
+
+	r1 := 128 * r / (pwxWords * 4)
+
+	copy(x[:], b[(r1-1)*pwxWords:r1*pwxWords])
+	for i := 0; i < r1; i++ {
+		if r1 > 1 {
+			blkxor(x[:], b[i*pwxWords:(i+1)*pwxWords])
+		}
+		pwxform(x[:], ctx)
+		copy(b[i*pwxWords:(i+1)*pwxWords], x[:])
+	}
+
+	i := (r1 - 1) * pwxWords / 16
+	salsa20(b[i*16:(i+1)*16], 2)
+
+	for i++; i < 2*r; i++ {
+		blkxor(b[i*16:(i+1)*16], b[(i-1)*16:i*16])
+		salsa20(b[i*16:(i+1)*16], 2)
+	}
+}